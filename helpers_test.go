@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Test helpers - a MockStub ledger with three companies and identities carrying fabric-ca attributes
+//
+// ProviderMSP is the service provider, CustomerMSP and OtherMSP are customers. The channel admin is a ProviderMSP
+// identity enrolled with "role=admin". Employees are identities with the "employee_sn" attribute.
+// ============================================================================================================================
+
+const (
+	providerMsp = "ProviderMSP"
+	customerMsp = "CustomerMSP"
+	otherMsp    = "OtherMSP"
+)
+
+// cid reads the attributes of an enrollment certificate from this extension
+var attrsOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+var (
+	signerOnce sync.Once
+	signer     *ecdsa.PrivateKey
+	serial     int64
+	serialLock sync.Mutex
+)
+
+// serialized identity of an enrollment certificate with the attributes, as returned by GetCreator()
+func creator(t *testing.T, mspId string, name string, attrs map[string]string) []byte {
+	signerOnce.Do(func() {
+		var err error
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	serialLock.Lock()
+	serial++
+	number := big.NewInt(serial)
+	serialLock.Unlock()
+
+	attrsAsBytes, _ := json.Marshal(map[string]map[string]string{"attrs": attrs})
+	template := &x509.Certificate{
+		SerialNumber:    number,
+		Subject:         pkix.Name{CommonName: name, OrganizationalUnit: []string{"client"}},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: attrsOID, Value: attrsAsBytes}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &signer.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := &msp.SerializedIdentity{Mspid: mspId, IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+	identityAsBytes, err := proto.Marshal(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identityAsBytes
+}
+
+// testStub fills in what the MockStub leaves out, the creator and transient map of the transaction, the key history of
+// the transactions it runs, private data range queries and deletes. Like a peer, and unlike the MockStub, it keeps the
+// writes of a transaction until the transaction ends so the transaction reads what was there before it
+type testStub struct {
+	*shim.MockStub
+	Creator      []byte
+	TransientMap map[string][]byte
+	history      map[string][]*queryresult.KeyModification
+	writes       []pendingWrite
+}
+
+type pendingWrite struct {
+	key   string
+	value []byte //nil deletes the key
+}
+
+// testChaincode runs the chaincode against the testStub when the MockStub invokes it
+type testChaincode struct {
+	stub *testStub
+}
+
+func (c *testChaincode) Init(shim.ChaincodeStubInterface) pb.Response {
+	res := new(SimpleChaincode).Init(c.stub)
+	c.stub.commit()
+	return res
+}
+
+func (c *testChaincode) Invoke(shim.ChaincodeStubInterface) pb.Response {
+	res := new(SimpleChaincode).Invoke(c.stub)
+	c.stub.commit()
+	return res
+}
+
+func newTestStub() *testStub {
+	s := &testStub{history: make(map[string][]*queryresult.KeyModification)}
+	s.MockStub = shim.NewMockStub("bluehack", &testChaincode{s})
+	return s
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.Creator, nil
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.TransientMap, nil
+}
+
+func (s *testStub) record(key string, value []byte, isDelete bool) {
+	modification := &queryresult.KeyModification{TxId: s.TxID, Value: value, Timestamp: s.TxTimestamp, IsDelete: isDelete}
+	modifications := s.history[key]
+	if len(modifications) > 0 && modifications[len(modifications)-1].TxId == s.TxID {
+		modifications[len(modifications)-1] = modification //the last write of a transaction wins
+		return
+	}
+	s.history[key] = append(modifications, modification)
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	if s.TxID == "" {
+		return errors.New("cannot PutState without a transactions - call stub.MockTransactionStart()?")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.writes = append(s.writes, pendingWrite{key, value})
+	s.record(key, value, false)
+	return nil
+}
+
+func (s *testStub) DelState(key string) error {
+	if s.TxID == "" {
+		return errors.New("cannot DelState without a transactions - call stub.MockTransactionStart()?")
+	}
+	s.writes = append(s.writes, pendingWrite{key, nil})
+	s.record(key, nil, true)
+	return nil
+}
+
+// write the pending writes of the transaction to the MockStub's state, the last write to a key wins
+func (s *testStub) commit() {
+	for _, write := range s.writes {
+		if write.value == nil {
+			s.MockStub.DelState(write.key)
+		} else {
+			s.MockStub.PutState(write.key, write.value)
+		}
+	}
+	s.writes = nil
+}
+
+func (s *testStub) MockTransactionEnd(uuid string) {
+	s.commit()
+	s.MockStub.MockTransactionEnd(uuid)
+}
+
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: s.history[key]}, nil
+}
+
+func (s *testStub) DelPrivateData(collection string, key string) error {
+	delete(s.PvtState[collection], key)
+	return nil
+}
+
+func (s *testStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range s.PvtState[collection] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	iterator := &kvIterator{}
+	for _, key := range keys {
+		iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: key, Value: s.PvtState[collection][key]})
+	}
+	return iterator, nil
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (i *historyIterator) HasNext() bool { return len(i.modifications) > 0 }
+func (i *historyIterator) Close() error  { return nil }
+func (i *historyIterator) Next() (*queryresult.KeyModification, error) {
+	modification := i.modifications[0]
+	i.modifications = i.modifications[1:]
+	return modification, nil
+}
+
+type kvIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (i *kvIterator) HasNext() bool { return len(i.kvs) > 0 }
+func (i *kvIterator) Close() error  { return nil }
+func (i *kvIterator) Next() (*queryresult.KV, error) {
+	kv := i.kvs[0]
+	i.kvs = i.kvs[1:]
+	return kv, nil
+}
+
+type testLedger struct {
+	t      *testing.T
+	stub   *testStub
+	tx     int
+	admin  []byte
+	events []*pb.ChaincodeEvent //events of the last transaction
+}
+
+// a bootstrapped ledger with the three companies registered, the caller is the admin
+func newTestLedger(t *testing.T) *testLedger {
+	return newLegacyTestLedger(t, nil)
+}
+
+// a ledger the chaincode from before bootstrapping wrote the documents to, bootstrapped like newTestLedger
+func newLegacyTestLedger(t *testing.T, legacy map[string]string) *testLedger {
+	l := &testLedger{t: t, stub: newTestStub()}
+	l.admin = creator(t, providerMsp, "admin", map[string]string{"role": ROLE_ADMIN})
+	l.stub.Creator = l.admin
+	adminId, err := cid.GetID(l.stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bootstrap := map[string]interface{}{
+		"admins":      []map[string]string{{"mspid": providerMsp, "id": adminId}},
+		"queues":      []string{"hardware", "software", "billing"},
+		"slapolicies": []map[string]interface{}{{"queue": "hardware", "hours": 48}},
+	}
+	bootstrapAsBytes, _ := json.Marshal(bootstrap)
+	if legacy != nil {
+		l.stub.MockTransactionStart("legacy")
+		l.stub.PutState("hello_world", []byte("hello"))
+		for key, doc := range legacy {
+			l.stub.PutState(key, []byte(doc))
+		}
+		l.stub.MockTransactionEnd("legacy")
+	}
+	l.ok(l.stub.MockInit("init", [][]byte{[]byte("init"), bootstrapAsBytes}))
+
+	l.ok(l.invoke("init_company", providerMsp, "Provider"))
+	l.ok(l.invoke("init_company", customerMsp, "Customer"))
+	l.ok(l.invoke("init_company", otherMsp, "Other"))
+	return l
+}
+
+// act as the admin
+func (l *testLedger) asAdmin() *testLedger {
+	l.stub.Creator = l.admin
+	return l
+}
+
+// act as an identity of the MSP linked to the employee, an empty serial is an identity without an employee
+func (l *testLedger) as(mspId string, employee_sn string) *testLedger {
+	attrs := map[string]string{}
+	if len(employee_sn) > 0 {
+		attrs["employee_sn"] = employee_sn
+	}
+	l.stub.Creator = creator(l.t, mspId, "user "+employee_sn, attrs)
+	return l
+}
+
+// pass personal data in the transient map of the next transaction
+func (l *testLedger) pii(fields string) *testLedger {
+	l.stub.TransientMap = map[string][]byte{"pii": []byte(fields)}
+	return l
+}
+
+// call a chaincode function through Invoke
+func (l *testLedger) invoke(function string, args ...string) pb.Response {
+	l.tx++
+	callArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		callArgs = append(callArgs, []byte(arg))
+	}
+	res := l.stub.MockInvoke("tx"+strconv.Itoa(l.tx), callArgs)
+	l.stub.TransientMap = nil
+	l.drain()
+	return res
+}
+
+// call a chaincode function directly in a transaction timestamped at the given time
+func (l *testLedger) invokeAt(when time.Time, function func(shim.ChaincodeStubInterface, []string) pb.Response, args ...string) pb.Response {
+	l.tx++
+	txId := "tx" + strconv.Itoa(l.tx)
+	l.stub.MockTransactionStart(txId)
+	l.stub.TxTimestamp = &timestamp.Timestamp{Seconds: when.Unix(), Nanos: int32(when.Nanosecond())}
+	res := function(l.stub, args)
+	l.stub.MockTransactionEnd(txId)
+	l.stub.TransientMap = nil
+	l.drain()
+	return res
+}
+
+// collect the events of the last transaction so the mock's event channel never fills up
+func (l *testLedger) drain() {
+	l.events = nil
+	for {
+		select {
+		case event := <-l.stub.ChaincodeEventsChannel:
+			l.events = append(l.events, event)
+		default:
+			return
+		}
+	}
+}
+
+func (l *testLedger) ok(res pb.Response) []byte {
+	l.t.Helper()
+	if res.Status != shim.OK {
+		l.t.Fatalf("expected success, got %d - %s", res.Status, res.Message)
+	}
+	return res.Payload
+}
+
+func (l *testLedger) fails(res pb.Response, message string) {
+	l.t.Helper()
+	if res.Status == shim.OK {
+		l.t.Fatalf("expected an error containing %q, got success", message)
+	}
+	if !strings.Contains(res.Message, message) {
+		l.t.Fatalf("expected an error containing %q, got %q", message, res.Message)
+	}
+}
+
+// the name of the last event, empty when the transaction emitted none
+func (l *testLedger) event() string {
+	if len(l.events) == 0 {
+		return ""
+	}
+	return l.events[len(l.events)-1].EventName
+}
+
+// ----- fixtures ----- //
+
+// an employee of the company with a role, created by an identity of the company and promoted by the admin
+func (l *testLedger) employee(mspId string, employee_sn string, role string) {
+	l.t.Helper()
+	l.as(mspId, "").ok(l.invoke("init_employee", employee_sn, "Employee "+employee_sn))
+	if role != ROLE_USER {
+		l.asAdmin().ok(l.invoke("set_employee_role", employee_sn, role, "team", ""))
+	}
+}
+
+// a deployed asset of the company
+func (l *testLedger) asset(mspId string, serialNumber string, assetType string, owner string) {
+	l.t.Helper()
+	l.as(mspId, owner).ok(l.invoke("init_ibmasset", serialNumber, assetType, "none", owner))
+}
+
+// open a ticket as its owner
+func (l *testLedger) ticket(mspId string, id string, description string, owner string, assignee string, asset string, queue string) pb.Response {
+	l.as(mspId, owner)
+	return l.invoke("init_ticket", id, description, "2017-07-20", STATUS_OPEN, owner, assignee, asset, queue,
+		"ThinkPad", "T470", "diagnostic", "none", "pw")
+}
+
+// open a ticket as its owner in a transaction at the given time
+func (l *testLedger) ticketAt(when time.Time, mspId string, id string, description string, owner string, assignee string, asset string, queue string) pb.Response {
+	l.as(mspId, owner)
+	return l.invokeAt(when, init_ticket, id, description, "2017-07-20", STATUS_OPEN, owner, assignee, asset, queue,
+		"ThinkPad", "T470", "diagnostic", "none", "pw")
+}
+
+// open a software ticket of owner1 with custom fields
+func (l *testLedger) ticketWithFields(id string, fields string) pb.Response {
+	l.as(customerMsp, "owner1")
+	return l.invoke("init_ticket", id, "outlook crashes", "2017-07-20", STATUS_OPEN, "owner1", "tech2", "X1", "software",
+		"ThinkPad", "T470", "diagnostic", "none", "pw", fields)
+}
+
+// resolve a ticket as its assignee and close it with its owner's sign-off, both at the given time
+func (l *testLedger) closeAt(when time.Time, mspId string, id string, assignee string, owner string) {
+	l.t.Helper()
+	l.as(mspId, assignee).ok(l.invokeAt(when, request_customer_signoff, id, "fixed"))
+	l.as(mspId, owner).ok(l.invokeAt(when, accept_resolution, id))
+}
+
+// a customer with a technician of the provider and an owner with a deployed asset at CustomerMSP
+func (l *testLedger) customer() *testLedger {
+	l.t.Helper()
+	l.employee(providerMsp, "tech1", ROLE_SUPPORT)
+	l.employee(customerMsp, "owner1", ROLE_USER)
+	l.employee(customerMsp, "tech2", ROLE_TECHNICIAN)
+	l.asset(customerMsp, "SN1", "thinkpad", "owner1")
+	return l
+}
+
+// config entry set by the admin
+func (l *testLedger) config(name string, scope string, value string) {
+	l.t.Helper()
+	if len(scope) == 0 {
+		l.asAdmin().ok(l.invoke("set_config", name, value))
+		return
+	}
+	l.asAdmin().ok(l.invoke("set_config", name, scope, value))
+}
+
+func (l *testLedger) getTicket(id string) Ticket {
+	l.t.Helper()
+	ticket, err := get_ticket(l.stub, id)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return ticket
+}
+
+func (l *testLedger) getEmployee(id string) Employee {
+	l.t.Helper()
+	employee, err := get_employee(l.stub, id)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return employee
+}
+
+func (l *testLedger) getAsset(id string) IBM_Asset {
+	l.t.Helper()
+	ibmasset, err := get_ibmasset(l.stub, id)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return ibmasset
+}
+
+// a YYYY-MM-DD day at noon UTC
+func day(str string) time.Time {
+	t, err := time.Parse("2006-01-02", str)
+	if err != nil {
+		panic(err)
+	}
+	return t.Add(12 * time.Hour)
+}
@@ -14,10 +14,14 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // SimpleChaincode example simple Chaincode implementation
@@ -31,84 +35,570 @@ func main() {
 	}
 }
 
-// Init resets all the things
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+// version of the ledger documents this code writes, bump it and add a migration when their layout changes
+const CHAINCODE_SCHEMA_VERSION = 9
+
+// migrations[v] upgrades the ledger from version v-1 to v
+var migrations = map[int]func(shim.ChaincodeStubInterface) error{
+	2: migrate_drop_hello_world,
+	4: migrate_search_index,
+	6: migrate_part_keys,
+	7: migrate_asset_tag_keys,
+	8: migrate_ticket_lookup,
+}
+
+// documentMigrations[v] upgrades a raw world state document from version v-1 to v and tells if it changed it
+//
+// A peer does not let a transaction read its own writes, so every document is read once and the changes of all the
+// versions it goes through are written together. They run before the migrations above, which must not rely on them.
+var documentMigrations = map[int]func(shim.ChaincodeStubInterface, string, map[string]interface{}) (bool, error){
+	2: migrate_roles_and_lifecycle,
+	3: migrate_strip_personal_data,
+	5: migrate_backfill_closed_on,
+	9: migrate_freeze_charged_to,
+}
+
+// Init bootstraps the channel on instantiate and migrates the ledger on upgrade
+//
+// On instantiate the only argument is the bootstrap document, e.g.
+//   {"schemaversion": 9,
+//    "admins": [{"mspid": "Org1MSP", "id": "x509::CN=admin,OU=client::CN=ca.org1"}],
+//    "queues": ["hardware", "software", "billing"],
+//    "slapolicies": [{"queue": "hardware", "hours": 48}],
+//    "statuses": ["open", "in progress", "waiting for customer", "resolved", "closed"]}
+// It is validated and written once. On upgrade Init takes no arguments and runs the migrations between the stored
+// schema version and CHAINCODE_SCHEMA_VERSION.
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	fmt.Println("init is running")
+
+	bootstrap, found, err := get_bootstrap(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ---- Upgrade ---- //
+	if found {
+		if len(args) != 0 {
+			return shim.Error("Channel is already bootstrapped, upgrades take no arguments")
+		}
+		if bootstrap.SchemaVersion > CHAINCODE_SCHEMA_VERSION {
+			return shim.Error("Ledger schema version " + strconv.Itoa(bootstrap.SchemaVersion) + " is newer than this chaincode")
+		}
+		err = run_migrations(stub, &bootstrap)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	}
+
+	// ---- Bootstrap ---- //
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return shim.Error("Incorrect number of arguments. Expecting the bootstrap document")
 	}
 
-	err := stub.PutState("hello_world", []byte(args[0]))
+	bootstrap, err = parse_bootstrap(args[0])
 	if err != nil {
-		return nil, err
+		return shim.Error(err.Error())
 	}
 
-	return nil, nil
+	_, err = put_config(stub, "queues", "", bootstrap.Queues, "init")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = put_config(stub, "statuses", "", bootstrap.Statuses, "init")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, policy := range bootstrap.SlaPolicies {
+		_, err = put_config(stub, "sla_hours", policy.Queue, policy.Hours, "init")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	bootstrap.BootstrappedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a ledger written by the chaincode before bootstrapping existed is at version 1 and still needs migrating
+	legacy, err := stub.GetState("hello_world")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if legacy != nil {
+		bootstrap.SchemaVersion = 1
+	}
+
+	err = run_migrations(stub, &bootstrap)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end init")
+	return shim.Success(nil)
 }
 
-// Invoke isur entry point to invoke a chaincode function
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
+// parse and validate the bootstrap document given to Init
+func parse_bootstrap(str string) (Bootstrap, error) {
+	var bootstrap Bootstrap
+	decoder := json.NewDecoder(strings.NewReader(str))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&bootstrap)
+	if err != nil {
+		return bootstrap, errors.New("Failed to parse bootstrap document - " + err.Error())
+	}
+	bootstrap.ObjectType = "bootstrap"
 
-	// Handle different functions
-	if function == "init" {
-		return t.Init(stub, "init", args)
-	} else if function == "write" {
-		return t.write(stub, args)
+	if bootstrap.SchemaVersion == 0 {
+		bootstrap.SchemaVersion = CHAINCODE_SCHEMA_VERSION
+	}
+	if bootstrap.SchemaVersion != CHAINCODE_SCHEMA_VERSION {
+		return bootstrap, errors.New("Bootstrap schemaversion must be " + strconv.Itoa(CHAINCODE_SCHEMA_VERSION))
+	}
+
+	if len(bootstrap.Admins) == 0 {
+		return bootstrap, errors.New("Bootstrap needs at least one admin")
+	}
+	for _, admin := range bootstrap.Admins {
+		if len(admin.MspId) == 0 {
+			return bootstrap, errors.New("Bootstrap admins need an mspid")
+		}
+	}
+
+	if len(bootstrap.Queues) == 0 {
+		return bootstrap, errors.New("Bootstrap needs at least one queue")
+	}
+	seen := make(map[string]bool)
+	for _, queue := range bootstrap.Queues {
+		if seen[queue] {
+			return bootstrap, errors.New("Bootstrap queue listed twice - " + queue)
+		}
+		seen[queue] = true
+	}
+
+	for _, policy := range bootstrap.SlaPolicies {
+		if !seen[policy.Queue] {
+			return bootstrap, errors.New("Bootstrap SLA policy for unknown queue - " + policy.Queue)
+		}
+		if policy.Hours <= 0 {
+			return bootstrap, errors.New("Bootstrap SLA policy hours must be positive - " + policy.Queue)
+		}
 	}
-	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
+	if len(bootstrap.Statuses) == 0 {
+		bootstrap.Statuses = []string{STATUS_OPEN, STATUS_IN_PROGRESS, STATUS_RESOLVED, STATUS_CLOSED}
+	}
+	for i, status := range bootstrap.Statuses {
+		bootstrap.Statuses[i] = normalize_status(status)
+	}
+	return bootstrap, nil
 }
 
-// Query is our entry point for queries
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+// bring the ledger from the bootstrap's schema version up to CHAINCODE_SCHEMA_VERSION and store the bootstrap
+func run_migrations(stub shim.ChaincodeStubInterface, bootstrap *Bootstrap) error {
+	err := migrate_documents(stub, bootstrap.SchemaVersion)
+	if err != nil {
+		return err
+	}
+	for version := bootstrap.SchemaVersion + 1; version <= CHAINCODE_SCHEMA_VERSION; version++ {
+		fmt.Println("migrating ledger to schema version " + strconv.Itoa(version))
+		migrate, ok := migrations[version]
+		if ok {
+			err = migrate(stub)
+			if err != nil {
+				return errors.New("Migration to schema version " + strconv.Itoa(version) + " failed - " + err.Error())
+			}
+		}
+		bootstrap.SchemaVersion = version
+		bootstrap.MigratedOn, err = get_tx_time(stub)
+		if err != nil {
+			return err
+		}
+	}
+	return put_bootstrap(stub, *bootstrap)
+}
 
-	// Handle different functions
-	if function == "read" { //read a variable
-		return t.read(stub, args)
+// run the document migrations after version from over every document, writing each changed document once
+func migrate_documents(stub shim.ChaincodeStubInterface, from int) error {
+	resultsIterator, err := stub.GetStateByRange("", "")    //empty range covers every non composite key
+	if err != nil {
+		return err
 	}
-	fmt.Println("query did not find func: " + function)
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		//work on the raw document so fields later versions took off the structs survive, see version 3
+		var doc map[string]interface{}
+		if json.Unmarshal(pointer.GetValue(), &doc) != nil {
+			continue
+		}
+		changed := false
+		for version := from + 1; version <= CHAINCODE_SCHEMA_VERSION; version++ {
+			migrate, ok := documentMigrations[version]
+			if !ok {
+				continue
+			}
+			migrated, err := migrate(stub, pointer.GetKey(), doc)
+			if err != nil {
+				return errors.New("Migration to schema version " + strconv.Itoa(version) + " failed - " + err.Error())
+			}
+			changed = changed || migrated
+		}
+
+		if changed {
+			docAsBytes, _ := json.Marshal(doc)
+			err = stub.PutState(pointer.GetKey(), docAsBytes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// version 2 - the old Init's key goes
+func migrate_drop_hello_world(stub shim.ChaincodeStubInterface) error {
+	return stub.DelState("hello_world")                      //left behind by the old Init
+}
 
-	return nil, errors.New("Received unknown function query: " + function)
+// version 2 - employees get an explicit role, assets a lifecycle status, ticket statuses follow the catalogue
+func migrate_roles_and_lifecycle(stub shim.ChaincodeStubInterface, key string, doc map[string]interface{}) (bool, error) {
+	switch doc["docType"] {
+	case "employee":
+		if role, _ := doc["role"].(string); len(role) == 0 {
+			doc["role"] = ROLE_USER
+			return true, nil
+		}
+	case "ibm_asset":
+		if status, _ := doc["status"].(string); len(status) == 0 {
+			doc["status"] = ASSET_DEPLOYED
+			return true, nil
+		}
+	case "ticket":
+		status, _ := doc["status"].(string)
+		if status != normalize_status(status) {
+			doc["status"] = normalize_status(status)
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// write - invoke function to write key/value pair
-func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, value string
-	var err error
-	fmt.Println("running write()")
+// version 3 - clear contact details and emails leave the public documents
+//
+// Private data cannot be written from Init, so the clear fields move to a legacy personal data document of their own
+// and wait there until an admin runs migrate_personal_data, which puts them into private data. Until then they stay in
+// world state as they were, updates to the documents cannot lose them.
+func migrate_strip_personal_data(stub shim.ChaincodeStubInterface, key string, doc map[string]interface{}) (bool, error) {
+	recordType, _ := doc["docType"].(string)
+	if recordType != "ticket" && recordType != "employee" {
+		return false, nil
+	}
+
+	legacy := LegacyPersonalData{ObjectType: "legacy_personal_data", RecordType: recordType, RecordId: key}
+	legacy.Fields = make(map[string]string)
+	stripped := false
+	for _, field := range append(piiFields["ticket"], piiFields["employee"]...) {
+		value, ok := doc[field]
+		if !ok {
+			continue
+		}
+		if str, isString := value.(string); isString && len(str) > 0 && contains(piiFields[recordType], field) {
+			legacy.Fields[field] = str
+		}
+		delete(doc, field)
+		stripped = true
+	}
+	if !stripped || len(legacy.Fields) == 0 {
+		return stripped, nil
+	}
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the key and value to set")
+	if recordType == "ticket" {
+		legacy.Subject, _ = doc["ticketowner"].(string)
+	} else {
+		legacy.Subject, _ = doc["employee_sn"].(string)
 	}
+	return true, put_legacy_personal_data(stub, legacy)
+}
 
-	key = args[0] //rename for funsies
-	value = args[1]
-	err = stub.PutState(key, []byte(value)) //write the variable into the chaincode state
+// version 4 - the text of the tickets already on the ledger goes into the search index
+func migrate_search_index(stub shim.ChaincodeStubInterface) error {
+	tickets, err := get_all_tickets(stub)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return nil, nil
+	for _, ticket := range tickets {
+		err = index_ticket(stub, Ticket{}, ticket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// version 5 - closed tickets written before closedon was recorded get the upgrade's time, retention then counts from
+// the upgrade so nothing is purged earlier than it would have been
+func migrate_backfill_closed_on(stub shim.ChaincodeStubInterface, key string, doc map[string]interface{}) (bool, error) {
+	status, _ := doc["status"].(string)
+	closedOn, _ := doc["closedon"].(string)
+	if doc["docType"] != "ticket" || normalize_status(status) != STATUS_CLOSED || len(closedOn) > 0 {
+		return false, nil
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return false, err
+	}
+	doc["closedon"] = txTime
+	return true, nil
 }
 
-// read - query function to read key/value pair
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp string
-	var err error
+// version 9 - closed tickets get the cost centre and owner of their asset frozen on them, like tickets closed from now on
+func migrate_freeze_charged_to(stub shim.ChaincodeStubInterface, key string, doc map[string]interface{}) (bool, error) {
+	status, _ := doc["status"].(string)
+	if doc["docType"] != "ticket" || normalize_status(status) != STATUS_CLOSED || doc["chargedto"] != nil {
+		return false, nil
+	}
+	serialNumber, _ := doc["asset"].(string)
+	ibmasset, _ := get_ibmasset(stub, serialNumber)
+	doc["chargedto"] = ChargedTo{ibmasset.CostCentre, ibmasset.Owner}
+	return true, nil
+}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
+// version 6 - spare parts move from site and number keys to keys that start with their company
+func migrate_part_keys(stub shim.ChaincodeStubInterface) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("part~site~number", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var part Part
+		json.Unmarshal(pointer.GetValue(), &part)            //un stringify it aka JSON.parse()
+		err = put_part(stub, part)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(pointer.GetKey())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// version 7 - asset tags are indexed under the assets' docType, ibm_asset, instead of asset
+func migrate_asset_tag_keys(stub shim.ChaincodeStubInterface) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(TAG_INDEX, []string{})
+	if err != nil {
+		return err
 	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(pointer.GetKey())
+		if err != nil {
+			return err
+		}
+		if len(keyParts) != 3 || keyParts[1] != "asset" {
+			continue
+		}
+		err = put_tag_index(stub, "ibm_asset", keyParts[2], []string{keyParts[0]})
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(pointer.GetKey())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	key = args[0]
-	valAsbytes, err := stub.GetState(key)
+// version 8 - the tickets already on the ledger go into the owner and asset indexes
+func migrate_ticket_lookup(stub shim.ChaincodeStubInterface) error {
+	tickets, err := get_all_tickets(stub)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return err
+	}
+	for _, ticket := range tickets {
+		err = put_ticket_lookup(stub, ticket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Invoke is our entry point to invoke a chaincode function, queries come in here too
+//
+// There is no generic key/value write or read, everything goes through the typed functions below and configuration
+// through set_config/read_config.
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	fmt.Println("invoke is running " + function)
+
+	// Handle different functions
+	if function == "init_ticket" {
+		return init_ticket(stub, args)
+	} else if function == "set_assignee" {
+		return set_assignee(stub, args)
+	} else if function == "set_ticket_status" {
+		return set_ticket_status(stub, args)
+	} else if function == "delete_ticket" {
+		return delete_ticket(stub, args)
+	} else if function == "init_employee" {
+		return init_employee(stub, args)
+	} else if function == "update_employee" {
+		return update_employee(stub, args)
+	} else if function == "deactivate_employee" {
+		return deactivate_employee(stub, args)
+	} else if function == "set_employee_role" {
+		return set_employee_role(stub, args)
+	} else if function == "delete_employee" {
+		return delete_employee(stub, args)
+	} else if function == "init_ibmasset" {
+		return init_ibmasset(stub, args)
+	} else if function == "update_ibmasset" {
+		return update_ibmasset(stub, args)
+	} else if function == "set_ibmasset_status" {
+		return set_ibmasset_status(stub, args)
+	} else if function == "retire_asset" {
+		return retire_asset(stub, args)
+	} else if function == "delete_ibmasset" {
+		return delete_ibmasset(stub, args)
+	} else if function == "init_company" {
+		return init_company(stub, args)
+	} else if function == "set_endorsement_policy" {
+		return set_endorsement_policy(stub, args)
+	} else if function == "erase_personal_data" {
+		return erase_personal_data(stub, args)
+	} else if function == "migrate_personal_data" {
+		return migrate_personal_data(stub, args)
+	} else if function == "request_customer_signoff" {
+		return request_customer_signoff(stub, args)
+	} else if function == "accept_resolution" {
+		return accept_resolution(stub, args)
+	} else if function == "reject_resolution" {
+		return reject_resolution(stub, args)
+	} else if function == "restock_part" {
+		return restock_part(stub, args)
+	} else if function == "consume_part" {
+		return consume_part(stub, args)
+	} else if function == "log_time" {
+		return log_time(stub, args)
+	} else if function == "update_ticket" {
+		return update_ticket(stub, args)
+	} else if function == "set_custom_fields" {
+		return set_custom_fields(stub, args)
+	} else if function == "add_tag" {
+		return add_tag(stub, args)
+	} else if function == "remove_tag" {
+		return remove_tag(stub, args)
+	} else if function == "set_checklist_template" {
+		return set_checklist_template(stub, args)
+	} else if function == "update_checklist_item" {
+		return update_checklist_item(stub, args)
+	} else if function == "set_maintenance_plan" {
+		return set_maintenance_plan(stub, args)
+	} else if function == "run_maintenance_scheduler" {
+		return run_maintenance_scheduler(stub, args)
+	} else if function == "schedule_visit" {
+		return schedule_visit(stub, args)
+	} else if function == "check_in" {
+		return check_in(stub, args)
+	} else if function == "check_out" {
+		return check_out(stub, args)
+	} else if function == "open_rma" {
+		return open_rma(stub, args)
+	} else if function == "ship_rma" {
+		return ship_rma(stub, args)
+	} else if function == "receive_rma" {
+		return receive_rma(stub, args)
+	} else if function == "generate_invoice" {
+		return generate_invoice(stub, args)
+	} else if function == "submit_csat" {
+		return submit_csat(stub, args)
+	} else if function == "add_ticket_attachment" {
+		return add_ticket_attachment(stub, args)
+	} else if function == "purge_expired_tickets" {
+		return purge_expired_tickets(stub, args)
+	} else if function == "set_config" {
+		return set_config(stub, args)
+	} else if function == "delete_config" {
+		return delete_config(stub, args)
 	}
 
-	return valAsbytes, nil
+	// queries
+	if function == "read_ticket" {
+		return read_ticket(stub, args)
+	} else if function == "read_everything" {
+		return read_everything(stub)
+	} else if function == "getHistory" {
+		return getHistory(stub, args)
+	} else if function == "getTicketsByRange" {
+		return getTicketsByRange(stub, args)
+	} else if function == "get_workload" {
+		return get_workload(stub, args)
+	} else if function == "get_employee_workload" {
+		return get_employee_workload(stub, args)
+	} else if function == "get_assets_out_of_warranty" {
+		return get_assets_out_of_warranty(stub, args)
+	} else if function == "read_company" {
+		return read_company(stub, args)
+	} else if function == "get_endorsement_policy" {
+		return get_endorsement_policy(stub, args)
+	} else if function == "read_personal_data" {
+		return read_personal_data(stub, args)
+	} else if function == "verify_personal_data" {
+		return verify_personal_data(stub, args)
+	} else if function == "read_part" {
+		return read_part(stub, args)
+	} else if function == "chargeback_report" {
+		return chargeback_report(stub, args)
+	} else if function == "get_technician_agenda" {
+		return get_technician_agenda(stub, args)
+	} else if function == "read_custom_fields" {
+		return read_custom_fields(stub, args)
+	} else if function == "find_tickets_by_custom_field" {
+		return find_tickets_by_custom_field(stub, args)
+	} else if function == "search_tickets" {
+		return search_tickets(stub, args)
+	} else if function == "find_by_tag" {
+		return find_by_tag(stub, args)
+	} else if function == "read_invoice" {
+		return read_invoice(stub, args)
+	} else if function == "list_invoices" {
+		return list_invoices(stub, args)
+	} else if function == "csat_report" {
+		return csat_report(stub, args)
+	} else if function == "verify_attachment" {
+		return verify_attachment(stub, args)
+	} else if function == "retention_report" {
+		return retention_report(stub, args)
+	} else if function == "read_config" {
+		return read_config(stub, args)
+	} else if function == "list_config" {
+		return list_config(stub)
+	}
+	fmt.Println("invoke did not find func: " + function)
+
+	return shim.Error("Received unknown function invocation: " + function)
 }
 /*
 
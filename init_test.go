@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- entry points ----- //
+
+func TestNoRawKeyAccess(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+
+	l.asAdmin().fails(l.invoke("write", "t1", "{}"), "Received unknown function invocation")
+	l.fails(l.invoke("read", "t1"), "Received unknown function invocation")
+	if l.getTicket("t1").Description != "no display" {
+		t.Fatal("ticket was overwritten")
+	}
+}
+
+// ----- bootstrap and migrations ----- //
+
+func initWith(stub *testStub, doc string) pb.Response {
+	return stub.MockInit("init", [][]byte{[]byte("init"), []byte(doc)})
+}
+
+func TestBootstrapValidation(t *testing.T) {
+	stub := newTestStub()
+	cases := map[string]string{
+		`{"queues": ["hardware"]}`:                                               "at least one admin",
+		`{"admins": [{"id": "x"}], "queues": ["hardware"]}`:                      "need an mspid",
+		`{"admins": [{"mspid": "Org1MSP"}]}`:                                     "at least one queue",
+		`{"admins": [{"mspid": "Org1MSP"}], "queues": ["hardware", "hardware"]}`: "listed twice",
+		`{"admins": [{"mspid": "Org1MSP"}], "queues": ["hardware"], "slapolicies": [{"queue": "billing", "hours": 8}]}`: "unknown queue",
+		`{"admins": [{"mspid": "Org1MSP"}], "queues": ["hardware"], "schemaversion": 1}`:                                "schemaversion must be",
+		`{"admins": [{"mspid": "Org1MSP"}], "queues": ["hardware"], "colour": "blue"}`:                                  "unknown field",
+	}
+	for doc, message := range cases {
+		res := initWith(stub, doc)
+		if res.Status == shim.OK || !strings.Contains(res.Message, message) {
+			t.Fatalf("%s - expected an error containing %q, got %d %q", doc, message, res.Status, res.Message)
+		}
+	}
+}
+
+func TestBootstrapOnce(t *testing.T) {
+	l := newTestLedger(t)
+
+	bootstrap, found, err := get_bootstrap(l.stub)
+	if err != nil || !found || bootstrap.SchemaVersion != CHAINCODE_SCHEMA_VERSION {
+		t.Fatalf("expected the bootstrap at the current schema version - %+v %v", bootstrap, err)
+	}
+	if len(bootstrap.Statuses) != 4 {
+		t.Fatalf("expected the default status catalogue, got %v", bootstrap.Statuses)
+	}
+	if hours := get_config_number(l.stub, "sla_hours", "hardware", 0); hours != 48 {
+		t.Fatalf("expected the SLA policy in the config store, got %v", hours)
+	}
+
+	// upgrades take no arguments and leave the bootstrap alone
+	res := initWith(l.stub, `{"admins": [{"mspid": "EvilMSP"}], "queues": ["x"]}`)
+	if res.Status == shim.OK || !strings.Contains(res.Message, "already bootstrapped") {
+		t.Fatalf("expected a second bootstrap to fail, got %d %q", res.Status, res.Message)
+	}
+	l.ok(l.stub.MockInit("upgrade", [][]byte{[]byte("init")}))
+	bootstrap, _, _ = get_bootstrap(l.stub)
+	if bootstrap.Admins[0].MspId != providerMsp {
+		t.Fatal("bootstrap changed on upgrade")
+	}
+
+	// a ledger written by newer chaincode is refused
+	bootstrap.SchemaVersion = CHAINCODE_SCHEMA_VERSION + 1
+	l.stub.MockTransactionStart("newer")
+	put_bootstrap(l.stub, bootstrap)
+	l.stub.MockTransactionEnd("newer")
+	res = l.stub.MockInit("upgrade", [][]byte{[]byte("init")})
+	if res.Status == shim.OK || !strings.Contains(res.Message, "newer than this chaincode") {
+		t.Fatalf("expected a newer ledger to be refused, got %d %q", res.Status, res.Message)
+	}
+}
+
+func TestMigrateLegacyLedger(t *testing.T) {
+	stub := newTestStub()
+	stub.MockTransactionStart("legacy")
+	stub.PutState("hello_world", []byte("hi"))
+	stub.PutState("o1", []byte(`{"docType": "employee", "employee_sn": "o1", "fullname": "Bob"}`))
+	stub.PutState("SN1", []byte(`{"docType": "ibm_asset", "serialnumber": "SN1", "assettype": "thinkpad"}`))
+	stub.PutState("m1", []byte(`{"docType": "ticket", "ticket_id": "m1", "status": " Open ", "description": "no display"}`))
+	stub.MockTransactionEnd("legacy")
+
+	res := initWith(stub, `{"admins": [{"mspid": "Org1MSP"}], "queues": ["hardware"]}`)
+	if res.Status != shim.OK {
+		t.Fatalf("bootstrapping a legacy ledger failed - %s", res.Message)
+	}
+
+	if hello, _ := stub.GetState("hello_world"); hello != nil {
+		t.Fatal("expected hello_world removed")
+	}
+	employee, _ := get_employee(stub, "o1")
+	if employee.Role != ROLE_USER {
+		t.Fatalf("expected legacy employees to become users, got %q", employee.Role)
+	}
+	ibmasset, _ := get_ibmasset(stub, "SN1")
+	if ibmasset.Status != ASSET_DEPLOYED {
+		t.Fatalf("expected legacy assets deployed, got %q", ibmasset.Status)
+	}
+	ticket, _ := get_ticket(stub, "m1")
+	if ticket.Status != STATUS_OPEN {
+		t.Fatalf("expected the ticket status normalised, got %q", ticket.Status)
+	}
+	bootstrap, _, _ := get_bootstrap(stub)
+	if bootstrap.SchemaVersion != CHAINCODE_SCHEMA_VERSION || len(bootstrap.MigratedOn) == 0 {
+		t.Fatalf("expected the ledger migrated to the current schema version - %+v", bootstrap)
+	}
+}
+
+func TestMigrateLegacyPersonalData(t *testing.T) {
+	l := newLegacyTestLedger(t, map[string]string{
+		"o1": `{"docType": "employee", "employee_sn": "o1", "fullname": "Bob", "email": "bob@example.com"}`,
+		"m1": `{"docType": "ticket", "ticket_id": "m1", "status": "open", "ticketowner": "o1", "address": "MOP 1", "contactphone": "0612345678", "contactemail": ""}`,
+	})
+
+	// the clear fields leave the documents but are kept until they are in private data
+	for _, key := range []string{"o1", "m1"} {
+		public := string(l.stub.State[key])
+		if strings.Contains(public, "bob@example.com") || strings.Contains(public, "MOP 1") || strings.Contains(public, "contactemail") {
+			t.Fatalf("clear personal data left on the public document - %s", public)
+		}
+	}
+	records, _ := get_legacy_personal_data(l.stub, "o1")
+	if len(records) != 2 {
+		t.Fatalf("expected the ticket's and the employee's personal data kept, got %+v", records)
+	}
+
+	// updating the documents does not lose them
+	l.asAdmin().ok(l.invoke("set_ticket_status", "m1", STATUS_IN_PROGRESS))
+	l.ok(l.invoke("update_employee", "o1", "Bob Smith"))
+
+	l.as(customerMsp, "").pii(`{"salt": "`+testSalt+`"}`).fails(l.invoke("migrate_personal_data"), "Only an admin")
+	l.asAdmin().fails(l.invoke("migrate_personal_data"), "Expecting the salt")
+	l.pii(`{"email": "x", "salt": "`+testSalt+`"}`).fails(l.invoke("migrate_personal_data"), "Unknown personal field")
+
+	var migrated []string
+	json.Unmarshal(l.pii(`{"salt": "`+testSalt+`"}`).ok(l.invoke("migrate_personal_data", "1")), &migrated)
+	if len(migrated) != 1 {
+		t.Fatalf("expected max to limit the migration, got %v", migrated)
+	}
+	json.Unmarshal(l.pii(`{"salt": "`+testSalt+`"}`).ok(l.invoke("migrate_personal_data")), &migrated)
+	if len(migrated) != 1 || l.event() != "personal_data_migrated" {
+		t.Fatalf("expected the remaining record migrated, got %v", migrated)
+	}
+	if records, _ := get_legacy_personal_data(l.stub, ""); len(records) != 0 {
+		t.Fatalf("expected no legacy personal data left, got %+v", records)
+	}
+
+	ticket, _ := get_ticket(l.stub, "m1")
+	if ticket.PersonalData.Hashes["address"] != hash_pii(hash_pii(testSalt, "ticket m1"), "MOP 1") {
+		t.Fatalf("expected the address hashed with the record's salt - %+v", ticket.PersonalData)
+	}
+	var personalData PersonalData
+	json.Unmarshal(l.ok(l.invoke("read_personal_data", "employee", "o1")), &personalData)
+	if personalData.Fields["email"] != "bob@example.com" {
+		t.Fatalf("expected the email in private data - %+v", personalData)
+	}
+}
+
+func TestMigrateFromFirstVersion(t *testing.T) {
+	l := newLegacyTestLedger(t, map[string]string{
+		"o1":  `{"docType": "employee", "employee_sn": "o1", "fullname": "Bob", "email": "bob@example.com"}`,
+		"m1":  `{"docType": "ticket", "ticket_id": "m1", "status": " Open ", "ticketowner": "o1", "address": "MOP 1"}`,
+		"m2":  `{"docType": "ticket", "ticket_id": "m2", "status": "Closed", "ticketowner": "o1", "asset": "SN1", "contactphone": "0612345678"}`,
+		"SN1": `{"docType": "ibm_asset", "serialnumber": "SN1", "assettype": "thinkpad", "costcentre": "CC-1"}`,
+	})
+
+	// every version's change to a document survives the later ones run in the same upgrade
+	employee := l.getEmployee("o1")
+	if employee.Role != ROLE_USER || strings.Contains(string(l.stub.State["o1"]), "bob@example.com") {
+		t.Fatalf("expected the employee with a role and without the email - %s", l.stub.State["o1"])
+	}
+	ticket := l.getTicket("m1")
+	if ticket.Status != STATUS_OPEN || strings.Contains(string(l.stub.State["m1"]), "MOP 1") {
+		t.Fatalf("expected the ticket normalised and without the address - %s", l.stub.State["m1"])
+	}
+	ticket = l.getTicket("m2")
+	if ticket.Status != STATUS_CLOSED || len(ticket.ClosedOn) == 0 || ticket.ChargedTo == nil || ticket.ChargedTo.CostCentre != "CC-1" || strings.Contains(string(l.stub.State["m2"]), "0612345678") {
+		t.Fatalf("expected the closed ticket normalised, closed and charged on the upgrade and without the phone - %s", l.stub.State["m2"])
+	}
+}
+
+func TestEraseLegacyPersonalData(t *testing.T) {
+	l := newLegacyTestLedger(t, map[string]string{
+		"m1": `{"docType": "ticket", "ticket_id": "m1", "status": "open", "ticketowner": "o1", "address": "MOP 1"}`,
+		"o1": `{"docType": "employee", "employee_sn": "o1", "fullname": "Bob"}`,
+	})
+	l.asAdmin().ok(l.invokeAt(day("2017-07-20"), erase_personal_data, "o1"))
+	if records, _ := get_legacy_personal_data(l.stub, ""); len(records) != 0 {
+		t.Fatalf("expected the legacy personal data erased, got %+v", records)
+	}
+	ticket, _ := get_ticket(l.stub, "m1")
+	if ticket.PersonalData.Reason != ERASED_ON_REQUEST {
+		t.Fatalf("expected the ticket marked erased - %+v", ticket.PersonalData)
+	}
+}
+
+func TestMigratePartKeys(t *testing.T) {
+	oldKey := "\x00part~site~number\x00Dublin\x00FAN-120\x00"
+	l := newLegacyTestLedger(t, map[string]string{
+		oldKey: `{"docType": "part", "part_number": "FAN-120", "site": "Dublin", "company": "CustomerMSP", "quantity": 3}`,
+	})
+	if _, found := l.stub.State[oldKey]; found {
+		t.Fatal("expected the part's old key removed")
+	}
+	part, found, err := get_part(l.stub, customerMsp, "Dublin", "FAN-120")
+	if err != nil || !found || part.Quantity != 3 {
+		t.Fatalf("expected the part under its company's key - %v %+v", err, part)
+	}
+}
+
+func TestMigrateAssetTagKeys(t *testing.T) {
+	oldKey := "\x00tag~objecttype~id\x00spare\x00asset\x00SN1\x00"
+	l := newLegacyTestLedger(t, map[string]string{
+		"SN1":  `{"docType": "ibm_asset", "serialnumber": "SN1", "assettype": "thinkpad", "company": "CustomerMSP", "tags": ["spare"]}`,
+		oldKey: "\x00",
+	})
+	newKey, _ := tag_key(l.stub, "spare", "ibm_asset", "SN1")
+	if _, found := l.stub.State[oldKey]; found {
+		t.Fatal("expected the old asset tag key removed")
+	}
+	if _, found := l.stub.State[newKey]; !found {
+		t.Fatal("expected the asset tag under ibm_asset")
+	}
+}
+
+func TestMigrateTicketLookup(t *testing.T) {
+	l := newLegacyTestLedger(t, map[string]string{
+		"t1": `{"docType": "ticket", "ticket_id": "t1", "status": "open", "ticketowner": "owner1", "asset": "SN1", "company": "CustomerMSP"}`,
+	})
+	if ids, _ := get_ticket_ids_by(l.stub, TICKET_OWNER_INDEX, "owner1"); len(ids) != 1 || ids[0] != "t1" {
+		t.Fatalf("expected the ticket found by its owner - %v", ids)
+	}
+	if ids, _ := get_ticket_ids_by(l.stub, TICKET_ASSET_INDEX, "SN1"); len(ids) != 1 || ids[0] != "t1" {
+		t.Fatalf("expected the ticket found by its asset - %v", ids)
+	}
+}
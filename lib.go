@@ -0,0 +1,2372 @@
+// =================================================
+// AssetChain v0.1 - ledger objects and helpers
+// =================================================
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+)
+
+// ----- Employee roles ----- //
+const (
+	ROLE_USER       = "user"       //can open tickets
+	ROLE_TECHNICIAN = "technician" //can be assigned tickets
+	ROLE_TEAMLEAD   = "teamlead"   //can be assigned tickets and sees team workload
+	ROLE_ADMIN      = "admin"      //manages employees and configuration
+	ROLE_SUPPORT    = "support"    //service provider staff, works tickets of every company
+)
+
+// ----- Ticket statuses ----- //
+const (
+	STATUS_OPEN        = "open"
+	STATUS_IN_PROGRESS = "in progress"
+	STATUS_RESOLVED    = "resolved"
+	STATUS_CLOSED      = "closed"
+)
+
+// ----- Asset lifecycle statuses ----- //
+const (
+	ASSET_IN_STOCK  = "in stock"
+	ASSET_DEPLOYED  = "deployed"
+	ASSET_IN_REPAIR = "in repair"
+	ASSET_RETIRED   = "retired"
+)
+
+// allowed asset status transitions, retired is final
+var assetTransitions = map[string][]string{
+	ASSET_IN_STOCK:  {ASSET_DEPLOYED, ASSET_RETIRED},
+	ASSET_DEPLOYED:  {ASSET_IN_STOCK, ASSET_IN_REPAIR, ASSET_RETIRED},
+	ASSET_IN_REPAIR: {ASSET_DEPLOYED, ASSET_IN_STOCK, ASSET_RETIRED},
+	ASSET_RETIRED:   {},
+}
+
+// tickets in this queue are hardware repairs and move their asset in and out of repair
+const QUEUE_HARDWARE = "hardware"
+
+// out of warranty hardware repairs are routed here to be charged back
+const QUEUE_BILLING = "billing"
+
+// ----- What init_ticket does with a likely duplicate ----- //
+const (
+	DUPLICATE_OFF    = "off"    //no check
+	DUPLICATE_REJECT = "reject" //the ticket is not opened
+	DUPLICATE_WARN   = "warn"   //the ticket is opened and the duplicates are listed in the response
+	DUPLICATE_LINK   = "link"   //the ticket is opened as a duplicate of the most similar one
+)
+
+// ----- Config value types ----- //
+const (
+	CONFIG_STRING      = "string"
+	CONFIG_NUMBER      = "number"
+	CONFIG_BOOL        = "bool"
+	CONFIG_STRING_LIST = "stringlist"
+)
+
+// composite key namespace config entries live under, nothing else can be written there
+const CONFIG_INDEX = "config~name~scope"
+
+// ----- ConfigSchema - what a config entry may hold ----- //
+type ConfigSchema struct {
+	Type        string   `json:"type"`
+	Scoped      bool     `json:"scoped"`      //one value per queue, scope is the queue name
+	Min         float64  `json:"min"`         //numbers only
+	Max         float64  `json:"max"`         //numbers only, 0 means no maximum
+	Enum        []string `json:"enum"`        //strings only, empty means any string
+	Required    []string `json:"required"`    //string lists only, items the list must contain
+	Description string   `json:"description"`
+}
+
+// every config entry the chaincode knows about, set_config refuses anything else
+var configSchemas = map[string]ConfigSchema{
+	"billing_queue": {Type: CONFIG_STRING, Description: "queue out of warranty hardware repairs are routed to"},
+	"queues":        {Type: CONFIG_STRING_LIST, Description: "queues tickets can be opened in, any queue when not set"},
+	"statuses": {Type: CONFIG_STRING_LIST, Description: "ticket status catalogue",
+		Required: []string{STATUS_OPEN, STATUS_IN_PROGRESS, STATUS_RESOLVED, STATUS_CLOSED}},
+	"sla_hours": {Type: CONFIG_NUMBER, Scoped: true, Min: 0, Description: "hours a ticket in the queue may stay unresolved, 0 for none"},
+	"provider_msp":  {Type: CONFIG_STRING, Description: "MSP of the service provider, co-endorses changes to customer tickets and assets"},
+	"csat_window_days": {Type: CONFIG_NUMBER, Scoped: true, Min: 0, Description: "days after closure the owner of a ticket in the queue can rate it, 0 for no limit"},
+	"labour_rate":   {Type: CONFIG_NUMBER, Scoped: true, Min: 0, Description: "hourly labour rate, scope is the rate category time is logged under"},
+	"duplicate_action": {Type: CONFIG_STRING, Scoped: true, Enum: []string{DUPLICATE_OFF, DUPLICATE_REJECT, DUPLICATE_WARN, DUPLICATE_LINK},
+		Description: "what init_ticket does with a likely duplicate of an open ticket in the queue, off when not set"},
+	"duplicate_window_hours": {Type: CONFIG_NUMBER, Scoped: true, Min: 0, Description: "how recent an open ticket must be to count as the original of a duplicate, 0 for any age"},
+	"duplicate_similarity": {Type: CONFIG_NUMBER, Min: 0, Max: 1, Description: "share of description words two tickets need in common to be duplicates"},
+	"retention_years": {Type: CONFIG_NUMBER, Scoped: true, Min: 0, Description: "years the personal details of a closed ticket in the queue are kept, 0 keeps them"},
+}
+
+// ----- Bootstrap - the channel configuration Init was given, written once ----- //
+type Bootstrap struct {
+	ObjectType     string          `json:"docType"` //field for couchdb
+	SchemaVersion  int             `json:"schemaversion"`
+	Admins         []AdminIdentity `json:"admins"`
+	Queues         []string        `json:"queues"`
+	SlaPolicies    []SlaPolicy     `json:"slapolicies"`
+	Statuses       []string        `json:"statuses"`
+	BootstrappedOn string          `json:"bootstrappedon"`
+	MigratedOn     string          `json:"migratedon"`
+}
+
+// an admin identity, an empty id makes every identity of the MSP an admin
+type AdminIdentity struct {
+	MspId string `json:"mspid"`
+	Id    string `json:"id"`    //as returned by cid.GetID()
+}
+
+type SlaPolicy struct {
+	Queue string  `json:"queue"`
+	Hours float64 `json:"hours"`
+}
+
+// composite key the bootstrap document is stored under
+const BOOTSTRAP_INDEX = "chaincode~bootstrap"
+
+// ----- ConfigEntry - a typed configuration value ----- //
+type ConfigEntry struct {
+	ObjectType string          `json:"docType"` //field for couchdb
+	Name       string          `json:"name"`
+	Scope      string          `json:"scope"`   //empty for channel wide entries
+	Value      json.RawMessage `json:"value"`
+	UpdatedBy  string          `json:"updatedby"`
+	UpdatedOn  string          `json:"updatedon"`
+}
+
+// ----- Personal data ----- //
+
+// private data collection personal data is kept in, see collections_config.json
+const COLLECTION_PII = "collectionPII"
+
+// composite key personal data records are stored under in the collection
+const PII_INDEX = "pii~subject~doctype~id"
+
+// the personal fields each document type may carry
+var piiFields = map[string][]string{
+	"ticket":   {"address", "contactphone", "contactemail"},
+	"employee": {"email"},
+}
+
+// ----- PiiReference - what stays on the public document, salted hashes of the personal fields ----- //
+type PiiReference struct {
+	Subject  string            `json:"subject"`  //employee the data is about
+	Hashes   map[string]string `json:"hashes"`   //field -> hex sha256(salt + value)
+	ErasedOn string            `json:"erasedon"` //set once the private data was erased
+	Reason   string            `json:"reason"`   //why it was erased, a data subject request or the retention policy
+}
+
+// reasons personal data gets erased
+const (
+	ERASED_ON_REQUEST   = "data subject request"
+	ERASED_BY_RETENTION = "retention policy"
+)
+
+// ----- PersonalData - the clear personal fields, private data only ----- //
+type PersonalData struct {
+	ObjectType string            `json:"docType"` //field for couchdb
+	Subject    string            `json:"subject"`
+	RecordType string            `json:"recordtype"` //docType of the public document
+	RecordId   string            `json:"recordid"`
+	Salt       string            `json:"salt"`
+	Fields     map[string]string `json:"fields"`
+}
+
+// composite key clear personal fields of documents from before schema version 3 wait under for migrate_personal_data
+const LEGACY_PII_INDEX = "legacypii~subject~doctype~id"
+
+// ----- LegacyPersonalData - clear personal fields the version 3 migration took off a public document ----- //
+type LegacyPersonalData struct {
+	ObjectType string            `json:"docType"` //field for couchdb
+	Subject    string            `json:"subject"`
+	RecordType string            `json:"recordtype"` //docType of the public document
+	RecordId   string            `json:"recordid"`
+	Fields     map[string]string `json:"fields"`
+}
+
+// ----- Company - a tenant of the channel, one per MSP ----- //
+type Company struct {
+	ObjectType string `json:"docType"` //field for couchdb
+	Company_Id string `json:"company_id"` //the MSP id of the organisation
+	Name       string `json:"name"`
+	CreatedOn  string `json:"createdon"`
+}
+
+// composite key companies are stored under
+const COMPANY_INDEX = "company~id"
+
+// ----- TenantScope - which company's data the caller may see ----- //
+type TenantScope struct {
+	Company     string
+	CrossTenant bool
+}
+
+// ----- Ticket - a support ticket opened by an employee ----- //
+type Ticket struct {
+	ObjectType         string           `json:"docType"` //field for couchdb
+	Ticket_Id          string           `json:"ticket_id"`
+	Company            string           `json:"company"`
+	Description        string           `json:"description"`
+	Date               string           `json:"date"`
+	Status             string           `json:"status"`
+	TicketOwner        string           `json:"ticketowner"`
+	Assignee           EmployeeRelation `json:"assignee"`
+	Asset              string           `json:"asset"`
+	Queue              string           `json:"queue"`
+	DescriptionProduct string           `json:"descriptionproduct"`
+	Prod               string           `json:"prod"`
+	Diagnostic         string           `json:"diagnostic"`
+	HardwarePw         string           `json:"hardwarepw"`
+	OsPw               string           `json:"ospw"`
+	PersonalData       PiiReference     `json:"personaldata"` //address, contactphone and contactemail live in private data
+	ClosedOn           string           `json:"closedon"`     //RFC3339, empty unless the ticket is closed
+	Signoffs           []Signoff        `json:"signoffs"`     //owner sign-offs, appended to and never changed once answered
+	Entitlement        *Entitlement     `json:"entitlement"` //nil when the asset is not on the ledger
+	Cost               *TicketCost      `json:"cost"`        //nil until the ticket is resolved
+	Invoice            string           `json:"invoice"`     //id of the invoice that billed the ticket
+	MaintenancePlan    string           `json:"maintenanceplan"` //plan that opened the ticket, empty for tickets opened by people
+	Checklist          []ChecklistItem  `json:"checklist"`   //copied from the asset type's template when the ticket is opened
+	CustomFields       map[string]interface{} `json:"customFields"` //extra fields defined per queue
+	Tags               []string         `json:"tags"`        //normalised, sorted
+	OpenedOn           string           `json:"openedon"`    //RFC3339 time of the transaction that opened the ticket
+	DuplicateOf        string           `json:"duplicateof"` //ticket this one duplicates, linked when it was opened
+	ChargedTo          *ChargedTo       `json:"chargedto"`   //frozen from the asset when the ticket is closed, nil before
+}
+
+// ----- ChargedTo - the cost centre and asset owner a ticket's costs go to ----- //
+type ChargedTo struct {
+	CostCentre string `json:"costcentre"`
+	Owner      string `json:"owner"`
+}
+
+// ----- Entitlement - warranty check done when a ticket is opened against an asset ----- //
+type Entitlement struct {
+	Covered     bool   `json:"covered"`     //repair is covered by the asset's warranty
+	Billable    bool   `json:"billable"`    //repair is charged back to the asset's cost centre
+	Unknown     bool   `json:"unknown"`     //the asset has no usable warranty end, coverage was not decided
+	WarrantyEnd string `json:"warrantyend"`
+	CheckedOn   string `json:"checkedon"`
+	RoutedFrom  string `json:"routedfrom"`  //original queue when the ticket was routed to billing
+}
+
+// ----- Signoff - the ticket owner's answer to a resolution ----- //
+type Signoff struct {
+	Resolution  string `json:"resolution"`
+	RequestedBy string `json:"requestedby"`
+	RequestedOn string `json:"requestedon"`
+	Outcome     string `json:"outcome"`     //pending until the owner answers
+	Comment     string `json:"comment"`     //the reason when rejected
+	AnsweredBy  string `json:"answeredby"`
+	AnsweredOn  string `json:"answeredon"`
+}
+
+// ----- Signoff outcomes ----- //
+const (
+	SIGNOFF_PENDING  = "pending"
+	SIGNOFF_ACCEPTED = "accepted"
+	SIGNOFF_REJECTED = "rejected"
+	SIGNOFF_WITHDRAWN = "withdrawn" //the ticket was reopened before the owner answered
+)
+
+// ----- Attachment - a file on a ticket, stored off chain and anchored by its hash ----- //
+type Attachment struct {
+	ObjectType    string `json:"docType"` //field for couchdb
+	Attachment_Id string `json:"attachment_id"`
+	Ticket_Id     string `json:"ticket_id"`
+	Filename      string `json:"filename"`
+	MimeType      string `json:"mimetype"`
+	Size          int64  `json:"size"`        //bytes
+	Sha256        string `json:"sha256"`      //lower case hex
+	StorageUri    string `json:"storageuri"`  //where the file itself lives
+	Uploader      string `json:"uploader"`
+	UploadedOn    string `json:"uploadedon"`
+}
+
+// attachments are keyed by ticket then attachment id
+const ATTACHMENT_INDEX = "ticket~attachment"
+
+// ----- Csat - the owner's satisfaction rating of a closed ticket, one per ticket ----- //
+type Csat struct {
+	ObjectType  string `json:"docType"` //field for couchdb
+	Ticket_Id   string `json:"ticket_id"`
+	Company     string `json:"company"`
+	Score       int    `json:"score"`     //1 to 5
+	Comment     string `json:"comment"`
+	SubmittedBy string `json:"submittedby"`
+	SubmittedOn string `json:"submittedon"`
+	Assignee    string `json:"assignee"`  //assignee, queue and asset type as they were when the ticket was rated
+	Queue       string `json:"queue"`
+	AssetType   string `json:"assettype"`
+}
+
+// ratings are keyed by ticket
+const CSAT_INDEX = "ticket~csat"
+
+// ----- Part - spare parts stock of a company at a site ----- //
+type Part struct {
+	ObjectType   string `json:"docType"` //field for couchdb
+	Part_Number  string `json:"part_number"`
+	Site         string `json:"site"`
+	Company      string `json:"company"`
+	Description  string `json:"description"`
+	Quantity     int    `json:"quantity"`
+	ReorderLevel int    `json:"reorderlevel"` //a low stock event is sent once quantity drops to this
+	UnitCost     float64 `json:"unitcost"`
+	UpdatedOn    string `json:"updatedon"`
+}
+
+// stock is keyed by company, site then part number, companies sharing a site keep their own stock
+const PART_INDEX = "part~company~site~number"
+
+// ----- PartUsage - parts consumed by a ticket ----- //
+type PartUsage struct {
+	ObjectType  string `json:"docType"` //field for couchdb
+	Usage_Id    string `json:"usage_id"` //id of the transaction that consumed the parts
+	Ticket_Id   string `json:"ticket_id"`
+	Part_Number string `json:"part_number"`
+	Site        string `json:"site"`
+	Quantity    int    `json:"quantity"`
+	UnitCost    float64 `json:"unitcost"` //unit cost of the part when it was consumed
+	Cost        float64 `json:"cost"`
+	ConsumedBy  string `json:"consumedby"`
+	ConsumedOn  string `json:"consumedon"`
+}
+
+// usage is keyed by ticket then usage id
+const PART_USAGE_INDEX = "ticket~part"
+
+// ----- TimeEntry - labour logged on a ticket ----- //
+type TimeEntry struct {
+	ObjectType   string  `json:"docType"` //field for couchdb
+	Entry_Id     string  `json:"entry_id"` //id of the transaction that logged the time
+	Ticket_Id    string  `json:"ticket_id"`
+	Technician   string  `json:"technician"`
+	Minutes      int     `json:"minutes"`
+	RateCategory string  `json:"ratecategory"`
+	Rate         float64 `json:"rate"`     //hourly labour_rate of the category when the time was logged
+	Cost         float64 `json:"cost"`
+	LoggedBy     string  `json:"loggedby"`
+	LoggedOn     string  `json:"loggedon"`
+}
+
+// time entries are keyed by ticket then entry id
+const TIME_ENTRY_INDEX = "ticket~time"
+
+// ----- TicketCost - what a ticket cost, worked out when it is resolved ----- //
+type TicketCost struct {
+	Minutes    int     `json:"minutes"`
+	Labour     float64 `json:"labour"`
+	Parts      float64 `json:"parts"`
+	Total      float64 `json:"total"`
+	ComputedOn string  `json:"computedon"`
+}
+
+// ----- Invoice - chargeback of a cost centre's billable tickets closed in a period, never changed once written ----- //
+type Invoice struct {
+	ObjectType  string        `json:"docType"` //field for couchdb
+	Invoice_Id  string        `json:"invoice_id"`
+	Company     string        `json:"company"`
+	CostCentre  string        `json:"costcentre"`
+	PeriodStart string        `json:"periodstart"`
+	PeriodEnd   string        `json:"periodend"`
+	Lines       []InvoiceLine `json:"lines"`
+	Total       float64       `json:"total"`
+	GeneratedBy string        `json:"generatedby"`
+	GeneratedOn string        `json:"generatedon"`
+}
+
+// ----- InvoiceLine - the cost of one ticket, frozen when the invoice was generated ----- //
+type InvoiceLine struct {
+	Ticket_Id string  `json:"ticket_id"`
+	Asset     string  `json:"asset"`
+	Queue     string  `json:"queue"`
+	ClosedOn  string  `json:"closedon"`
+	Minutes   int     `json:"minutes"`
+	Labour    float64 `json:"labour"`
+	Parts     float64 `json:"parts"`
+	Total     float64 `json:"total"`
+}
+
+// invoices are keyed by id
+const INVOICE_INDEX = "invoice~id"
+
+// ----- Rma - a part or device sent back to its vendor for a ticket ----- //
+type Rma struct {
+	ObjectType        string `json:"docType"` //field for couchdb
+	Rma_Id            string `json:"rma_id"`
+	Ticket_Id         string `json:"ticket_id"`
+	Company           string `json:"company"`
+	Asset             string `json:"asset"`             //serial that went back to the vendor
+	Vendor            string `json:"vendor"`
+	RmaNumber         string `json:"rmanumber"`         //the vendor's reference
+	Status            string `json:"status"`
+	ShippedOn         string `json:"shippedon"`         //YYYY-MM-DD
+	ReceivedOn        string `json:"receivedon"`        //YYYY-MM-DD
+	ReplacementSerial string `json:"replacementserial"` //empty when the same device came back
+	OpenedBy          string `json:"openedby"`
+	OpenedOn          string `json:"openedon"`
+}
+
+// ----- RMA statuses ----- //
+const (
+	RMA_OPEN     = "open"
+	RMA_SHIPPED  = "shipped"
+	RMA_RECEIVED = "received"
+)
+
+// RMAs are keyed by ticket then RMA id
+const RMA_INDEX = "ticket~rma"
+
+// ----- Visit - an on-site visit of a technician for a ticket ----- //
+type Visit struct {
+	ObjectType  string `json:"docType"` //field for couchdb
+	Visit_Id    string `json:"visit_id"`
+	Ticket_Id   string `json:"ticket_id"`
+	Company     string `json:"company"`
+	Technician  string `json:"technician"`
+	Site        string `json:"site"`
+	WindowStart string `json:"windowstart"` //RFC3339
+	WindowEnd   string `json:"windowend"`   //RFC3339
+	Status      string `json:"status"`
+	CheckedIn   string `json:"checkedin"`   //RFC3339, when the technician actually arrived
+	CheckedOut  string `json:"checkedout"`  //RFC3339, when the technician actually left
+	ScheduledBy string `json:"scheduledby"`
+	ScheduledOn string `json:"scheduledon"`
+}
+
+// ----- Visit statuses ----- //
+const (
+	VISIT_SCHEDULED  = "scheduled"
+	VISIT_CHECKED_IN = "checked in"
+	VISIT_COMPLETED  = "completed"
+)
+
+// visits are keyed by technician then visit id, for the agenda and conflict checks
+const VISIT_INDEX = "technician~visit"
+
+// ----- MaintenancePlan - periodic servicing of an asset type, or of one asset ----- //
+type MaintenancePlan struct {
+	ObjectType   string   `json:"docType"` //field for couchdb
+	Plan_Id      string   `json:"plan_id"`
+	Company      string   `json:"company"`
+	AssetType    string   `json:"assettype"`    //either the asset type or the asset is set
+	Asset        string   `json:"asset"`
+	IntervalDays int      `json:"intervaldays"`
+	StartDate    string   `json:"startdate"`    //YYYY-MM-DD, first day of the first period
+	Checklist    []string `json:"checklist"`
+	Queue        string   `json:"queue"`
+	Owner        string   `json:"owner"`        //employee the maintenance tickets are opened for
+	Assignee     string   `json:"assignee"`
+	Description  string   `json:"description"`
+	UpdatedBy    string   `json:"updatedby"`
+	UpdatedOn    string   `json:"updatedon"`
+}
+
+// plans are keyed by id
+const MAINTENANCE_PLAN_INDEX = "maintenance~plan"
+
+// the ticket a plan opened for an asset in a period, written once so each period gets one ticket
+const MAINTENANCE_RUN_INDEX = "maintenance~plan~asset~period"
+
+// ----- ChecklistTemplate - the diagnostic checklist tickets on an asset type start with ----- //
+type ChecklistTemplate struct {
+	ObjectType string                  `json:"docType"` //field for couchdb
+	AssetType  string                  `json:"assettype"`
+	Items      []ChecklistTemplateItem `json:"items"`
+	UpdatedBy  string                  `json:"updatedby"`
+	UpdatedOn  string                  `json:"updatedon"`
+}
+
+type ChecklistTemplateItem struct {
+	Name      string `json:"name"`
+	Mandatory bool   `json:"mandatory"`
+}
+
+// templates are keyed by lower case asset type
+const CHECKLIST_INDEX = "checklist~assettype"
+
+// ----- ChecklistItem - a checklist item on a ticket ----- //
+type ChecklistItem struct {
+	Name      string `json:"name"`
+	Mandatory bool   `json:"mandatory"` //the ticket cannot be resolved until the item has a result
+	Result    string `json:"result"`    //empty until checked
+	Notes     string `json:"notes"`
+	UpdatedBy string `json:"updatedby"`
+	UpdatedOn string `json:"updatedon"`
+}
+
+// ----- Checklist item results ----- //
+const (
+	CHECK_PASS = "pass"
+	CHECK_FAIL = "fail"
+)
+
+// ----- CustomFieldSchema - the extra fields tickets in a queue carry ----- //
+type CustomFieldSchema struct {
+	ObjectType string                  `json:"docType"` //field for couchdb
+	Queue      string                  `json:"queue"`
+	Fields     []CustomFieldDefinition `json:"fields"`
+	UpdatedBy  string                  `json:"updatedby"`
+	UpdatedOn  string                  `json:"updatedon"`
+}
+
+type CustomFieldDefinition struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Enum     []string `json:"enum"` //strings only, empty means any string
+}
+
+// ----- Custom field types ----- //
+const (
+	FIELD_STRING = "string"
+	FIELD_NUMBER = "number"
+	FIELD_BOOL   = "bool"
+	FIELD_DATE   = "date" //YYYY-MM-DD
+)
+
+// schemas are keyed by queue
+const CUSTOM_FIELDS_INDEX = "customfields~queue"
+
+// tag index entries are keyed by tag, object type and id
+const TAG_INDEX = "tag~objecttype~id"
+
+// search index entries are keyed by the term's first two characters, the term and the ticket, the bucket lets a
+// prefix search use a partial key, LevelDB has no other way to range over composite keys
+const SEARCH_INDEX = "search~bucket~term~ticket"
+
+// tickets by owner and by asset, the duplicate check looks up its candidates here
+const TICKET_OWNER_INDEX = "owner~ticket"
+const TICKET_ASSET_INDEX = "asset~ticket"
+
+// ticket fields that are searchable
+var searchFields = []string{"description", "descriptionproduct", "diagnostic"}
+
+// ----- DuplicateCheck - likely duplicates of a new ticket, most similar first ----- //
+type DuplicateCheck struct {
+	Ticket_Id  string      `json:"ticket_id"`
+	Action     string      `json:"action"`
+	Duplicates []Duplicate `json:"duplicates"`
+}
+
+type Duplicate struct {
+	Ticket_Id  string  `json:"ticket_id"`
+	Reason     string  `json:"reason"`     //same asset or same owner
+	Similarity float64 `json:"similarity"`
+}
+
+// ----- TicketAttributes - the ticket attributes update_ticket changes, nil fields are left alone ----- //
+type TicketAttributes struct {
+	Description        *string                `json:"description"`
+	DescriptionProduct *string                `json:"descriptionproduct"`
+	Prod               *string                `json:"prod"`
+	Diagnostic         *string                `json:"diagnostic"`
+	CustomFields       map[string]interface{} `json:"customFields"` //merged into the ticket's, null removes a field
+}
+
+// ----- TicketDetails - a ticket with the records kept next to it, returned by read_ticket ----- //
+type TicketDetails struct {
+	Ticket
+	Attachments []Attachment `json:"attachments"`
+	Parts       []PartUsage  `json:"parts"`
+	TimeEntries []TimeEntry  `json:"timeentries"`
+	Rmas        []Rma        `json:"rmas"`
+}
+
+// ----- Employee - anyone who opens or works tickets ----- //
+type Employee struct {
+	ObjectType    string   `json:"docType"` //field for couchdb
+	Employee_sn   string   `json:"employee_sn"`
+	Company       string   `json:"company"`
+	PersonalData  PiiReference `json:"personaldata"` //email lives in private data
+	Fullname      string   `json:"fullname"`
+	Role          string   `json:"role"`
+	Team          string   `json:"team"`
+	Skills        []string `json:"skills"`
+	Deactivated   bool     `json:"deactivated"`   //deactivated employees keep their history but take no new tickets
+	DeactivatedOn string   `json:"deactivatedon"`
+}
+
+type EmployeeRelation struct {
+	Employee_sn string `json:"employee_sn"`
+	Fullname    string `json:"fullname"`
+}
+
+// ----- IBM_Asset - a device tickets can be opened against ----- //
+type IBM_Asset struct {
+	ObjectType   string `json:"docType"` //field for couchdb
+	SerialNumber string `json:"serialnumber"`
+	Company      string `json:"company"`
+	AssetType    string `json:"assettype"`
+	Tickets      string `json:"tickets"`
+	Owner        string `json:"owner"`
+	Status       string `json:"status"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	PurchaseDate string `json:"purchasedate"` //YYYY-MM-DD
+	WarrantyEnd  string `json:"warrantyend"`  //YYYY-MM-DD, last day covered
+	Location     string `json:"location"`
+	Site         string `json:"site"`
+	CostCentre   string `json:"costcentre"`
+	Replaces     string `json:"replaces"`   //serial of the asset this one replaced under an RMA
+	ReplacedBy   string `json:"replacedby"` //serial of the asset that replaced this one under an RMA
+	Tags         []string `json:"tags"`     //normalised, sorted
+}
+
+// ----- AssetAttributes - the optional IBM_Asset attributes, nil fields are left alone on update ----- //
+type AssetAttributes struct {
+	Manufacturer *string `json:"manufacturer"`
+	Model        *string `json:"model"`
+	PurchaseDate *string `json:"purchasedate"`
+	WarrantyEnd  *string `json:"warrantyend"`
+	Location     *string `json:"location"`
+	Site         *string `json:"site"`
+	CostCentre   *string `json:"costcentre"`
+}
+
+// ============================================================================================================================
+// Get Ticket - get a ticket from ledger
+// ============================================================================================================================
+func get_ticket(stub shim.ChaincodeStubInterface, id string) (Ticket, error) {
+	var ticket Ticket
+	ticketAsBytes, err := stub.GetState(id)                  //getState retreives a key/value from the ledger
+	if err != nil {                                          //this seems to always succeed, even if key didn't exist
+		return ticket, errors.New("Failed to find ticket - " + id)
+	}
+	json.Unmarshal(ticketAsBytes, &ticket)                   //un stringify it aka JSON.parse()
+
+	if ticket.Ticket_Id != id {                              //test if ticket is actually here or just nil
+		return ticket, errors.New("Ticket does not exist - " + id)
+	}
+
+	return ticket, nil
+}
+
+// ============================================================================================================================
+// Get Employee - get an employee from ledger
+// ============================================================================================================================
+func get_employee(stub shim.ChaincodeStubInterface, id string) (Employee, error) {
+	var employee Employee
+	employeeAsBytes, err := stub.GetState(id)                //getState retreives a key/value from the ledger
+	if err != nil {                                          //this seems to always succeed, even if key didn't exist
+		return employee, errors.New("Failed to get employee - " + id)
+	}
+	json.Unmarshal(employeeAsBytes, &employee)               //un stringify it aka JSON.parse()
+
+	if employee.Employee_sn != id {                          //test if employee is actually here or just nil
+		return employee, errors.New("Employee does not exist - " + id)
+	}
+
+	return employee, nil
+}
+
+// ============================================================================================================================
+// Get IBM_Asset - get an asset from ledger
+// ============================================================================================================================
+func get_ibmasset(stub shim.ChaincodeStubInterface, id string) (IBM_Asset, error) {
+	var ibmasset IBM_Asset
+	ibmassetAsBytes, err := stub.GetState(id)                //getState retreives a key/value from the ledger
+	if err != nil {                                          //this seems to always succeed, even if key didn't exist
+		return ibmasset, errors.New("Failed to get asset - " + id)
+	}
+	json.Unmarshal(ibmassetAsBytes, &ibmasset)               //un stringify it aka JSON.parse()
+
+	if ibmasset.SerialNumber != id {                         //test if asset is actually here or just nil
+		return ibmasset, errors.New("Asset does not exist - " + id)
+	}
+
+	return ibmasset, nil
+}
+
+// ============================================================================================================================
+// Ticket status helpers - statuses are free text from the client so compare them loosely
+// ============================================================================================================================
+func normalize_status(status string) string {
+	status = strings.ToLower(strings.TrimSpace(status))
+	return strings.Replace(strings.Replace(status, "_", " ", -1), "-", " ", -1)
+}
+
+// the core statuses are always known, the channel's status catalogue can add more
+func is_valid_status(stub shim.ChaincodeStubInterface, status string) bool {
+	core := []string{STATUS_OPEN, STATUS_IN_PROGRESS, STATUS_RESOLVED, STATUS_CLOSED}
+	for _, known := range get_config_list(stub, "statuses", "", core) {
+		if normalize_status(known) == normalize_status(status) {
+			return true
+		}
+	}
+	return false
+}
+
+func is_resolved_status(status string) bool {
+	status = normalize_status(status)
+	return status == STATUS_RESOLVED || status == STATUS_CLOSED
+}
+
+// ============================================================================================================================
+// Get All Tickets - walk every simple key in state and keep the ticket documents
+// ============================================================================================================================
+func get_all_tickets(stub shim.ChaincodeStubInterface) ([]Ticket, error) {
+	var tickets []Ticket
+	resultsIterator, err := stub.GetStateByRange("", "")    //empty range covers every non composite key
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var ticket Ticket
+		json.Unmarshal(pointer.GetValue(), &ticket)          //un stringify it aka JSON.parse()
+		if ticket.ObjectType == "ticket" {
+			tickets = append(tickets, ticket)
+		}
+	}
+	return tickets, nil
+}
+
+// ============================================================================================================================
+// Asset status helpers
+// ============================================================================================================================
+
+// assets created before lifecycle statuses existed are in use
+func asset_status(ibmasset IBM_Asset) string {
+	if len(ibmasset.Status) == 0 {
+		return ASSET_DEPLOYED
+	}
+	return ibmasset.Status
+}
+
+func is_hardware_queue(queue string) bool {
+	return strings.ToLower(strings.TrimSpace(queue)) == QUEUE_HARDWARE
+}
+
+// escape a part of an id joined with '-', so the parts can hold '-' without two different sets of parts giving one id
+var idPartEscaper = strings.NewReplacer("%", "%25", "-", "%2D")
+
+func id_part(str string) string {
+	return idPartEscaper.Replace(str)
+}
+
+// who a ticket's costs go to, frozen when it was closed so a later asset swap or cost centre change does not move them,
+// read from its asset until then
+func ticket_charged_to(stub shim.ChaincodeStubInterface, ticket Ticket) ChargedTo {
+	if ticket.ChargedTo != nil {
+		return *ticket.ChargedTo
+	}
+	ibmasset, _ := get_ibmasset(stub, ticket.Asset)
+	return ChargedTo{ibmasset.CostCentre, ibmasset.Owner}
+}
+
+// hardware tickets routed to billing are still hardware repairs
+func is_hardware_ticket(ticket Ticket) bool {
+	if ticket.Entitlement != nil && is_hardware_queue(ticket.Entitlement.RoutedFrom) {
+		return true
+	}
+	return is_hardware_queue(ticket.Queue)
+}
+
+// ============================================================================================================================
+// Check Entitlement - decide whether a repair on the asset is covered and where the ticket should go
+//
+// Returns the entitlement to record on the ticket and the queue the ticket belongs in. Assets without a usable warranty
+// end give an unknown entitlement, neither covered nor billable, and the ticket stays in its queue.
+// ============================================================================================================================
+func check_entitlement(stub shim.ChaincodeStubInterface, ibmasset IBM_Asset, queue string) (Entitlement, string, error) {
+	var entitlement Entitlement
+	today, err := get_tx_datetime(stub)
+	if err != nil {
+		return entitlement, queue, err
+	}
+
+	entitlement.WarrantyEnd = ibmasset.WarrantyEnd
+	entitlement.CheckedOn = today.Format(time.RFC3339)
+	if !warranty_known(ibmasset) {
+		entitlement.Unknown = true
+		return entitlement, queue, nil
+	}
+	entitlement.Covered = in_warranty(ibmasset, today)
+
+	if !entitlement.Covered && is_hardware_queue(queue) {
+		entitlement.Billable = true
+		entitlement.RoutedFrom = queue
+		queue = get_config_string(stub, "billing_queue", "", QUEUE_BILLING)
+	}
+	return entitlement, queue, nil
+}
+
+// move an asset to a new lifecycle status if the transition is allowed and store it
+func set_asset_status(stub shim.ChaincodeStubInterface, ibmasset IBM_Asset, status string) (IBM_Asset, error) {
+	current := asset_status(ibmasset)
+	if _, ok := assetTransitions[status]; !ok {
+		return ibmasset, errors.New("Unknown asset status - " + status)
+	}
+	for _, next := range assetTransitions[current] {
+		if next == status {
+			ibmasset.Status = status
+			ibmassetAsBytes, _ := json.Marshal(ibmasset)          //convert to array of bytes
+			err := stub.PutState(ibmasset.SerialNumber, ibmassetAsBytes)
+			return ibmasset, err
+		}
+	}
+	return ibmasset, errors.New("Asset " + ibmasset.SerialNumber + " cannot move from '" + current + "' to '" + status + "'")
+}
+
+// ============================================================================================================================
+// Get All Assets - walk every simple key in state and keep the IBM_Asset documents
+// ============================================================================================================================
+func get_all_assets(stub shim.ChaincodeStubInterface) ([]IBM_Asset, error) {
+	var assets []IBM_Asset
+	resultsIterator, err := stub.GetStateByRange("", "")    //empty range covers every non composite key
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var ibmasset IBM_Asset
+		json.Unmarshal(pointer.GetValue(), &ibmasset)        //un stringify it aka JSON.parse()
+		if ibmasset.ObjectType == "ibm_asset" {
+			assets = append(assets, ibmasset)
+		}
+	}
+	return assets, nil
+}
+
+// ============================================================================================================================
+// Asset attribute helpers
+// ============================================================================================================================
+
+// copy the attributes that were given onto the asset
+func apply_asset_attributes(ibmasset *IBM_Asset, attributes AssetAttributes) {
+	fields := []struct {
+		from *string
+		to   *string
+	}{
+		{attributes.Manufacturer, &ibmasset.Manufacturer},
+		{attributes.Model, &ibmasset.Model},
+		{attributes.PurchaseDate, &ibmasset.PurchaseDate},
+		{attributes.WarrantyEnd, &ibmasset.WarrantyEnd},
+		{attributes.Location, &ibmasset.Location},
+		{attributes.Site, &ibmasset.Site},
+		{attributes.CostCentre, &ibmasset.CostCentre},
+	}
+	for _, field := range fields {
+		if field.from != nil {
+			*field.to = strings.TrimSpace(*field.from)
+		}
+	}
+}
+
+// check the optional attributes of an asset, empty attributes are always fine
+func validate_asset_attributes(ibmasset IBM_Asset) error {
+	texts := map[string]string{
+		"manufacturer": ibmasset.Manufacturer,
+		"model":        ibmasset.Model,
+		"location":     ibmasset.Location,
+		"site":         ibmasset.Site,
+		"costcentre":   ibmasset.CostCentre,
+	}
+	for name, value := range texts {
+		if len(value) > 64 {
+			return errors.New("Asset " + name + " must be <= 64 characters")
+		}
+	}
+	for _, r := range ibmasset.CostCentre {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return errors.New("Asset costcentre may only contain letters, digits and '-' - " + ibmasset.CostCentre)
+		}
+	}
+
+	var purchased, warrantyEnd time.Time
+	var err error
+	if len(ibmasset.PurchaseDate) > 0 {
+		purchased, err = time.Parse("2006-01-02", ibmasset.PurchaseDate)
+		if err != nil {
+			return errors.New("Asset purchasedate must be YYYY-MM-DD - " + ibmasset.PurchaseDate)
+		}
+	}
+	if len(ibmasset.WarrantyEnd) > 0 {
+		warrantyEnd, err = time.Parse("2006-01-02", ibmasset.WarrantyEnd)
+		if err != nil {
+			return errors.New("Asset warrantyend must be YYYY-MM-DD - " + ibmasset.WarrantyEnd)
+		}
+	}
+	if !purchased.IsZero() && !warrantyEnd.IsZero() && warrantyEnd.Before(purchased) {
+		return errors.New("Asset warrantyend is before purchasedate")
+	}
+	return nil
+}
+
+// does the asset have a warranty end date coverage can be decided on
+func warranty_known(ibmasset IBM_Asset) bool {
+	_, err := time.Parse("2006-01-02", ibmasset.WarrantyEnd)
+	return err == nil
+}
+
+// is the asset under warranty on the given day, assets without a warranty end date are not
+func in_warranty(ibmasset IBM_Asset, day time.Time) bool {
+	if len(ibmasset.WarrantyEnd) == 0 {
+		return false
+	}
+	warrantyEnd, err := time.Parse("2006-01-02", ibmasset.WarrantyEnd)
+	if err != nil {
+		return false
+	}
+	return day.Before(warrantyEnd.AddDate(0, 0, 1))                //warranty end day is still covered
+}
+
+// ============================================================================================================================
+// Config helpers
+// ============================================================================================================================
+
+// check a raw JSON value against the schema of a config entry
+func validate_config_value(name string, scope string, value []byte) error {
+	schema, ok := configSchemas[name]
+	if !ok {
+		return errors.New("Unknown config entry - " + name)
+	}
+	if schema.Scoped && len(scope) == 0 {
+		return errors.New("Config entry " + name + " is set per queue, expecting a scope")
+	}
+	if !schema.Scoped && len(scope) > 0 {
+		return errors.New("Config entry " + name + " is channel wide and takes no scope")
+	}
+
+	switch schema.Type {
+	case CONFIG_STRING:
+		var str string
+		if json.Unmarshal(value, &str) != nil {
+			return errors.New("Config entry " + name + " must be a JSON string")
+		}
+		if len(schema.Enum) > 0 && !contains(schema.Enum, str) {
+			return errors.New("Config entry " + name + " must be one of " + strings.Join(schema.Enum, ", "))
+		}
+	case CONFIG_NUMBER:
+		var number float64
+		if json.Unmarshal(value, &number) != nil {
+			return errors.New("Config entry " + name + " must be a JSON number")
+		}
+		if number < schema.Min || (schema.Max > 0 && number > schema.Max) {
+			return errors.New("Config entry " + name + " is out of range")
+		}
+	case CONFIG_BOOL:
+		var flag bool
+		if json.Unmarshal(value, &flag) != nil {
+			return errors.New("Config entry " + name + " must be true or false")
+		}
+	case CONFIG_STRING_LIST:
+		var list []string
+		if json.Unmarshal(value, &list) != nil {
+			return errors.New("Config entry " + name + " must be a JSON array of strings")
+		}
+		for _, item := range list {
+			if len(strings.TrimSpace(item)) == 0 {
+				return errors.New("Config entry " + name + " must not contain empty strings")
+			}
+		}
+		for _, required := range schema.Required {
+			if !contains(list, required) {
+				return errors.New("Config entry " + name + " must contain '" + required + "'")
+			}
+		}
+	default:
+		return errors.New("Config entry " + name + " has unknown type " + schema.Type)
+	}
+	return nil
+}
+
+func config_key(stub shim.ChaincodeStubInterface, name string, scope string) (string, error) {
+	return stub.CreateCompositeKey(CONFIG_INDEX, []string{name, scope})
+}
+
+// get a config entry, found is false when it was never set
+func get_config(stub shim.ChaincodeStubInterface, name string, scope string) (ConfigEntry, bool, error) {
+	var entry ConfigEntry
+	key, err := config_key(stub, name, scope)
+	if err != nil {
+		return entry, false, err
+	}
+	entryAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return entry, false, errors.New("Failed to get config entry - " + name)
+	}
+	if entryAsBytes == nil {
+		return entry, false, nil
+	}
+	err = json.Unmarshal(entryAsBytes, &entry)
+	return entry, err == nil, err
+}
+
+// typed config getter, falls back to the given default when the entry is not set
+func get_config_string(stub shim.ChaincodeStubInterface, name string, scope string, fallback string) string {
+	entry, found, err := get_config(stub, name, scope)
+	var str string
+	if err != nil || !found || json.Unmarshal(entry.Value, &str) != nil {
+		return fallback
+	}
+	return str
+}
+
+func get_config_number(stub shim.ChaincodeStubInterface, name string, scope string, fallback float64) float64 {
+	entry, found, err := get_config(stub, name, scope)
+	var number float64
+	if err != nil || !found || json.Unmarshal(entry.Value, &number) != nil {
+		return fallback
+	}
+	return number
+}
+
+func get_config_list(stub shim.ChaincodeStubInterface, name string, scope string, fallback []string) []string {
+	entry, found, err := get_config(stub, name, scope)
+	var list []string
+	if err != nil || !found || json.Unmarshal(entry.Value, &list) != nil {
+		return fallback
+	}
+	return list
+}
+
+// validate and write a config entry, callers do their own access checks
+func put_config(stub shim.ChaincodeStubInterface, name string, scope string, value interface{}, updatedBy string) (ConfigEntry, error) {
+	var entry ConfigEntry
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		return entry, errors.New("Config entry " + name + " is not valid JSON")
+	}
+	err = validate_config_value(name, scope, valueAsBytes)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.ObjectType = "config"
+	entry.Name = name
+	entry.Scope = scope
+	entry.Value = json.RawMessage(valueAsBytes)
+	entry.UpdatedBy = updatedBy
+	entry.UpdatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return entry, err
+	}
+
+	key, err := config_key(stub, name, scope)
+	if err != nil {
+		return entry, err
+	}
+	entryAsBytes, _ := json.Marshal(entry)          //convert to array of bytes
+	return entry, stub.PutState(key, entryAsBytes)  //write the entry into the ledger
+}
+
+// ============================================================================================================================
+// Get Bootstrap - get the bootstrap document, found is false before Init has bootstrapped the channel
+// ============================================================================================================================
+func get_bootstrap(stub shim.ChaincodeStubInterface) (Bootstrap, bool, error) {
+	var bootstrap Bootstrap
+	key, err := stub.CreateCompositeKey(BOOTSTRAP_INDEX, []string{})
+	if err != nil {
+		return bootstrap, false, err
+	}
+	bootstrapAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return bootstrap, false, errors.New("Failed to get bootstrap document")
+	}
+	if bootstrapAsBytes == nil {
+		return bootstrap, false, nil
+	}
+	err = json.Unmarshal(bootstrapAsBytes, &bootstrap)
+	return bootstrap, err == nil, err
+}
+
+func put_bootstrap(stub shim.ChaincodeStubInterface, bootstrap Bootstrap) error {
+	key, err := stub.CreateCompositeKey(BOOTSTRAP_INDEX, []string{})
+	if err != nil {
+		return err
+	}
+	bootstrapAsBytes, _ := json.Marshal(bootstrap)
+	return stub.PutState(key, bootstrapAsBytes)
+}
+
+func contains(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Employee role helpers
+// ============================================================================================================================
+func is_valid_role(role string) bool {
+	switch role {
+	case ROLE_USER, ROLE_TECHNICIAN, ROLE_TEAMLEAD, ROLE_ADMIN, ROLE_SUPPORT:
+		return true
+	}
+	return false
+}
+
+// employees created before roles existed are plain users until an admin assigns them a role
+func employee_role(employee Employee) string {
+	if len(employee.Role) == 0 {
+		return ROLE_USER
+	}
+	return employee.Role
+}
+
+// can this employee be given a ticket to work on
+func can_take_assignment(employee Employee) error {
+	if employee.Deactivated {
+		return errors.New("Employee is deactivated - " + employee.Employee_sn)
+	}
+	role := employee_role(employee)
+	if role != ROLE_TECHNICIAN && role != ROLE_TEAMLEAD && role != ROLE_SUPPORT {
+		return errors.New("Employee " + employee.Employee_sn + " has role '" + role + "' and cannot be assigned tickets")
+	}
+	return nil
+}
+
+// can this employee work on tickets of the company, support staff work for every company
+func can_work_for(employee Employee, company string) error {
+	if employee.Company == company || employee_role(employee) == ROLE_SUPPORT {
+		return nil
+	}
+	return errors.New("Employee " + employee.Employee_sn + " works for another company")
+}
+
+// ============================================================================================================================
+// Caller helpers - map the submitting identity onto an employee
+//
+// The enrollment certificate carries the employee serial number in the "employee_sn" attribute. Identities enrolled with
+// the attribute "role=admin" and the admins listed in the bootstrap document are treated as admins even when they are
+// not linked to an employee.
+// ============================================================================================================================
+func get_caller_employee(stub shim.ChaincodeStubInterface) (Employee, error) {
+	var employee Employee
+	employee_sn, found, err := cid.GetAttributeValue(stub, "employee_sn")
+	if err != nil {
+		return employee, errors.New("Failed to read caller identity - " + err.Error())
+	}
+	if !found {
+		return employee, errors.New("Caller identity is not linked to an employee")
+	}
+	return get_employee(stub, employee_sn)
+}
+
+func caller_is_admin(stub shim.ChaincodeStubInterface) bool {
+	if cid.AssertAttributeValue(stub, "role", ROLE_ADMIN) == nil {
+		return true
+	}
+	if caller_is_bootstrap_admin(stub) {
+		return true
+	}
+	employee, err := get_caller_employee(stub)
+	if err != nil {
+		return false
+	}
+	return !employee.Deactivated && employee_role(employee) == ROLE_ADMIN
+}
+
+func caller_is_bootstrap_admin(stub shim.ChaincodeStubInterface) bool {
+	bootstrap, found, err := get_bootstrap(stub)
+	if err != nil || !found {
+		return false
+	}
+	mspId, err := cid.GetMSPID(stub)
+	if err != nil {
+		return false
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return false
+	}
+	for _, admin := range bootstrap.Admins {
+		if admin.MspId == mspId && (len(admin.Id) == 0 || admin.Id == id) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Tenant helpers - every ticket, employee and asset belongs to the company of the MSP that created it
+//
+// Callers only see and change their own company's data. Admins and employees with the support role work across
+// companies. Documents from before companies existed have no company and are only visible across companies.
+// ============================================================================================================================
+func get_company(stub shim.ChaincodeStubInterface, id string) (Company, error) {
+	var company Company
+	key, err := stub.CreateCompositeKey(COMPANY_INDEX, []string{id})
+	if err != nil {
+		return company, err
+	}
+	companyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return company, errors.New("Failed to get company - " + id)
+	}
+	json.Unmarshal(companyAsBytes, &company)                 //un stringify it aka JSON.parse()
+
+	if company.Company_Id != id {                            //test if company is actually here or just nil
+		return company, errors.New("Company does not exist - " + id)
+	}
+	return company, nil
+}
+
+// the company of the calling identity, its MSP must be registered with init_company
+func get_caller_company(stub shim.ChaincodeStubInterface) (Company, error) {
+	mspId, err := cid.GetMSPID(stub)
+	if err != nil {
+		return Company{}, errors.New("Failed to read caller MSP - " + err.Error())
+	}
+	return get_company(stub, mspId)
+}
+
+func caller_is_cross_tenant(stub shim.ChaincodeStubInterface) bool {
+	if caller_is_admin(stub) {
+		return true
+	}
+	employee, err := get_caller_employee(stub)
+	if err != nil {
+		return false
+	}
+	return !employee.Deactivated && employee_role(employee) == ROLE_SUPPORT
+}
+
+func get_tenant_scope(stub shim.ChaincodeStubInterface) (TenantScope, error) {
+	var scope TenantScope
+	scope.CrossTenant = caller_is_cross_tenant(stub)
+	mspId, err := cid.GetMSPID(stub)
+	if err != nil && !scope.CrossTenant {
+		return scope, errors.New("Failed to read caller MSP - " + err.Error())
+	}
+	scope.Company = mspId
+	return scope, nil
+}
+
+func can_see(scope TenantScope, company string) bool {
+	return scope.CrossTenant || (len(company) > 0 && company == scope.Company)
+}
+
+// error out unless the caller may touch data of the company
+func check_tenant(stub shim.ChaincodeStubInterface, company string) error {
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return err
+	}
+	if !can_see(scope, company) {
+		return errors.New("Not allowed to access data of another company")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Endorsement helpers - key level endorsement policies on tickets and assets
+//
+// Shows Off SetStateValidationParameter() - a customer's ticket or asset can only be changed with endorsements from
+// peers of both the customer's org and the service provider's org.
+// ============================================================================================================================
+
+// the orgs that should endorse changes to a document of the company, nil leaves the chaincode policy in charge
+func default_endorsement_orgs(stub shim.ChaincodeStubInterface, company string) []string {
+	provider := get_config_string(stub, "provider_msp", "", "")
+	if len(provider) == 0 || len(company) == 0 {
+		return nil
+	}
+	if company == provider {
+		return []string{provider}
+	}
+	return []string{company, provider}
+}
+
+// put a key level policy requiring a peer of every org on the key, no orgs removes the key level policy
+func set_endorsement_orgs(stub shim.ChaincodeStubInterface, key string, orgs []string) error {
+	if len(orgs) == 0 {
+		return stub.SetStateValidationParameter(key, nil)
+	}
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, orgs...)
+	if err != nil {
+		return err
+	}
+	policy, err := endorsementPolicy.Policy()
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(key, policy)
+}
+
+// the orgs of the key level policy on a key, nil when there is none
+func get_endorsement_orgs(stub shim.ChaincodeStubInterface, key string) ([]string, error) {
+	policy, err := stub.GetStateValidationParameter(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(policy) == 0 {
+		return nil, nil
+	}
+	endorsementPolicy, err := statebased.NewStateEP(policy)
+	if err != nil {
+		return nil, err
+	}
+	return endorsementPolicy.ListOrgs(), nil
+}
+
+// ============================================================================================================================
+// Personal data helpers
+//
+// Shows Off GetTransient() and PutPrivateData() - personal fields come in through the transient map so they never land
+// in the transaction, are stored in a private data collection and only salted hashes go on the public document.
+// ============================================================================================================================
+
+// read the "pii" entry of the transient map, a JSON object with the personal fields of the record type and a "salt"
+// of at least 16 characters. found is false when there is no "pii" entry.
+func get_transient_pii(stub shim.ChaincodeStubInterface, recordType string) (map[string]string, string, bool, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, "", false, err
+	}
+	piiAsBytes, ok := transient["pii"]
+	if !ok {
+		return nil, "", false, nil
+	}
+
+	var fields map[string]string
+	err = json.Unmarshal(piiAsBytes, &fields)
+	if err != nil {
+		return nil, "", false, errors.New("Transient pii must be a JSON object of strings")
+	}
+	salt := fields["salt"]
+	delete(fields, "salt")
+	if len(salt) < 16 {
+		return nil, "", false, errors.New("Transient pii needs a random salt of at least 16 characters")
+	}
+	for field := range fields {
+		if !contains(piiFields[recordType], field) {
+			return nil, "", false, errors.New("Unknown personal field for " + recordType + " - " + field)
+		}
+	}
+	return fields, salt, true, nil
+}
+
+func hash_pii(salt string, value string) string {
+	hash := sha256.Sum256([]byte(salt + value))
+	return hex.EncodeToString(hash[:])
+}
+
+func pii_key(stub shim.ChaincodeStubInterface, subject string, recordType string, recordId string) (string, error) {
+	return stub.CreateCompositeKey(PII_INDEX, []string{subject, recordType, recordId})
+}
+
+// store the personal fields of a document in private data and return the reference to keep on the public document
+func put_personal_data(stub shim.ChaincodeStubInterface, subject string, recordType string, recordId string, salt string, fields map[string]string) (PiiReference, error) {
+	var reference PiiReference
+	reference.Subject = subject
+	reference.Hashes = make(map[string]string)
+	for field, value := range fields {
+		reference.Hashes[field] = hash_pii(salt, value)
+	}
+
+	var personalData PersonalData
+	personalData.ObjectType = "personal_data"
+	personalData.Subject = subject
+	personalData.RecordType = recordType
+	personalData.RecordId = recordId
+	personalData.Salt = salt
+	personalData.Fields = fields
+
+	key, err := pii_key(stub, subject, recordType, recordId)
+	if err != nil {
+		return reference, err
+	}
+	personalDataAsBytes, _ := json.Marshal(personalData)
+	return reference, stub.PutPrivateData(COLLECTION_PII, key, personalDataAsBytes)
+}
+
+// get the personal fields of a document, found is false once they were erased or if there never were any
+func get_personal_data(stub shim.ChaincodeStubInterface, subject string, recordType string, recordId string) (PersonalData, bool, error) {
+	var personalData PersonalData
+	key, err := pii_key(stub, subject, recordType, recordId)
+	if err != nil {
+		return personalData, false, err
+	}
+	personalDataAsBytes, err := stub.GetPrivateData(COLLECTION_PII, key)
+	if err != nil {
+		return personalData, false, err
+	}
+	if personalDataAsBytes == nil {
+		return personalData, false, nil
+	}
+	err = json.Unmarshal(personalDataAsBytes, &personalData)
+	return personalData, err == nil, err
+}
+
+func legacy_pii_key(stub shim.ChaincodeStubInterface, legacy LegacyPersonalData) (string, error) {
+	return stub.CreateCompositeKey(LEGACY_PII_INDEX, []string{legacy.Subject, legacy.RecordType, legacy.RecordId})
+}
+
+func put_legacy_personal_data(stub shim.ChaincodeStubInterface, legacy LegacyPersonalData) error {
+	key, err := legacy_pii_key(stub, legacy)
+	if err != nil {
+		return err
+	}
+	legacyAsBytes, _ := json.Marshal(legacy)
+	return stub.PutState(key, legacyAsBytes)
+}
+
+// the legacy personal data records waiting for migrate_personal_data, of one subject or of everyone for an empty subject
+func get_legacy_personal_data(stub shim.ChaincodeStubInterface, subject string) ([]LegacyPersonalData, error) {
+	var records []LegacyPersonalData
+	var attributes []string
+	if len(subject) > 0 {
+		attributes = []string{subject}
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(LEGACY_PII_INDEX, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var legacy LegacyPersonalData
+		json.Unmarshal(pointer.GetValue(), &legacy)               //un stringify it aka JSON.parse()
+		records = append(records, legacy)
+	}
+	return records, nil
+}
+
+// the sign-off waiting for the owner's answer, nil when there is none
+func pending_signoff(ticket Ticket) *Signoff {
+	if len(ticket.Signoffs) == 0 {
+		return nil
+	}
+	last := &ticket.Signoffs[len(ticket.Signoffs)-1]
+	if last.Outcome != SIGNOFF_PENDING {
+		return nil
+	}
+	return last
+}
+
+func get_csat(stub shim.ChaincodeStubInterface, ticketId string) (Csat, bool, error) {
+	var csat Csat
+	key, err := stub.CreateCompositeKey(CSAT_INDEX, []string{ticketId})
+	if err != nil {
+		return csat, false, err
+	}
+	csatAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return csat, false, errors.New("Failed to get rating of ticket - " + ticketId)
+	}
+	if csatAsBytes == nil {
+		return csat, false, nil
+	}
+	json.Unmarshal(csatAsBytes, &csat)                        //un stringify it aka JSON.parse()
+	return csat, true, nil
+}
+
+// ============================================================================================================================
+// Spare part helpers
+// ============================================================================================================================
+
+func part_key(stub shim.ChaincodeStubInterface, company string, site string, partNumber string) (string, error) {
+	return stub.CreateCompositeKey(PART_INDEX, []string{company, site, partNumber})
+}
+
+func get_part(stub shim.ChaincodeStubInterface, company string, site string, partNumber string) (Part, bool, error) {
+	var part Part
+	key, err := part_key(stub, company, site, partNumber)
+	if err != nil {
+		return part, false, err
+	}
+	partAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return part, false, errors.New("Failed to get part - " + partNumber)
+	}
+	if partAsBytes == nil {
+		return part, false, nil
+	}
+	json.Unmarshal(partAsBytes, &part)                        //un stringify it aka JSON.parse()
+	return part, true, nil
+}
+
+func put_part(stub shim.ChaincodeStubInterface, part Part) error {
+	key, err := part_key(stub, part.Company, part.Site, part.Part_Number)
+	if err != nil {
+		return err
+	}
+	partAsBytes, _ := json.Marshal(part)                      //convert to array of bytes
+	return stub.PutState(key, partAsBytes)
+}
+
+func get_ticket_parts(stub shim.ChaincodeStubInterface, ticketId string) ([]PartUsage, error) {
+	usages := []PartUsage{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(PART_USAGE_INDEX, []string{ticketId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var usage PartUsage
+		json.Unmarshal(pointer.GetValue(), &usage)           //un stringify it aka JSON.parse()
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+func get_ticket_time_entries(stub shim.ChaincodeStubInterface, ticketId string) ([]TimeEntry, error) {
+	entries := []TimeEntry{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(TIME_ENTRY_INDEX, []string{ticketId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry TimeEntry
+		json.Unmarshal(pointer.GetValue(), &entry)           //un stringify it aka JSON.parse()
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// add up the labour and parts logged on a ticket
+func compute_ticket_cost(stub shim.ChaincodeStubInterface, ticketId string) (TicketCost, error) {
+	var cost TicketCost
+	entries, err := get_ticket_time_entries(stub, ticketId)
+	if err != nil {
+		return cost, err
+	}
+	for _, entry := range entries {
+		cost.Minutes += entry.Minutes
+		cost.Labour += entry.Cost
+	}
+
+	usages, err := get_ticket_parts(stub, ticketId)
+	if err != nil {
+		return cost, err
+	}
+	for _, usage := range usages {
+		cost.Parts += usage.Cost
+	}
+
+	cost.Total = cost.Labour + cost.Parts
+	cost.ComputedOn, err = get_tx_time(stub)
+	return cost, err
+}
+
+func get_rma(stub shim.ChaincodeStubInterface, ticketId string, rmaId string) (Rma, bool, error) {
+	var rma Rma
+	key, err := stub.CreateCompositeKey(RMA_INDEX, []string{ticketId, rmaId})
+	if err != nil {
+		return rma, false, err
+	}
+	rmaAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return rma, false, errors.New("Failed to get RMA - " + rmaId)
+	}
+	if rmaAsBytes == nil {
+		return rma, false, nil
+	}
+	json.Unmarshal(rmaAsBytes, &rma)                          //un stringify it aka JSON.parse()
+	return rma, true, nil
+}
+
+func put_rma(stub shim.ChaincodeStubInterface, rma Rma) error {
+	key, err := stub.CreateCompositeKey(RMA_INDEX, []string{rma.Ticket_Id, rma.Rma_Id})
+	if err != nil {
+		return err
+	}
+	rmaAsBytes, _ := json.Marshal(rma)                        //convert to array of bytes
+	return stub.PutState(key, rmaAsBytes)
+}
+
+func get_ticket_rmas(stub shim.ChaincodeStubInterface, ticketId string) ([]Rma, error) {
+	rmas := []Rma{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(RMA_INDEX, []string{ticketId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var rma Rma
+		json.Unmarshal(pointer.GetValue(), &rma)             //un stringify it aka JSON.parse()
+		rmas = append(rmas, rma)
+	}
+	return rmas, nil
+}
+
+func get_visit(stub shim.ChaincodeStubInterface, technician string, visitId string) (Visit, bool, error) {
+	var visit Visit
+	key, err := stub.CreateCompositeKey(VISIT_INDEX, []string{technician, visitId})
+	if err != nil {
+		return visit, false, err
+	}
+	visitAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return visit, false, errors.New("Failed to get visit - " + visitId)
+	}
+	if visitAsBytes == nil {
+		return visit, false, nil
+	}
+	json.Unmarshal(visitAsBytes, &visit)                      //un stringify it aka JSON.parse()
+	return visit, true, nil
+}
+
+func put_visit(stub shim.ChaincodeStubInterface, visit Visit) error {
+	key, err := stub.CreateCompositeKey(VISIT_INDEX, []string{visit.Technician, visit.Visit_Id})
+	if err != nil {
+		return err
+	}
+	visitAsBytes, _ := json.Marshal(visit)                    //convert to array of bytes
+	return stub.PutState(key, visitAsBytes)
+}
+
+func get_technician_visits(stub shim.ChaincodeStubInterface, technician string) ([]Visit, error) {
+	visits := []Visit{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(VISIT_INDEX, []string{technician})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var visit Visit
+		json.Unmarshal(pointer.GetValue(), &visit)           //un stringify it aka JSON.parse()
+		visits = append(visits, visit)
+	}
+	return visits, nil
+}
+
+// true when the two time windows share any time, windows touching end to start do not overlap
+func windows_overlap(start time.Time, end time.Time, otherStart time.Time, otherEnd time.Time) bool {
+	return start.Before(otherEnd) && otherStart.Before(end)
+}
+
+func get_maintenance_plan(stub shim.ChaincodeStubInterface, id string) (MaintenancePlan, bool, error) {
+	var plan MaintenancePlan
+	key, err := stub.CreateCompositeKey(MAINTENANCE_PLAN_INDEX, []string{id})
+	if err != nil {
+		return plan, false, err
+	}
+	planAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return plan, false, errors.New("Failed to get maintenance plan - " + id)
+	}
+	if planAsBytes == nil {
+		return plan, false, nil
+	}
+	json.Unmarshal(planAsBytes, &plan)                        //un stringify it aka JSON.parse()
+	return plan, true, nil
+}
+
+// the plan's period a day falls in, counted from 0, ok is false before the plan starts
+func maintenance_period(plan MaintenancePlan, day time.Time) (int, bool) {
+	start, err := time.Parse("2006-01-02", plan.StartDate)
+	if err != nil || day.Before(start) || plan.IntervalDays <= 0 {
+		return 0, false
+	}
+	days := int(day.Sub(start).Hours() / 24)
+	return days / plan.IntervalDays, true
+}
+
+func plan_covers(plan MaintenancePlan, ibmasset IBM_Asset) bool {
+	if ibmasset.Company != plan.Company || asset_status(ibmasset) == ASSET_RETIRED {
+		return false
+	}
+	if len(plan.Asset) > 0 {
+		return ibmasset.SerialNumber == plan.Asset
+	}
+	return strings.EqualFold(ibmasset.AssetType, plan.AssetType)
+}
+
+func get_checklist_template(stub shim.ChaincodeStubInterface, assetType string) (ChecklistTemplate, bool, error) {
+	var template ChecklistTemplate
+	key, err := stub.CreateCompositeKey(CHECKLIST_INDEX, []string{strings.ToLower(assetType)})
+	if err != nil {
+		return template, false, err
+	}
+	templateAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return template, false, errors.New("Failed to get checklist of asset type - " + assetType)
+	}
+	if templateAsBytes == nil {
+		return template, false, nil
+	}
+	json.Unmarshal(templateAsBytes, &template)                //un stringify it aka JSON.parse()
+	return template, true, nil
+}
+
+func has_checklist_item(ticket Ticket, name string) bool {
+	for _, item := range ticket.Checklist {
+		if item.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// the mandatory checklist items of a ticket that have no result yet
+func open_mandatory_items(ticket Ticket) []string {
+	var open []string
+	for _, item := range ticket.Checklist {
+		if item.Mandatory && len(item.Result) == 0 {
+			open = append(open, item.Name)
+		}
+	}
+	return open
+}
+
+func get_custom_field_schema(stub shim.ChaincodeStubInterface, queue string) (CustomFieldSchema, bool, error) {
+	var schema CustomFieldSchema
+	key, err := stub.CreateCompositeKey(CUSTOM_FIELDS_INDEX, []string{queue})
+	if err != nil {
+		return schema, false, err
+	}
+	schemaAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return schema, false, errors.New("Failed to get custom fields of queue - " + queue)
+	}
+	if schemaAsBytes == nil {
+		return schema, false, nil
+	}
+	json.Unmarshal(schemaAsBytes, &schema)                    //un stringify it aka JSON.parse()
+	return schema, true, nil
+}
+
+// the queue a ticket was opened in, its custom fields follow that queue's schema
+func ticket_origin_queue(ticket Ticket) string {
+	if ticket.Entitlement != nil && len(ticket.Entitlement.RoutedFrom) > 0 {
+		return ticket.Entitlement.RoutedFrom
+	}
+	return ticket.Queue
+}
+
+func validate_custom_field_value(field CustomFieldDefinition, value interface{}) error {
+	switch field.Type {
+	case FIELD_STRING:
+		str, ok := value.(string)
+		if !ok {
+			return errors.New("Custom field " + field.Name + " must be a string")
+		}
+		if len(field.Enum) > 0 && !contains(field.Enum, str) {
+			return errors.New("Custom field " + field.Name + " must be one of " + strings.Join(field.Enum, ", "))
+		}
+	case FIELD_NUMBER:
+		if _, ok := value.(float64); !ok {
+			return errors.New("Custom field " + field.Name + " must be a number")
+		}
+	case FIELD_BOOL:
+		if _, ok := value.(bool); !ok {
+			return errors.New("Custom field " + field.Name + " must be true or false")
+		}
+	case FIELD_DATE:
+		str, ok := value.(string)
+		if !ok {
+			return errors.New("Custom field " + field.Name + " must be a YYYY-MM-DD date")
+		}
+		if _, err := time.Parse("2006-01-02", str); err != nil {
+			return errors.New("Custom field " + field.Name + " must be a YYYY-MM-DD date")
+		}
+	default:
+		return errors.New("Custom field " + field.Name + " has unknown type " + field.Type)
+	}
+	return nil
+}
+
+// check custom fields against the queue's schema, queues without one take no custom fields
+func validate_custom_fields(stub shim.ChaincodeStubInterface, queue string, fields map[string]interface{}) error {
+	schema, _, err := get_custom_field_schema(stub, queue)
+	if err != nil {
+		return err
+	}
+	known := map[string]CustomFieldDefinition{}
+	for _, field := range schema.Fields {
+		known[field.Name] = field
+		if _, ok := fields[field.Name]; field.Required && !ok {
+			return errors.New("Custom field " + field.Name + " is required in queue " + queue)
+		}
+	}
+	for name, value := range fields {
+		field, ok := known[name]
+		if !ok {
+			return errors.New("Queue " + queue + " has no custom field " + name)
+		}
+		err = validate_custom_field_value(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compare a custom field value with the value of a query, numbers and dates compare by value, the rest as text
+func compare_custom_field(value interface{}, operator string, target string) bool {
+	var order int
+	switch v := value.(type) {
+	case float64:
+		number, err := strconv.ParseFloat(target, 64)
+		if err != nil {
+			return false
+		}
+		if v < number {
+			order = -1
+		} else if v > number {
+			order = 1
+		}
+	case bool:
+		if operator != "=" && operator != "!=" {
+			return false
+		}
+		if strconv.FormatBool(v) != strings.ToLower(target) {
+			order = 1
+		}
+	case string:
+		if operator == "contains" {
+			return strings.Contains(strings.ToLower(v), strings.ToLower(target))
+		}
+		order = strings.Compare(v, target)                      //YYYY-MM-DD dates order as text
+	default:
+		return false
+	}
+
+	switch operator {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Tag helpers
+// ============================================================================================================================
+
+// tags are lower case, words joined by '-', letters, digits and - _ . : only
+func normalize_tag(tag string) (string, error) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+	if len(tag) == 0 || len(tag) > 32 {
+		return "", errors.New("Tags must be 1 to 32 characters")
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == ':') {
+			return "", errors.New("Tags may only contain letters, digits and - _ . : - " + tag)
+		}
+	}
+	return tag, nil
+}
+
+func tag_key(stub shim.ChaincodeStubInterface, tag string, objectType string, id string) (string, error) {
+	return stub.CreateCompositeKey(TAG_INDEX, []string{tag, objectType, id})
+}
+
+// write the index entries of an object's tags, the value is a placeholder like in the marbles index
+func put_tag_index(stub shim.ChaincodeStubInterface, objectType string, id string, tags []string) error {
+	for _, tag := range tags {
+		key, err := tag_key(stub, tag, objectType, id)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(key, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func del_tag_index(stub shim.ChaincodeStubInterface, objectType string, id string, tags []string) error {
+	for _, tag := range tags {
+		key, err := tag_key(stub, tag, objectType, id)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ids of the objects of a type carrying a tag
+func get_tagged_ids(stub shim.ChaincodeStubInterface, tag string, objectType string) ([]string, error) {
+	var ids []string
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(TAG_INDEX, []string{tag, objectType})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(pointer.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, attributes[2])
+	}
+	return ids, nil
+}
+
+// ============================================================================================================================
+// Ticket lookup helpers - tickets by owner and by asset
+// ============================================================================================================================
+
+// write a ticket's owner and asset index entries, the value is a placeholder like in the marbles index
+func put_ticket_lookup(stub shim.ChaincodeStubInterface, ticket Ticket) error {
+	ownerKey, err := stub.CreateCompositeKey(TICKET_OWNER_INDEX, []string{ticket.TicketOwner, ticket.Ticket_Id})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(ownerKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+	if len(ticket.Asset) == 0 {
+		return nil
+	}
+	assetKey, err := stub.CreateCompositeKey(TICKET_ASSET_INDEX, []string{ticket.Asset, ticket.Ticket_Id})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(assetKey, []byte{0x00})
+}
+
+func del_ticket_lookup(stub shim.ChaincodeStubInterface, ticket Ticket) error {
+	ownerKey, err := stub.CreateCompositeKey(TICKET_OWNER_INDEX, []string{ticket.TicketOwner, ticket.Ticket_Id})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(ownerKey)
+	if err != nil {
+		return err
+	}
+	if len(ticket.Asset) == 0 {
+		return nil
+	}
+	assetKey, err := stub.CreateCompositeKey(TICKET_ASSET_INDEX, []string{ticket.Asset, ticket.Ticket_Id})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(assetKey)
+}
+
+// ids of the tickets of an owner or on an asset, index is TICKET_OWNER_INDEX or TICKET_ASSET_INDEX
+func get_ticket_ids_by(stub shim.ChaincodeStubInterface, index string, value string) ([]string, error) {
+	var ids []string
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, []string{value})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(pointer.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, attributes[1])
+	}
+	return ids, nil
+}
+
+// ============================================================================================================================
+// Search index helpers - an inverted index from terms to the positions they have in a ticket's fields
+// ============================================================================================================================
+
+// lower case words of letters and digits, in order
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// single characters and very long tokens are not indexed, they still count for positions
+func is_indexed_term(term string) bool {
+	return len(term) >= 2 && len(term) <= 64
+}
+
+func search_bucket(term string) string {
+	if len(term) < 2 {
+		return term
+	}
+	return term[:2]
+}
+
+// term -> field -> positions of the term in the field
+func ticket_postings(ticket Ticket) map[string]map[string][]int {
+	texts := map[string]string{
+		"description":        ticket.Description,
+		"descriptionproduct": ticket.DescriptionProduct,
+		"diagnostic":         ticket.Diagnostic,
+	}
+	postings := map[string]map[string][]int{}
+	for _, field := range searchFields {
+		for position, term := range tokenize(texts[field]) {
+			if !is_indexed_term(term) {
+				continue
+			}
+			if postings[term] == nil {
+				postings[term] = map[string][]int{}
+			}
+			postings[term][field] = append(postings[term][field], position)
+		}
+	}
+	return postings
+}
+
+func search_key(stub shim.ChaincodeStubInterface, term string, ticketId string) (string, error) {
+	return stub.CreateCompositeKey(SEARCH_INDEX, []string{search_bucket(term), term, ticketId})
+}
+
+// bring the index of a ticket from its old text to its new text, old is empty for a new ticket and current for a
+// deleted one. Every old entry is deleted and every current one put, the last write to a key in a transaction wins so
+// terms in both texts end up with their new positions.
+func index_ticket(stub shim.ChaincodeStubInterface, old Ticket, current Ticket) error {
+	for term := range ticket_postings(old) {
+		key, err := search_key(stub, term, old.Ticket_Id)
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	if len(current.Ticket_Id) == 0 {
+		return nil                                              //deleted
+	}
+	for term, fields := range ticket_postings(current) {
+		key, err := search_key(stub, term, current.Ticket_Id)
+		if err != nil {
+			return err
+		}
+		fieldsAsBytes, _ := json.Marshal(fields)                //map keys marshal sorted, same bytes on every peer
+		err = stub.PutState(key, fieldsAsBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ticket -> field -> positions of every indexed term starting with prefix, or equal to it when exact
+func get_term_postings(stub shim.ChaincodeStubInterface, prefix string, exact bool) (map[string]map[string][][]int, error) {
+	keys := []string{search_bucket(prefix)}
+	if exact {
+		keys = append(keys, prefix)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(SEARCH_INDEX, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	postings := map[string]map[string][][]int{}
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(pointer.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		term, ticketId := attributes[1], attributes[2]
+		if !strings.HasPrefix(term, prefix) {
+			continue
+		}
+		var fields map[string][]int
+		json.Unmarshal(pointer.GetValue(), &fields)          //un stringify it aka JSON.parse()
+		if postings[ticketId] == nil {
+			postings[ticketId] = map[string][][]int{}
+		}
+		for field, positions := range fields {
+			postings[ticketId][field] = append(postings[ticketId][field], positions)
+		}
+	}
+	return postings, nil
+}
+
+// ============================================================================================================================
+// Duplicate helpers
+// ============================================================================================================================
+
+// indexed words of a ticket's description, descriptionproduct and diagnostic
+func ticket_words(ticket Ticket) map[string]bool {
+	words := map[string]bool{}
+	for term := range ticket_postings(ticket) {
+		words[term] = true
+	}
+	return words
+}
+
+// share of the words of two tickets they have in common, 0 to 1
+func similarity(words map[string]bool, other map[string]bool) float64 {
+	if len(words) == 0 || len(other) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range words {
+		if other[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(words) + len(other) - shared)
+}
+
+// when a ticket was opened, tickets from before openedon was recorded fall back to their date
+func ticket_opened_on(ticket Ticket) (time.Time, error) {
+	openedOn, err := time.Parse(time.RFC3339, ticket.OpenedOn)
+	if err == nil {
+		return openedOn, nil
+	}
+	return parse_date(ticket.Date)
+}
+
+func get_invoice(stub shim.ChaincodeStubInterface, id string) (Invoice, bool, error) {
+	var invoice Invoice
+	key, err := stub.CreateCompositeKey(INVOICE_INDEX, []string{id})
+	if err != nil {
+		return invoice, false, err
+	}
+	invoiceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return invoice, false, errors.New("Failed to get invoice - " + id)
+	}
+	if invoiceAsBytes == nil {
+		return invoice, false, nil
+	}
+	json.Unmarshal(invoiceAsBytes, &invoice)                  //un stringify it aka JSON.parse()
+	return invoice, true, nil
+}
+
+// admins and anyone who can work tickets, they manage stock and visits
+func caller_works_tickets(stub shim.ChaincodeStubInterface) bool {
+	if caller_is_admin(stub) {
+		return true
+	}
+	employee, err := get_caller_employee(stub)
+	return err == nil && can_take_assignment(employee) == nil
+}
+
+// ============================================================================================================================
+// Attachment helpers - files live off chain, the ledger anchors them by content hash
+// ============================================================================================================================
+
+// hashes are compared as lower case hex
+func normalize_sha256(hash string) (string, error) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", errors.New("Expecting a hex encoded SHA-256 hash - " + hash)
+	}
+	return hash, nil
+}
+
+func get_attachment(stub shim.ChaincodeStubInterface, ticketId string, attachmentId string) (Attachment, bool, error) {
+	var attachment Attachment
+	key, err := stub.CreateCompositeKey(ATTACHMENT_INDEX, []string{ticketId, attachmentId})
+	if err != nil {
+		return attachment, false, err
+	}
+	attachmentAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return attachment, false, errors.New("Failed to get attachment - " + attachmentId)
+	}
+	if attachmentAsBytes == nil {
+		return attachment, false, nil
+	}
+	json.Unmarshal(attachmentAsBytes, &attachment)            //un stringify it aka JSON.parse()
+	return attachment, true, nil
+}
+
+func get_ticket_attachments(stub shim.ChaincodeStubInterface, ticketId string) ([]Attachment, error) {
+	attachments := []Attachment{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ATTACHMENT_INDEX, []string{ticketId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var attachment Attachment
+		json.Unmarshal(pointer.GetValue(), &attachment)      //un stringify it aka JSON.parse()
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// who the caller is in records they leave behind, their employee number when linked to one
+func caller_identity(stub shim.ChaincodeStubInterface) string {
+	employee, err := get_caller_employee(stub)
+	if err == nil {
+		return employee.Employee_sn
+	}
+	id, _ := cid.GetID(stub)
+	return id
+}
+
+// ============================================================================================================================
+// Retention helpers - the personal details of a closed ticket are kept retention_years of its queue after closure
+// ============================================================================================================================
+
+// when the ticket's personal details are due for purge, ok is false when the ticket is not closed or its queue keeps them
+func get_retention_due(stub shim.ChaincodeStubInterface, ticket Ticket) (time.Time, float64, bool) {
+	var due time.Time
+	years := get_config_number(stub, "retention_years", ticket.Queue, 0)
+	if years <= 0 || normalize_status(ticket.Status) != STATUS_CLOSED {
+		return due, years, false
+	}
+
+	closedOn, err := time.Parse(time.RFC3339, ticket.ClosedOn)   //only the recorded closure counts, never history
+	if err != nil {
+		return due, years, false
+	}
+
+	wholeYears := int(years)
+	extraDays := int((years - float64(wholeYears)) * 365)
+	return closedOn.AddDate(wholeYears, 0, extraDays), years, true
+}
+
+// ============================================================================================================================
+// Emit Event - set the chaincode event for this transaction with a JSON payload
+// ============================================================================================================================
+func emit_event(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	payloadAsBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, payloadAsBytes)
+}
+
+// ============================================================================================================================
+// Get Tx Time - deterministic time of the current transaction, as time or as RFC3339 string
+// ============================================================================================================================
+func get_tx_datetime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(txTimestamp.GetSeconds(), int64(txTimestamp.GetNanos())).UTC(), nil
+}
+
+func get_tx_time(stub shim.ChaincodeStubInterface) (string, error) {
+	txTime, err := get_tx_datetime(stub)
+	if err != nil {
+		return "", err
+	}
+	return txTime.Format(time.RFC3339), nil
+}
+
+// ============================================================================================================================
+// Parse Date - accept a full RFC3339 timestamp or a plain YYYY-MM-DD date
+// ============================================================================================================================
+func parse_date(str string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, str)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", str)
+	if err != nil {
+		return t, errors.New("Expecting an RFC3339 or YYYY-MM-DD date - " + str)
+	}
+	return t, nil
+}
+
+// the first instant after a period ending on str, a plain YYYY-MM-DD end includes that whole day
+func parse_period_end(str string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, str)
+	if err == nil {
+		return t.Add(time.Nanosecond), nil
+	}
+	t, err = parse_date(str)
+	if err != nil {
+		return t, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// ============================================================================================================================
+// Split List - split a comma separated argument, dropping empty entries
+// ============================================================================================================================
+func split_list(str string) []string {
+	var list []string
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ========================================================
+// Input Sanitation - dumb input checking, look for empty strings
+// ========================================================
+func sanitize_arguments(strs []string) error {
+	for i, val := range strs {
+		if len(val) <= 0 {
+			return errors.New("Argument " + strconv.Itoa(i) + " must be a non-empty string")
+		}
+	}
+	return nil
+}
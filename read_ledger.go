@@ -7,53 +7,198 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // ============================================================================================================================
-// Read - read a generic variable from ledger
+// Read Config - read a configuration entry
 //
-// Shows Off GetState() - reading a key/value from the ledger
+// Shows Off GetState() on a composite key - only the config~name~scope namespace can be read here
 //
 // Inputs - Array of strings
-//  0
-//  key
-//  "abc"
-// 
-// Returns - string
+//        0       ,     1
+//       name     ,   scope
+// "billing_queue",
+//
+// Returns - config entry json, its value is null when the entry is not set
 // ============================================================================================================================
-func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var key, jsonResp string
-	var err error
-	fmt.Println("starting read")
+func read_config(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var name, scope string
+	fmt.Println("starting read_config")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting name and optional scope of the entry")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	name = args[0]
+	if len(args) == 2 {
+		scope = args[1]
+	}
+	if _, ok := configSchemas[name]; !ok {
+		return shim.Error("Unknown config entry - " + name)
+	}
+
+	entry, found, err := get_config(stub, name, scope)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		entry = ConfigEntry{ObjectType: "config", Name: name, Scope: scope, Value: json.RawMessage("null")}
+	}
+
+	entryAsBytes, _ := json.Marshal(entry)           //convert to array of bytes
+	fmt.Println("- end read_config")
+	return shim.Success(entryAsBytes)                //send it onward
+}
+
+// ============================================================================================================================
+// List Config - every configuration entry that is set, plus the schema of every entry that can be set
+//
+// Shows Off GetStateByPartialCompositeKey() - walking the config~name~scope namespace
+//
+// Inputs - none
+// ============================================================================================================================
+func list_config(stub shim.ChaincodeStubInterface) pb.Response {
+	type ConfigListing struct {
+		Entries []ConfigEntry           `json:"entries"`
+		Schemas map[string]ConfigSchema `json:"schemas"`
+	}
+	var listing ConfigListing
+	listing.Entries = []ConfigEntry{}
+	listing.Schemas = configSchemas
+	fmt.Println("starting list_config")
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(CONFIG_INDEX, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var entry ConfigEntry
+		json.Unmarshal(pointer.GetValue(), &entry)                //un stringify it aka JSON.parse()
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	listingAsBytes, _ := json.Marshal(listing)                    //convert to array of bytes
+	fmt.Println("- end list_config")
+	return shim.Success(listingAsBytes)
+}
+
+// ============================================================================================================================
+// Read Company - read a registered company
+//
+// Inputs - Array of strings
+//      0
+//   company
+//  "Org1MSP"
+// ============================================================================================================================
+func read_company(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting read_company")
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting key of the var to query")
+		return shim.Error("Incorrect number of arguments. Expecting company id")
 	}
 
 	// input sanitation
-	err = sanitize_arguments(args)
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	company, err := get_company(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, company.Company_Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	companyAsBytes, _ := json.Marshal(company)                //convert to array of bytes
+	fmt.Println("- end read_company")
+	return shim.Success(companyAsBytes)
+}
+
+// ============================================================================================================================
+// Read Ticket - read a ticket with everything recorded on it, including its warranty entitlement
+//
+// Inputs - Array of strings
+//      0
+//  ticket id
+// "m999999999"
+//
+// Returns - ticket json
+// ============================================================================================================================
+func read_ticket(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting read_ticket")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting ticket id")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	key = args[0]
-	valAsbytes, err := stub.GetState(key)           //get the var from ledger
+	details := TicketDetails{Ticket: ticket}
+	details.Attachments, err = get_ticket_attachments(stub, ticket.Ticket_Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	details.Parts, err = get_ticket_parts(stub, ticket.Ticket_Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	details.TimeEntries, err = get_ticket_time_entries(stub, ticket.Ticket_Id)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return shim.Error(err.Error())
+	}
+	details.Rmas, err = get_ticket_rmas(stub, ticket.Ticket_Id)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	fmt.Println("- end read")
-	return shim.Success(valAsbytes)                  //send it onward
+	ticketAsBytes, _ := json.Marshal(details)                 //convert to array of bytes
+	fmt.Println("- end read_ticket")
+	return shim.Success(ticketAsBytes)
 }
 
 // ============================================================================================================================
 // Get everything we need (tickets + employee + asset)
 //
+// Only the caller's company's documents are returned, unless the caller works across companies.
+//
 // Inputs - none
 //
 // Returns: json array with tickets, employees and assets
@@ -66,6 +211,11 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 	}
 	var everything Everything
 
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ---- Get All Tickets ---- //
 	resultsIterator, err := stub.GetStateByRange("0", "9999999999999999999")
 	if err != nil {
@@ -84,6 +234,9 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 		fmt.Println("on ticket id - ", queryKeyAsStr)
 		var ticket Ticket
 		json.Unmarshal(queryValAsBytes, &ticket)                  //un stringify it aka JSON.parse()
+		if ticket.ObjectType != "ticket" || !can_see(scope, ticket.Company) {
+			continue
+		}
 		everything.Tickets = append(everything.Tickets, ticket)   //add this Ticket to the list
 	}
 	fmt.Println("Tickets array - ", everything.Tickets)
@@ -106,6 +259,9 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 		fmt.Println("on employee id - ", queryKeyAsStr)
 		var employee Employee
 		json.Unmarshal(queryValAsBytes, &employee)                  //un stringify it aka JSON.parse()
+		if employee.ObjectType != "employee" || !can_see(scope, employee.Company) {
+			continue
+		}
 		everything.Employees = append(everything.Employees, employee)     //add this Employee to the list
 	}
 	fmt.Println("Employees array - ", everything.Employees)
@@ -127,6 +283,9 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 		fmt.Println("on asset id - ", queryKeyAsStr)
 		var ibmasset IBM_Asset
 		json.Unmarshal(queryValAsBytes, &ibmasset)                  //un stringify it aka JSON.parse()
+		if ibmasset.ObjectType != "ibm_asset" || !can_see(scope, ibmasset.Company) {
+			continue
+		}
 		everything.Assets = append(everything.Assets, ibmasset)     //add this asset to the list
 	}
 	fmt.Println("Assets array - ", everything.Assets)
@@ -161,6 +320,18 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	ticketId := args[0]
 	fmt.Printf("- start getHistoryForTicket: %s\n", ticketId)
 
+	// deleted tickets can only be audited across companies
+	current, err := get_ticket(stub, ticketId)
+	if err != nil && !caller_is_cross_tenant(stub) {
+		return shim.Error(err.Error())
+	}
+	if err == nil {
+		err = check_tenant(stub, current.Company)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	// Get History
 	resultsIterator, err := stub.GetHistoryForKey(ticketId)
 	if err != nil {
@@ -187,7 +358,7 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		}
 		history = append(history, tx)              //add this tx to the list
 	}
-	fmt.Printf("- getHistoryForTicket returning:\n%s", history)
+	fmt.Printf("- getHistoryForTicket returning:\n%v", history)
 
 	//change to array of bytes
 	historyAsBytes, _ := json.Marshal(history)     //convert to array of bytes
@@ -197,7 +368,7 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // ============================================================================================================================
 // Get history of tickets - performs a range query based on the start and end keys provided.
 //
-// Shows Off GetStateByRange() - reading a multiple key/values from the ledger
+// Shows Off GetStateByRange() - reading a multiple key/values from the ledger. Only ticket documents are returned.
 //
 // Inputs - Array of strings
 //       0     ,    1
@@ -212,6 +383,11 @@ func getTicketsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 	startKey := args[0]
 	endKey := args[1]
 
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -229,6 +405,14 @@ func getTicketsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		var ticket Ticket
+		json.Unmarshal(queryResultValue, &ticket)
+		if ticket.ObjectType != "ticket" {         //skip employees and assets sharing the key range
+			continue
+		}
+		if !can_see(scope, ticket.Company) {
+			continue
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -250,3 +434,1411 @@ func getTicketsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 
 	return shim.Success(buffer.Bytes())
 }
+
+
+// ============================================================================================================================
+// Get ticket timeline - when a ticket was opened and when it was last resolved, from its history
+//
+// Resolved is the zero time when the ticket was never resolved or has been reopened since.
+// ============================================================================================================================
+func get_ticket_timeline(stub shim.ChaincodeStubInterface, ticketId string) (time.Time, time.Time, error) {
+	var opened, resolved time.Time
+
+	resultsIterator, err := stub.GetHistoryForKey(ticketId)
+	if err != nil {
+		return opened, resolved, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return opened, resolved, err
+		}
+		if pointer.GetIsDelete() {
+			continue
+		}
+
+		txTime := time.Unix(pointer.GetTimestamp().GetSeconds(), int64(pointer.GetTimestamp().GetNanos())).UTC()
+		if opened.IsZero() {
+			opened = txTime                                    //first write is when the ticket was opened
+		}
+
+		var ticket Ticket
+		json.Unmarshal(pointer.GetValue(), &ticket)          //un stringify it aka JSON.parse()
+		if !is_resolved_status(ticket.Status) {
+			resolved = time.Time{}                             //reopened
+		} else if resolved.IsZero() {
+			resolved = txTime
+		}
+	}
+	return opened, resolved, nil
+}
+
+// ============================================================================================================================
+// Build workload - per assignee ticket counts, time to resolve and SLA breaches for tickets opened in [start, end)
+//
+// Tickets are measured against their queue's sla_hours policy, slaHours is used for queues without one. Only tickets
+// of the caller's company count unless the caller works across companies.
+// ============================================================================================================================
+type Workload struct {
+	Employee_sn       string  `json:"employee_sn"`
+	Fullname          string  `json:"fullname"`
+	Team              string  `json:"team"`
+	Open              int     `json:"open"`
+	InProgress        int     `json:"inprogress"`
+	Resolved          int     `json:"resolved"`
+	AvgHoursToResolve float64 `json:"avghourstoresolve"`
+	SlaBreaches       int     `json:"slabreaches"`
+}
+
+func build_workload(stub shim.ChaincodeStubInterface, start time.Time, end time.Time, slaHours float64) (map[string]*Workload, error) {
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := make(map[string]*Workload)
+	totalHours := make(map[string]float64)
+
+	now, err := get_tx_datetime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	tickets, err := get_all_tickets(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ticket := range tickets {
+		employee_sn := ticket.Assignee.Employee_sn
+		if len(employee_sn) == 0 {
+			continue                                           //nobody to charge it to
+		}
+		if !can_see(scope, ticket.Company) {
+			continue
+		}
+
+		opened, resolved, err := get_ticket_timeline(stub, ticket.Ticket_Id)
+		if err != nil {
+			return nil, err
+		}
+		if opened.Before(start) || !opened.Before(end) {
+			continue
+		}
+
+		// the queue's SLA policy wins over the hours asked for
+		ticketSlaHours := get_config_number(stub, "sla_hours", ticket.Queue, slaHours)
+		sla := time.Duration(ticketSlaHours * float64(time.Hour))
+
+		workload, ok := workloads[employee_sn]
+		if !ok {
+			workload = &Workload{Employee_sn: employee_sn, Fullname: ticket.Assignee.Fullname}
+			workloads[employee_sn] = workload
+		}
+
+		switch {
+		case is_resolved_status(ticket.Status) && !resolved.IsZero():
+			workload.Resolved++
+			totalHours[employee_sn] += resolved.Sub(opened).Hours()
+			if ticketSlaHours > 0 && resolved.Sub(opened) > sla {
+				workload.SlaBreaches++
+			}
+			continue
+		case normalize_status(ticket.Status) == STATUS_IN_PROGRESS:
+			workload.InProgress++
+		default:
+			workload.Open++
+		}
+		if ticketSlaHours > 0 && now.Sub(opened) > sla {
+			workload.SlaBreaches++                             //still unresolved past its deadline
+		}
+	}
+
+	for employee_sn, workload := range workloads {
+		if workload.Resolved > 0 {
+			workload.AvgHoursToResolve = totalHours[employee_sn] / float64(workload.Resolved)
+		}
+		employee, err := get_employee(stub, employee_sn)
+		if err == nil {
+			workload.Fullname = employee.Fullname
+			workload.Team = employee.Team
+		}
+	}
+	return workloads, nil
+}
+
+// parse the date range and SLA arguments shared by the workload queries
+func parse_workload_args(args []string) (time.Time, time.Time, float64, error) {
+	var start, end time.Time
+	start, err := parse_date(args[0])
+	if err != nil {
+		return start, end, 0, err
+	}
+	end, err = parse_date(args[1])
+	if err != nil {
+		return start, end, 0, err
+	}
+	slaHours, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return start, end, 0, errors.New("SLA hours must be a number - " + args[2])
+	}
+	return start, end, slaHours, nil
+}
+
+// ============================================================================================================================
+// Get workload - ticket counts, average time to resolve and SLA breaches for every assignee
+//
+// Only tickets opened in [start, end) are counted. SLA hours apply to queues without an sla_hours policy, 0 disables
+// breach counting for them. Team is optional and limits the report to employees of that team.
+//
+// Inputs - Array of strings
+//       0      ,      1      ,     2     ,     3
+//     start    ,     end     , sla hours ,   team
+// "2017-07-01" , "2017-08-01",    "48"   , "hardware"
+// ============================================================================================================================
+func get_workload(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_workload")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	start, end, slaHours, err := parse_workload_args(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	workloads, err := build_workload(stub, start, end, slaHours)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var report []Workload
+	for _, workload := range workloads {
+		if len(args) == 4 && workload.Team != args[3] {
+			continue
+		}
+		report = append(report, *workload)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Employee_sn < report[j].Employee_sn })
+
+	reportAsBytes, _ := json.Marshal(report)                  //convert to array of bytes
+	fmt.Println("- end get_workload")
+	return shim.Success(reportAsBytes)
+}
+
+// ============================================================================================================================
+// Get employee workload - the workload figures of a single employee
+//
+// Inputs - Array of strings
+//         0       ,      1      ,      2      ,     3
+//    employee id  ,    start    ,     end     , sla hours
+// "o9999999999999", "2017-07-01", "2017-08-01",    "48"
+// ============================================================================================================================
+func get_employee_workload(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_employee_workload")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	employee, err := get_employee(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, employee.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	start, end, slaHours, err := parse_workload_args(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	workloads, err := build_workload(stub, start, end, slaHours)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	workload, ok := workloads[employee.Employee_sn]
+	if !ok {
+		workload = &Workload{Employee_sn: employee.Employee_sn, Fullname: employee.Fullname, Team: employee.Team}
+	}
+
+	workloadAsBytes, _ := json.Marshal(workload)              //convert to array of bytes
+	fmt.Println("- end get_employee_workload")
+	return shim.Success(workloadAsBytes)
+}
+
+
+// ============================================================================================================================
+// Get assets out of warranty - every asset in service whose warranty ended before the given day
+//
+// The day is optional and defaults to the transaction date. Assets without a warranty end date are left out, retired
+// assets too.
+//
+// Inputs - Array of strings
+//       0
+//      day
+// "2017-07-20"
+// ============================================================================================================================
+func get_assets_out_of_warranty(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var day time.Time
+	var err error
+	fmt.Println("starting get_assets_out_of_warranty")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	if len(args) == 1 {
+		day, err = parse_date(args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		day, err = get_tx_datetime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	assets, err := get_all_assets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	outOfWarranty := []IBM_Asset{}
+	for _, ibmasset := range assets {
+		if !can_see(scope, ibmasset.Company) {
+			continue
+		}
+		if !warranty_known(ibmasset) || asset_status(ibmasset) == ASSET_RETIRED {
+			continue
+		}
+		if !in_warranty(ibmasset, day) {
+			outOfWarranty = append(outOfWarranty, ibmasset)
+		}
+	}
+
+	assetsAsBytes, _ := json.Marshal(outOfWarranty)           //convert to array of bytes
+	fmt.Println("- end get_assets_out_of_warranty")
+	return shim.Success(assetsAsBytes)
+}
+
+
+// ============================================================================================================================
+// Get Endorsement Policy - the orgs that must endorse changes to a ticket or asset. Admin only.
+//
+// Shows Off GetStateValidationParameter() - reading the key level endorsement policy of a key
+//
+// Inputs - Array of strings
+//       0     ,       1
+//  object type,      id
+//    "ticket" , "m999999999"
+//
+// Returns - json with the orgs, an empty list means the chaincode endorsement policy applies
+// ============================================================================================================================
+func get_endorsement_policy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type EndorsementPolicy struct {
+		ObjectType string   `json:"docType"`
+		Id         string   `json:"id"`
+		Orgs       []string `json:"orgs"`
+	}
+	var policy EndorsementPolicy
+	fmt.Println("starting get_endorsement_policy")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can read endorsement policies")
+	}
+
+	policy.ObjectType = args[0]
+	policy.Id = args[1]
+	switch policy.ObjectType {
+	case "ticket":
+		_, err = get_ticket(stub, policy.Id)
+	case "ibm_asset":
+		_, err = get_ibmasset(stub, policy.Id)
+	default:
+		err = errors.New("Endorsement policies exist on 'ticket' and 'ibm_asset' only")
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	policy.Orgs, err = get_endorsement_orgs(stub, policy.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if policy.Orgs == nil {
+		policy.Orgs = []string{}
+	}
+
+	policyAsBytes, _ := json.Marshal(policy)                  //convert to array of bytes
+	fmt.Println("- end get_endorsement_policy")
+	return shim.Success(policyAsBytes)
+}
+
+
+// ============================================================================================================================
+// get the personal data reference on a ticket or employee, checking the caller may see the document
+// ============================================================================================================================
+func get_pii_reference(stub shim.ChaincodeStubInterface, recordType string, recordId string) (PiiReference, error) {
+	switch recordType {
+	case "ticket":
+		ticket, err := get_ticket(stub, recordId)
+		if err != nil {
+			return PiiReference{}, err
+		}
+		return ticket.PersonalData, check_tenant(stub, ticket.Company)
+	case "employee":
+		employee, err := get_employee(stub, recordId)
+		if err != nil {
+			return PiiReference{}, err
+		}
+		return employee.PersonalData, check_tenant(stub, employee.Company)
+	}
+	return PiiReference{}, errors.New("Personal data exists on 'ticket' and 'employee' only")
+}
+
+// ============================================================================================================================
+// Read Personal Data - read the clear personal fields of a ticket or employee from private data
+//
+// Shows Off GetPrivateData() - only peers of orgs in the collection hold the values
+//
+// Inputs - Array of strings
+//       0     ,       1
+//  object type,      id
+//    "ticket" , "m999999999"
+// ============================================================================================================================
+func read_personal_data(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting read_personal_data")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reference, err := get_pii_reference(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(reference.ErasedOn) > 0 {
+		return shim.Error("Personal data was erased on " + reference.ErasedOn)
+	}
+
+	personalData, found, err := get_personal_data(stub, reference.Subject, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("No personal data for " + args[0] + " " + args[1])
+	}
+
+	personalData.Salt = ""                                    //the salt does not leave the chaincode
+	personalDataAsBytes, _ := json.Marshal(personalData)      //convert to array of bytes
+	fmt.Println("- end read_personal_data")
+	return shim.Success(personalDataAsBytes)
+}
+
+// ============================================================================================================================
+// Verify Personal Data - check personal values someone kept against the salted hashes on a ticket or employee
+//
+// Works after erasure too. The values and their salt are passed in the transient map under "pii" the same way they were
+// given when the document was written.
+//
+// Inputs - Array of strings
+//       0     ,       1
+//  object type,      id
+//    "ticket" , "m999999999"
+//
+// Returns - json object with true or false for every field passed in
+// ============================================================================================================================
+func verify_personal_data(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting verify_personal_data")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reference, err := get_pii_reference(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fields, salt, found, err := get_transient_pii(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Expecting the values to verify in the transient map under 'pii'")
+	}
+
+	matches := make(map[string]bool)
+	for field, value := range fields {
+		hash, ok := reference.Hashes[field]
+		matches[field] = ok && hash == hash_pii(salt, value)
+	}
+
+	matchesAsBytes, _ := json.Marshal(matches)                //convert to array of bytes
+	fmt.Println("- end verify_personal_data")
+	return shim.Success(matchesAsBytes)
+}
+
+
+// ============================================================================================================================
+// Retention report - closed tickets whose personal details are due for purge on or before a day
+//
+// The day is optional and defaults to the transaction date. Tickets already purged or erased are left out.
+//
+// Inputs - Array of strings
+//       0
+//      day
+// "2024-01-01"
+// ============================================================================================================================
+func retention_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type RetentionEntry struct {
+		Ticket_Id      string  `json:"ticket_id"`
+		Company        string  `json:"company"`
+		Queue          string  `json:"queue"`
+		ClosedOn       string  `json:"closedon"`
+		RetentionYears float64 `json:"retentionyears"`
+		DueOn          string  `json:"dueon"`
+	}
+	var day time.Time
+	var err error
+	fmt.Println("starting retention_report")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	if len(args) == 1 {
+		day, err = parse_period_end(args[0])             //the whole day counts
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		day, err = get_tx_datetime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		day = day.Add(time.Nanosecond)
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tickets, err := get_all_tickets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report := []RetentionEntry{}
+	for _, ticket := range tickets {
+		if !can_see(scope, ticket.Company) || len(ticket.PersonalData.ErasedOn) > 0 {
+			continue
+		}
+		due, years, ok := get_retention_due(stub, ticket)
+		if !ok || !due.Before(day) {
+			continue
+		}
+		report = append(report, RetentionEntry{ticket.Ticket_Id, ticket.Company, ticket.Queue, ticket.ClosedOn, years, due.Format(time.RFC3339)})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].DueOn < report[j].DueOn })
+
+	reportAsBytes, _ := json.Marshal(report)                  //convert to array of bytes
+	fmt.Println("- end retention_report")
+	return shim.Success(reportAsBytes)
+}
+
+
+// ============================================================================================================================
+// Verify Attachment - check a file still matches the hash anchored when it was attached
+//
+// Inputs - Array of strings
+//       0     ,       1      ,      2
+//   ticket id , attachment id,   sha256
+// "m999999999",    "photo1"  , "9f86d08..."
+// ============================================================================================================================
+func verify_attachment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Verification struct {
+		Attachment Attachment `json:"attachment"`
+		Match      bool       `json:"match"`
+	}
+	var verification Verification
+	fmt.Println("starting verify_attachment")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	hash, err := normalize_sha256(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	attachment, found, err := get_attachment(stub, ticket.Ticket_Id, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("This attachment does not exist - " + args[1])
+	}
+
+	verification.Attachment = attachment
+	verification.Match = attachment.Sha256 == hash
+
+	verificationAsBytes, _ := json.Marshal(verification)      //convert to array of bytes
+	fmt.Println("- end verify_attachment")
+	return shim.Success(verificationAsBytes)
+}
+
+
+// ============================================================================================================================
+// Csat Report - average satisfaction rating per assignee, queue or asset type
+//
+// Start and end are optional and limit the report to ratings submitted between them, the end day included.
+//
+// Inputs - Array of strings
+//       0     ,      1      ,      2
+//    group by ,    start    ,     end
+//  "assignee" , "2024-01-01", "2024-03-31"
+// ============================================================================================================================
+func csat_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type CsatGroup struct {
+		Group   string  `json:"group"`
+		Count   int     `json:"count"`
+		Average float64 `json:"average"`
+		Scores  [5]int  `json:"scores"`    //how many ratings of 1 to 5
+	}
+	var start, end time.Time
+	var err error
+	fmt.Println("starting csat_report")
+
+	if len(args) != 1 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting group by and optional start and end")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	groupBy := strings.ToLower(args[0])
+	if groupBy != "assignee" && groupBy != "queue" && groupBy != "assettype" {
+		return shim.Error("Group by must be assignee, queue or assettype - " + args[0])
+	}
+	if len(args) == 3 {
+		start, err = parse_date(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		end, err = parse_period_end(args[2])                 //the whole end day counts
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(CSAT_INDEX, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	groups := map[string]*CsatGroup{}
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var csat Csat
+		json.Unmarshal(pointer.GetValue(), &csat)            //un stringify it aka JSON.parse()
+		if !can_see(scope, csat.Company) {
+			continue
+		}
+		if len(args) == 3 {
+			submittedOn, err := time.Parse(time.RFC3339, csat.SubmittedOn)
+			if err != nil || submittedOn.Before(start) || !submittedOn.Before(end) {
+				continue
+			}
+		}
+
+		group := csat.Assignee
+		if groupBy == "queue" {
+			group = csat.Queue
+		} else if groupBy == "assettype" {
+			group = csat.AssetType
+		}
+		if groups[group] == nil {
+			groups[group] = &CsatGroup{Group: group}
+		}
+		groups[group].Count++
+		groups[group].Scores[csat.Score-1]++
+		groups[group].Average += float64(csat.Score)
+	}
+
+	report := []CsatGroup{}
+	for _, group := range groups {
+		group.Average = group.Average / float64(group.Count)
+		report = append(report, *group)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Group < report[j].Group })
+
+	reportAsBytes, _ := json.Marshal(report)                  //convert to array of bytes
+	fmt.Println("- end csat_report")
+	return shim.Success(reportAsBytes)
+}
+
+
+// ============================================================================================================================
+// Read Part - stock of a part at a site
+//
+// Company is optional and defaults to the caller's company, support staff and admins can read any company's stock.
+//
+// Inputs - Array of strings
+//      0    ,      1     ,      2
+//     site  , part number,   company
+//  "Dublin" ,  "FAN-120" ,  "Org2MSP"
+// ============================================================================================================================
+func read_part(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var companyId string
+	fmt.Println("starting read_part")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting site, part number and optional company")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args) == 3 {
+		companyId = args[2]
+	} else {
+		company, err := get_caller_company(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		companyId = company.Company_Id
+	}
+	err = check_tenant(stub, companyId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	part, found, err := get_part(stub, companyId, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("This part is not stocked at this site - " + args[1])
+	}
+
+	partAsBytes, _ := json.Marshal(part)                      //convert to array of bytes
+	fmt.Println("- end read_part")
+	return shim.Success(partAsBytes)
+}
+
+
+// ============================================================================================================================
+// Chargeback Report - labour and parts cost per cost centre, asset owner or queue for a period
+//
+// Costs count in the period they were logged or consumed in, the end day included. Cost centre and owner are the ones
+// frozen on a closed ticket, open tickets use their asset's. Tickets without one are grouped under an empty name.
+//
+// Inputs - Array of strings
+//       0      ,      1      ,      2
+//    group by  ,    start    ,     end
+// "costcentre" , "2024-01-01", "2024-03-31"
+// ============================================================================================================================
+func chargeback_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Chargeback struct {
+		Group   string   `json:"group"`
+		Tickets []string `json:"tickets"`
+		Minutes int      `json:"minutes"`
+		Labour  float64  `json:"labour"`
+		Parts   float64  `json:"parts"`
+		Total   float64  `json:"total"`
+	}
+	fmt.Println("starting chargeback_report")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting group by, start and end")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	groupBy := strings.ToLower(args[0])
+	if groupBy != "costcentre" && groupBy != "owner" && groupBy != "queue" {
+		return shim.Error("Group by must be costcentre, owner or queue - " + args[0])
+	}
+	start, err := parse_date(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	end, err := parse_period_end(args[2])                      //the whole end day counts
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	inPeriod := func(str string) bool {
+		day, err := time.Parse(time.RFC3339, str)
+		return err == nil && !day.Before(start) && day.Before(end)
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tickets, err := get_all_tickets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	groups := map[string]*Chargeback{}
+	for _, ticket := range tickets {
+		if !can_see(scope, ticket.Company) {
+			continue
+		}
+
+		var minutes int
+		var labour, parts float64
+		entries, err := get_ticket_time_entries(stub, ticket.Ticket_Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, entry := range entries {
+			if inPeriod(entry.LoggedOn) {
+				minutes += entry.Minutes
+				labour += entry.Cost
+			}
+		}
+		usages, err := get_ticket_parts(stub, ticket.Ticket_Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, usage := range usages {
+			if inPeriod(usage.ConsumedOn) {
+				parts += usage.Cost
+			}
+		}
+		if minutes == 0 && parts == 0 {
+			continue
+		}
+
+		group := ticket.Queue
+		if groupBy != "queue" {
+			chargedTo := ticket_charged_to(stub, ticket)
+			group = chargedTo.CostCentre
+			if groupBy == "owner" {
+				group = chargedTo.Owner
+			}
+		}
+		if groups[group] == nil {
+			groups[group] = &Chargeback{Group: group}
+		}
+		groups[group].Tickets = append(groups[group].Tickets, ticket.Ticket_Id)
+		groups[group].Minutes += minutes
+		groups[group].Labour += labour
+		groups[group].Parts += parts
+		groups[group].Total += labour + parts
+	}
+
+	report := []Chargeback{}
+	for _, group := range groups {
+		report = append(report, *group)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Group < report[j].Group })
+
+	reportAsBytes, _ := json.Marshal(report)                  //convert to array of bytes
+	fmt.Println("- end chargeback_report")
+	return shim.Success(reportAsBytes)
+}
+
+
+// ============================================================================================================================
+// Read Invoice
+//
+// Inputs - Array of strings
+//        0
+//    invoice id
+// "inv-2024-q1"
+// ============================================================================================================================
+func read_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting read_invoice")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting invoice id")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	invoice, found, err := get_invoice(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("This invoice does not exist - " + args[0])
+	}
+	err = check_tenant(stub, invoice.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	invoiceAsBytes, _ := json.Marshal(invoice)                //convert to array of bytes
+	fmt.Println("- end read_invoice")
+	return shim.Success(invoiceAsBytes)
+}
+
+// ============================================================================================================================
+// List Invoices - invoices the caller may see, optionally of one cost centre
+//
+// Inputs - Array of strings
+//       0
+//  cost centre
+//   "CC-1001"
+// ============================================================================================================================
+func list_invoices(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting list_invoices")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting optional cost centre")
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(INVOICE_INDEX, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	invoices := []Invoice{}
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var invoice Invoice
+		json.Unmarshal(pointer.GetValue(), &invoice)         //un stringify it aka JSON.parse()
+		if !can_see(scope, invoice.Company) || (len(args) == 1 && invoice.CostCentre != args[0]) {
+			continue
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	invoicesAsBytes, _ := json.Marshal(invoices)              //convert to array of bytes
+	fmt.Println("- end list_invoices")
+	return shim.Success(invoicesAsBytes)
+}
+
+
+// ============================================================================================================================
+// Get Technician Agenda - a technician's visits in time order
+//
+// Start and end are optional and limit the agenda to visits whose window falls between them.
+//
+// Inputs - Array of strings
+//       0      ,      1      ,      2
+//   technician ,    start    ,     end
+// "o999999999" , "2024-02-01", "2024-02-08"
+// ============================================================================================================================
+func get_technician_agenda(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var start, end time.Time
+	var err error
+	fmt.Println("starting get_technician_agenda")
+
+	if len(args) != 1 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting technician and optional start and end")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	technician, err := get_employee(stub, args[0])
+	if err != nil {
+		return shim.Error("This employee does not exist - " + args[0])
+	}
+	if len(args) == 3 {
+		start, err = parse_date(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		end, err = parse_date(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	visits, err := get_technician_visits(stub, technician.Employee_sn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	agenda := []Visit{}
+	for _, visit := range visits {
+		if !can_see(scope, visit.Company) {
+			continue                                            //visits for other companies stay hidden
+		}
+		if len(args) == 3 {
+			windowStart, _ := time.Parse(time.RFC3339, visit.WindowStart)
+			windowEnd, _ := time.Parse(time.RFC3339, visit.WindowEnd)
+			if !windows_overlap(start, end, windowStart, windowEnd) {
+				continue
+			}
+		}
+		agenda = append(agenda, visit)
+	}
+	sort.Slice(agenda, func(i, j int) bool { return agenda[i].WindowStart < agenda[j].WindowStart })
+
+	agendaAsBytes, _ := json.Marshal(agenda)                  //convert to array of bytes
+	fmt.Println("- end get_technician_agenda")
+	return shim.Success(agendaAsBytes)
+}
+
+
+// ============================================================================================================================
+// Read Custom Fields - the custom fields tickets in a queue carry
+//
+// Inputs - Array of strings
+//       0
+//     queue
+//  "hardware"
+// ============================================================================================================================
+func read_custom_fields(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting read_custom_fields")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting queue")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	schema, found, err := get_custom_field_schema(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		schema = CustomFieldSchema{ObjectType: "custom_fields", Queue: args[0], Fields: []CustomFieldDefinition{}}
+	}
+
+	schemaAsBytes, _ := json.Marshal(schema)                  //convert to array of bytes
+	fmt.Println("- end read_custom_fields")
+	return shim.Success(schemaAsBytes)
+}
+
+// ============================================================================================================================
+// Find Tickets By Custom Field - tickets whose custom field matches a condition
+//
+// Operator is one of =, !=, <, <=, >, >= and contains. Numbers and dates compare by value, contains matches text
+// ignoring case. Queue is optional and limits the search to tickets opened in it.
+//
+// Inputs - Array of strings
+//       0     ,    1    ,      2      ,     3
+//     field   , operator,    value    ,   queue
+// "osversion" ,   "="   , "Windows 10", "hardware"
+// ============================================================================================================================
+func find_tickets_by_custom_field(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting find_tickets_by_custom_field")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting field, operator, value and optional queue")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	operators := []string{"=", "!=", "<", "<=", ">", ">=", "contains"}
+	if !contains(operators, args[1]) {
+		return shim.Error("Operator must be one of " + strings.Join(operators, " ") + " - " + args[1])
+	}
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tickets, err := get_all_tickets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	found := []Ticket{}
+	for _, ticket := range tickets {
+		if !can_see(scope, ticket.Company) {
+			continue
+		}
+		if len(args) == 4 && ticket_origin_queue(ticket) != args[3] {
+			continue
+		}
+		value, ok := ticket.CustomFields[args[0]]
+		if ok && compare_custom_field(value, args[1], args[2]) {
+			found = append(found, ticket)
+		}
+	}
+
+	foundAsBytes, _ := json.Marshal(found)                    //convert to array of bytes
+	fmt.Println("- end find_tickets_by_custom_field")
+	return shim.Success(foundAsBytes)
+}
+
+
+// ============================================================================================================================
+// Find By Tag - tickets or assets carrying all (and) or any (or) of some tags, a page at a time
+//
+// Object type is ticket or ibm_asset. Results are in id order. The bookmark is the last id of the previous page, leave
+// it empty for the first page. Only objects the caller may see are returned.
+//
+// Inputs - Array of strings
+//       0     ,  1   ,          2          ,     3    ,     4
+//  object type, mode ,        tags         , page size,  bookmark
+//    "ticket" , "and", "blue-screen,urgent",   "20"   , "m999999999"
+// ============================================================================================================================
+func find_by_tag(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type TagPage struct {
+		Results  []interface{} `json:"results"`
+		Bookmark string        `json:"bookmark"` //empty on the last page
+	}
+	var page TagPage
+	fmt.Println("starting find_by_tag")
+
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting object type, mode, tags, page size and optional bookmark")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args[:4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	objectType := args[0]
+	if objectType != "ticket" && objectType != "ibm_asset" {
+		return shim.Error("Tags go on 'ticket' and 'ibm_asset' only")
+	}
+	mode := strings.ToLower(args[1])
+	if mode != "and" && mode != "or" {
+		return shim.Error("Mode must be and or or - " + args[1])
+	}
+	var tags []string
+	for _, tag := range split_list(args[2]) {
+		tag, err = normalize_tag(tag)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return shim.Error("Expecting at least one tag")
+	}
+	pageSize, err := strconv.Atoi(args[3])
+	if err != nil || pageSize <= 0 {
+		return shim.Error("Page size must be a positive number - " + args[3])
+	}
+	bookmark := ""
+	if len(args) == 5 {
+		bookmark = args[4]
+	}
+
+	// count how many of the tags each id carries
+	matches := map[string]int{}
+	for _, tag := range tags {
+		ids, err := get_tagged_ids(stub, tag, objectType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, id := range ids {
+			matches[id]++
+		}
+	}
+	var ids []string
+	for id, count := range matches {
+		if mode == "or" || count == len(tags) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page.Results = []interface{}{}
+	for _, id := range ids {
+		if len(bookmark) > 0 && id <= bookmark {
+			continue                                            //on an earlier page
+		}
+		if len(page.Results) == pageSize {
+			break
+		}
+		page.Bookmark = id
+		if objectType == "ticket" {
+			ticket, err := get_ticket(stub, id)
+			if err == nil && can_see(scope, ticket.Company) {
+				page.Results = append(page.Results, ticket)
+			}
+		} else {
+			ibmasset, err := get_ibmasset(stub, id)
+			if err == nil && can_see(scope, ibmasset.Company) {
+				page.Results = append(page.Results, ibmasset)
+			}
+		}
+	}
+	if len(ids) == 0 || page.Bookmark == ids[len(ids)-1] {
+		page.Bookmark = ""                                      //nothing after this page
+	}
+
+	pageAsBytes, _ := json.Marshal(page)                      //convert to array of bytes
+	fmt.Println("- end find_by_tag")
+	return shim.Success(pageAsBytes)
+}
+
+
+// ============================================================================================================================
+// Search Tickets - tickets whose description, descriptionproduct or diagnostic match a query
+//
+// Uses the search index written with every ticket, so it works on LevelDB without CouchDB. The query is a list of
+// clauses that must all match: a term (bsod), a prefix of at least 2 characters (overheat*) or a phrase in double quotes
+// ("blue screen") whose words follow each other in one field. Matching ignores case. Tickets come back in id order.
+//
+// Inputs - Array of strings
+//                0
+//              query
+// "bsod \"after update\" driv*"
+// ============================================================================================================================
+func search_tickets(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting search_tickets")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting query")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// split the query into clauses, quoted parts are phrases
+	var clauses [][]string
+	var prefixes []bool
+	parts := strings.Split(args[0], "\"")
+	for i, part := range parts {
+		if i%2 == 1 {
+			phrase := tokenize(part)
+			if len(phrase) > 0 {
+				clauses = append(clauses, phrase)
+				prefixes = append(prefixes, false)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			for _, term := range tokenize(word) {
+				clauses = append(clauses, []string{term})
+				prefixes = append(prefixes, false)
+			}
+			if prefix && len(clauses) > 0 {
+				prefixes[len(prefixes)-1] = true                //the star applies to the last word
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return shim.Error("Expecting at least one search term")
+	}
+
+	var matched map[string]bool
+	for i, clause := range clauses {
+		ids, err := match_clause(stub, clause, prefixes[i])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if matched == nil {
+			matched = ids
+			continue
+		}
+		for id := range matched {
+			if !ids[id] {
+				delete(matched, id)                             //every clause must match
+			}
+		}
+	}
+
+	var ids []string
+	for id := range matched {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tickets := []Ticket{}
+	for _, id := range ids {
+		ticket, err := get_ticket(stub, id)
+		if err == nil && can_see(scope, ticket.Company) {
+			tickets = append(tickets, ticket)
+		}
+	}
+
+	ticketsAsBytes, _ := json.Marshal(tickets)                //convert to array of bytes
+	fmt.Println("- end search_tickets")
+	return shim.Success(ticketsAsBytes)
+}
+
+// ids of the tickets matching one clause, a term, a prefix or a phrase of terms in consecutive positions of one field.
+// Words too short to be indexed only hold their place in a phrase.
+func match_clause(stub shim.ChaincodeStubInterface, clause []string, prefix bool) (map[string]bool, error) {
+	var terms []string
+	var offsets []int
+	for offset, term := range clause {
+		if is_indexed_term(term) {
+			terms = append(terms, term)
+			offsets = append(offsets, offset)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("Search terms need 2 to 64 characters - " + strings.Join(clause, " "))
+	}
+
+	postings := make([]map[string]map[string][][]int, len(terms))
+	for i, term := range terms {
+		var err error
+		postings[i], err = get_term_postings(stub, term, !prefix || len(clause) > 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids := map[string]bool{}
+	for id, fields := range postings[0] {
+		if len(terms) == 1 {
+			ids[id] = true
+			continue
+		}
+		for field, positionLists := range fields {
+			for _, starts := range positionLists {
+				for _, start := range starts {
+					if phrase_continues(postings, offsets, id, field, start) {
+						ids[id] = true
+					}
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+// true when every following term of a phrase sits at its offset from the first term's position
+func phrase_continues(postings []map[string]map[string][][]int, offsets []int, id string, field string, start int) bool {
+	for i := 1; i < len(postings); i++ {
+		found := false
+		for _, positions := range postings[i][id][field] {
+			for _, position := range positions {
+				if position == start + offsets[i] - offsets[0] {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
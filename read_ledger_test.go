@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// ----- workload ----- //
+
+func TestWorkload(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+
+	// hardware has a 48 hour SLA
+	l.ok(l.ticketAt(day("2017-07-03"), customerMsp, "t1", "no display", "owner1", "tech2", "X1", "hardware"))
+	l.ok(l.ticketAt(day("2017-07-05"), customerMsp, "t2", "keyboard broken", "owner1", "tech2", "X2", "hardware"))
+	l.ok(l.ticketAt(day("2017-07-06"), customerMsp, "t3", "fan noise", "owner1", "tech2", "X3", "hardware"))
+	l.ok(l.ticketAt(day("2017-08-01"), customerMsp, "t4", "battery dead", "owner1", "tech2", "X4", "hardware"))
+	l.ok(l.ticketAt(day("2017-07-03"), otherMsp, "t5", "no power", "owner3", "tech3", "X5", "hardware"))
+	l.as(customerMsp, "tech2")
+	l.ok(l.invokeAt(day("2017-07-04"), request_customer_signoff, "t1", "fixed"))
+	l.ok(l.invokeAt(day("2017-07-08"), request_customer_signoff, "t2", "fixed"))
+
+	var report []Workload
+	l.as(customerMsp, "owner1")
+	json.Unmarshal(l.ok(l.invokeAt(day("2017-07-20"), get_workload, "2017-07-01", "2017-08-01", "0")), &report)
+	if len(report) != 1 {
+		t.Fatalf("expected the workload of tech2 only, got %+v", report)
+	}
+	workload := report[0]
+	if workload.Employee_sn != "tech2" || workload.Resolved != 2 || workload.Open != 1 {
+		t.Fatalf("wrong counts - %+v", workload)
+	}
+	if workload.AvgHoursToResolve != 48 {
+		t.Fatalf("expected 48 hours to resolve on average, got %v", workload.AvgHoursToResolve)
+	}
+	if workload.SlaBreaches != 2 {
+		t.Fatalf("expected t2 resolved late and t3 still open past its SLA, got %d breaches", workload.SlaBreaches)
+	}
+
+	l.as(otherMsp, "owner3").fails(l.invokeAt(day("2017-07-20"), get_employee_workload, "tech2", "2017-07-01", "2017-08-01", "0"), "another company")
+	l.as(customerMsp, "owner1").fails(l.invoke("get_workload", "July", "2017-08-01", "0"), "YYYY-MM-DD")
+}
+
+// ----- warranty ----- //
+
+func TestAssetsOutOfWarranty(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.asset(customerMsp, "SN2", "thinkpad", "owner1")
+	l.asset(customerMsp, "SN3", "thinkpad", "owner1")
+	l.asset(otherMsp, "SN4", "thinkpad", "owner3")
+	l.as(customerMsp, "owner1")
+	l.ok(l.invoke("update_ibmasset", "SN1", `{"warrantyend": "2017-07-19"}`))
+	l.ok(l.invoke("update_ibmasset", "SN2", `{"warrantyend": "2017-07-20"}`)) //last day covered
+	l.as(otherMsp, "").ok(l.invoke("update_ibmasset", "SN4", `{"warrantyend": "2016-01-01"}`))
+
+	var assets []IBM_Asset
+	l.as(customerMsp, "owner1")
+	json.Unmarshal(l.ok(l.invoke("get_assets_out_of_warranty", "2017-07-20")), &assets)
+	if len(assets) != 1 || assets[0].SerialNumber != "SN1" {
+		t.Fatalf("expected only SN1 out of warranty, got %+v", assets)
+	}
+
+	l.ok(l.invoke("retire_asset", "SN1"))
+	json.Unmarshal(l.ok(l.invoke("get_assets_out_of_warranty", "2017-07-20")), &assets)
+	if len(assets) != 0 {
+		t.Fatalf("expected retired assets left out, got %+v", assets)
+	}
+}
+
+// ----- config store ----- //
+
+func TestListConfig(t *testing.T) {
+	l := newTestLedger(t)
+	l.config("sla_hours", "software", "8")
+
+	var listing struct {
+		Entries []ConfigEntry           `json:"entries"`
+		Schemas map[string]ConfigSchema `json:"schemas"`
+	}
+	json.Unmarshal(l.ok(l.invoke("list_config")), &listing)
+	found := false
+	for _, entry := range listing.Entries {
+		if entry.Name == "sla_hours" && entry.Scope == "software" && string(entry.Value) == "8" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected sla_hours for software in the listing - %+v", listing.Entries)
+	}
+	if _, ok := listing.Schemas["billing_queue"]; !ok {
+		t.Fatal("expected the schemas in the listing")
+	}
+	l.fails(l.invoke("read_config", "no_such_entry"), "Unknown config entry")
+}
+
+// ----- tenants ----- //
+
+func TestTenantIsolationOnReads(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "X1", "software"))
+	l.ok(l.ticket(otherMsp, "t2", "no power", "owner3", "tech3", "X2", "software"))
+
+	l.as(otherMsp, "owner3").fails(l.invoke("read_ticket", "t1"), "another company")
+	l.fails(l.invoke("read_company", customerMsp), "another company")
+	l.fails(l.invoke("get_employee_workload", "tech2", "2017-07-01", "2017-08-01", "0"), "another company")
+	l.ok(l.invoke("read_ticket", "t2"))
+
+	ranged := func() []string {
+		var results []struct {
+			Key string `json:"Key"`
+		}
+		json.Unmarshal(l.ok(l.invoke("getTicketsByRange", "", "")), &results)
+		var keys []string
+		for _, result := range results {
+			keys = append(keys, result.Key)
+		}
+		return keys
+	}
+	if keys := ranged(); len(keys) != 1 || keys[0] != "t2" {
+		t.Fatalf("expected only the caller's company's ticket, got %v", keys)
+	}
+	l.as(customerMsp, "owner1")
+	if keys := ranged(); len(keys) != 1 || keys[0] != "t1" {
+		t.Fatalf("expected only the caller's company's ticket, got %v", keys)
+	}
+	l.as(providerMsp, "tech1")
+	if keys := ranged(); len(keys) != 2 {
+		t.Fatalf("expected support to see every company's tickets, got %v", keys)
+	}
+	l.asAdmin()
+	if keys := ranged(); len(keys) != 2 {
+		t.Fatalf("expected the admin to see every company's tickets, got %v", keys)
+	}
+	l.ok(l.invoke("read_ticket", "t1"))
+}
+
+// ----- csat ----- //
+
+func TestCsatReport(t *testing.T) {
+	l := newTestLedger(t).customer()
+	for _, id := range []string{"t1", "t2", "t3"} {
+		l.ok(l.ticketAt(day("2017-03-01"), customerMsp, id, "no display", "owner1", "tech2", "SN1", "software"))
+	}
+	l.closeAt(day("2017-03-10"), customerMsp, "t1", "tech2", "owner1")
+	l.closeAt(day("2017-03-31"), customerMsp, "t2", "tech2", "owner1")
+
+	l.as(customerMsp, "owner1").fails(l.invokeAt(day("2017-03-10"), submit_csat, "t3", "4"), "Only closed tickets")
+	l.as(customerMsp, "tech2").fails(l.invokeAt(day("2017-03-10"), submit_csat, "t1", "4"), "Only the ticket's owner")
+	l.as(customerMsp, "owner1").fails(l.invokeAt(day("2017-03-10"), submit_csat, "t1", "6"), "Score must be")
+	l.ok(l.invokeAt(day("2017-03-10"), submit_csat, "t1", "4", "quick"))
+	l.fails(l.invokeAt(day("2017-03-11"), submit_csat, "t1", "5"), "already rated")
+	l.ok(l.invokeAt(day("2017-03-31"), submit_csat, "t2", "2"))
+
+	type csatGroup struct {
+		Group   string  `json:"group"`
+		Count   int     `json:"count"`
+		Average float64 `json:"average"`
+	}
+	var report []csatGroup
+	json.Unmarshal(l.asAdmin().ok(l.invoke("csat_report", "queue", "2017-03-01", "2017-03-31")), &report)
+	if len(report) != 1 || report[0].Group != "software" || report[0].Count != 2 || report[0].Average != 3 {
+		t.Fatalf("expected both ratings with the end day included - %+v", report)
+	}
+	json.Unmarshal(l.ok(l.invoke("csat_report", "assignee", "2017-03-01", "2017-03-30")), &report)
+	if len(report) != 1 || report[0].Group != "tech2" || report[0].Count != 1 {
+		t.Fatalf("expected only the rating before the end day - %+v", report)
+	}
+	json.Unmarshal(l.as(otherMsp, "").ok(l.invoke("csat_report", "queue")), &report)
+	if len(report) != 0 {
+		t.Fatalf("expected another company's ratings hidden - %+v", report)
+	}
+}
+
+// ----- chargeback ----- //
+
+func TestChargebackReport(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	l.config("labour_rate", "standard", "60")
+	l.ok(l.ticket(customerMsp, "t1", "fan noise", "owner1", "tech2", "X1", "software"))
+	l.ok(l.ticket(otherMsp, "t3", "fan noise", "owner3", "tech3", "X3", "software"))
+
+	l.as(customerMsp, "tech2")
+	l.ok(l.invokeAt(day("2017-03-01"), log_time, "t1", "tech2", "10", "standard"))
+	l.ok(l.invokeAt(day("2017-03-31"), log_time, "t1", "tech2", "20", "standard"))
+	l.ok(l.invokeAt(day("2017-04-01"), log_time, "t1", "tech2", "40", "standard"))
+	l.as(otherMsp, "tech3").ok(l.invokeAt(day("2017-03-15"), log_time, "t3", "tech3", "60", "standard"))
+
+	type chargeback struct {
+		Group   string   `json:"group"`
+		Tickets []string `json:"tickets"`
+		Minutes int      `json:"minutes"`
+		Total   float64  `json:"total"`
+	}
+	var report []chargeback
+	json.Unmarshal(l.as(customerMsp, "tech2").ok(l.invoke("chargeback_report", "queue", "2017-03-01", "2017-03-31")), &report)
+	if len(report) != 1 || report[0].Group != "software" || report[0].Minutes != 30 || report[0].Total != 30 || report[0].Tickets[0] != "t1" {
+		t.Fatalf("expected the company's time from the start day to the end day included - %+v", report)
+	}
+	json.Unmarshal(l.asAdmin().ok(l.invoke("chargeback_report", "queue", "2017-03-02", "2017-03-30")), &report)
+	if len(report) != 1 || report[0].Minutes != 60 || report[0].Tickets[0] != "t3" {
+		t.Fatalf("expected only the time inside the period - %+v", report)
+	}
+	l.fails(l.invoke("chargeback_report", "site", "2017-03-01", "2017-03-31"), "Group by must be")
+
+	// closed tickets stay with the cost centre their asset had when they were closed
+	l.as(customerMsp, "owner1").ok(l.invoke("update_ibmasset", "SN1", `{"costcentre": "CC-1"}`))
+	l.ok(l.ticket(customerMsp, "t2", "fan noise", "owner1", "tech2", "SN1", "software"))
+	l.as(customerMsp, "tech2").ok(l.invokeAt(day("2017-05-10"), log_time, "t2", "tech2", "30", "standard"))
+	l.closeAt(day("2017-05-20"), customerMsp, "t2", "tech2", "owner1")
+	l.as(customerMsp, "owner1").ok(l.invoke("update_ibmasset", "SN1", `{"costcentre": "CC-2"}`))
+	json.Unmarshal(l.as(customerMsp, "tech2").ok(l.invoke("chargeback_report", "costcentre", "2017-05-01", "2017-05-31")), &report)
+	if len(report) != 1 || report[0].Group != "CC-1" || report[0].Tickets[0] != "t2" {
+		t.Fatalf("expected the closed ticket charged to its cost centre at closure - %+v", report)
+	}
+}
+
+// ----- custom fields ----- //
+
+func TestFindTicketsByCustomField(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.asAdmin().ok(l.invoke("set_custom_fields", "software", `[{"name": "osversion", "type": "string"}, {"name": "users", "type": "number"},
+		{"name": "vip", "type": "bool"}, {"name": "since", "type": "date"}]`))
+	l.ok(l.ticketWithFields("t1", `{"osversion": "Windows 10", "users": 3, "vip": true, "since": "2017-07-01"}`))
+	l.ok(l.ticketWithFields("t2", `{"osversion": "Windows 11", "users": 12, "vip": false, "since": "2017-06-15"}`))
+	l.ok(l.ticketWithFields("t3", `{}`))
+
+	find := func(args ...string) string {
+		var tickets []Ticket
+		json.Unmarshal(l.ok(l.invoke("find_tickets_by_custom_field", args...)), &tickets)
+		var ids []string
+		for _, ticket := range tickets {
+			ids = append(ids, ticket.Ticket_Id)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	for _, c := range []struct{ field, operator, value, want string }{
+		{"osversion", "=", "Windows 10", "t1"},
+		{"osversion", "!=", "Windows 10", "t2"},
+		{"osversion", "contains", "windows", "t1,t2"},
+		{"users", ">", "3", "t2"},
+		{"users", "<=", "3", "t1"},
+		{"users", ">=", "three", ""},
+		{"vip", "=", "TRUE", "t1"},
+		{"vip", "<", "true", ""},
+		{"since", "<", "2017-07-01", "t2"},
+		{"since", ">=", "2017-07-01", "t1"},
+	} {
+		if got := find(c.field, c.operator, c.value); got != c.want {
+			t.Errorf("%s %s %s - expected %q, got %q", c.field, c.operator, c.value, c.want, got)
+		}
+	}
+	if got := find("users", ">", "0", "hardware"); got != "" {
+		t.Fatalf("expected the queue to limit the search, got %q", got)
+	}
+	l.fails(l.invoke("find_tickets_by_custom_field", "users", "~", "3"), "Operator must be one of")
+	if l.as(otherMsp, ""); find("users", ">", "0") != "" {
+		t.Fatal("expected another company's tickets hidden")
+	}
+}
+
+// ----- tags ----- //
+
+func TestFindByTag(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	for _, id := range []string{"t1", "t2", "t3"} {
+		l.ok(l.ticket(customerMsp, id, "no display", "owner1", "tech2", "X1", "software"))
+		l.ok(l.invoke("add_tag", "ticket", id, "blue-screen"))
+	}
+	l.ok(l.invoke("add_tag", "ticket", "t2", "urgent"))
+	l.ok(l.ticket(otherMsp, "t4", "no display", "owner3", "tech3", "X3", "software"))
+	l.ok(l.invoke("add_tag", "ticket", "t4", "blue-screen"))
+	l.as(customerMsp, "owner1").ok(l.invoke("add_tag", "ibm_asset", "SN1", "blue-screen"))
+
+	type tagPage struct {
+		Results  []Ticket `json:"results"`
+		Bookmark string   `json:"bookmark"`
+	}
+	find := func(args ...string) (string, string) {
+		var page tagPage
+		json.Unmarshal(l.ok(l.invoke("find_by_tag", args...)), &page)
+		var ids []string
+		for _, ticket := range page.Results {
+			ids = append(ids, ticket.Ticket_Id)
+		}
+		return strings.Join(ids, ","), page.Bookmark
+	}
+
+	if ids, _ := find("ticket", "and", "blue-screen,urgent", "10"); ids != "t2" {
+		t.Fatalf("expected only the ticket with both tags, got %q", ids)
+	}
+	if ids, _ := find("ticket", "or", "urgent,Blue Screen", "10"); ids != "t1,t2,t3" {
+		t.Fatalf("expected the company's tickets with either tag, got %q", ids)
+	}
+	ids, bookmark := find("ticket", "or", "blue-screen", "2")
+	if ids != "t1,t2" || bookmark != "t2" {
+		t.Fatalf("expected the first page, got %q %q", ids, bookmark)
+	}
+	if ids, bookmark = find("ticket", "or", "blue-screen", "2", bookmark); ids != "t3" || bookmark != "" {
+		t.Fatalf("expected the last page, got %q %q", ids, bookmark)
+	}
+
+	var assets struct {
+		Results []IBM_Asset `json:"results"`
+	}
+	json.Unmarshal(l.ok(l.invoke("find_by_tag", "ibm_asset", "and", "blue-screen", "10")), &assets)
+	if len(assets.Results) != 1 || assets.Results[0].SerialNumber != "SN1" {
+		t.Fatalf("expected the tagged asset - %+v", assets)
+	}
+	l.fails(l.invoke("find_by_tag", "asset", "and", "blue-screen", "10"), "'ticket' and 'ibm_asset' only")
+	l.fails(l.invoke("find_by_tag", "ticket", "xor", "blue-screen", "10"), "Mode must be")
+	l.as(otherMsp, "")
+	if ids, _ := find("ticket", "or", "blue-screen", "10"); ids != "t4" {
+		t.Fatalf("expected only the caller's company's tickets, got %q", ids)
+	}
+}
+
+// ----- search ----- //
+
+func TestSearchTickets(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	l.ok(l.ticket(customerMsp, "t1", "Blue screen after update", "owner1", "tech2", "X1", "software"))
+	l.ok(l.ticket(customerMsp, "t2", "screen is blue, a driver crash", "owner1", "tech2", "X1", "software"))
+	l.ok(l.ticket(customerMsp, "t3", "overheating fan", "owner1", "tech2", "X1", "software"))
+	l.ok(l.ticket(otherMsp, "t4", "blue screen", "owner3", "tech3", "X3", "software"))
+
+	search := func(query string) string {
+		var tickets []Ticket
+		json.Unmarshal(l.ok(l.invoke("search_tickets", query)), &tickets)
+		var ids []string
+		for _, ticket := range tickets {
+			ids = append(ids, ticket.Ticket_Id)
+		}
+		return strings.Join(ids, ",")
+	}
+	l.as(customerMsp, "owner1")
+	for query, want := range map[string]string{
+		"blue":                     "t1,t2",
+		"BLUE Screen":              "t1,t2",
+		`"blue screen"`:            "t1",
+		`"screen is blue"`:         "t2",
+		`"a driver crash"`:         "t2",
+		`"screen blue"`:            "",
+		"scr*":                     "t1,t2",
+		"overheat*":                "t3",
+		"overheat":                 "",
+		`blue "after update" upd*`: "t1",
+		"thinkpad":                 "t1,t2,t3",
+	} {
+		if got := search(query); got != want {
+			t.Errorf("%s - expected %q, got %q", query, want, got)
+		}
+	}
+	l.fails(l.invoke("search_tickets", "x"), "2 to 64 characters")
+	l.fails(l.invoke("search_tickets", `""`), "at least one search term")
+
+	// the index follows updates and deletes
+	l.ok(l.invoke("update_ticket", "t2", `{"description": "fan noise"}`))
+	if got := search("blue"); got != "t1" {
+		t.Fatalf("expected the old text out of the index, got %q", got)
+	}
+	if got := search("fan"); got != "t2,t3" {
+		t.Fatalf("expected the new text in the index, got %q", got)
+	}
+
+	// terms in both texts keep their entry with the new positions
+	l.ok(l.invoke("update_ticket", "t1", `{"description": "after the update the screen went blue"}`))
+	if got := search("blue"); got != "t1" {
+		t.Fatalf("expected a term kept across the update, got %q", got)
+	}
+	if got := search(`"screen went blue"`) + "|" + search(`"blue screen"`); got != "t1|" {
+		t.Fatalf("expected the new positions in the index, got %q", got)
+	}
+	l.ok(l.invoke("delete_ticket", "t3", customerMsp))
+	if got := search("overheat*"); got != "" {
+		t.Fatalf("expected a deleted ticket out of the index, got %q", got)
+	}
+
+	l.as(otherMsp, "")
+	if got := search("blue"); got != "t4" {
+		t.Fatalf("expected only the caller's company's tickets, got %q", got)
+	}
+}
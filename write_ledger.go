@@ -5,32 +5,141 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	_ "strconv"
-	_ "strings"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // ============================================================================================================================
-// write() - genric write variable into ledger
-// 
-// Shows Off PutState() - writting a key/value into the ledger
+// set_config() - write a typed configuration entry
+//
+// Shows Off CreateCompositeKey() - entries live under the config~name~scope namespace so no ticket, employee or asset
+// document can be touched through here. Admin only.
+//
+// Value is JSON and must match the schema of the entry. Scope is the queue name for per queue entries and is left
+// out for channel wide ones.
+//
+// Inputs - Array of strings
+//        0       ,     1     ,     2
+//       name     ,   scope   ,   value
+// "billing_queue",           , "\"billing\""
+// ============================================================================================================================
+func set_config(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var name, scope, value string
+	var err error
+	fmt.Println("starting set_config")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3. name, optional scope and value of the entry")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	name = args[0]
+	value = args[len(args)-1]
+	if len(args) == 3 {
+		scope = args[1]
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can change the configuration")
+	}
+
+	updatedBy, _ := cid.GetID(stub)
+	entry, err := put_config(stub, name, scope, json.RawMessage(value), updatedBy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "config_changed", entry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_config")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// delete_config() - remove a configuration entry so its default applies again. Admin only.
+//
+// Inputs - Array of strings
+//        0       ,     1
+//       name     ,   scope
+// "billing_queue",
+// ============================================================================================================================
+func delete_config(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var name, scope string
+	fmt.Println("starting delete_config")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2. name and optional scope of the entry")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	name = args[0]
+	if len(args) == 2 {
+		scope = args[1]
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can change the configuration")
+	}
+
+	_, found, err := get_config(stub, name, scope)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Config entry is not set - " + name)
+	}
+
+	key, err := config_key(stub, name, scope)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(key)                        //remove the entry from the ledger
+	if err != nil {
+		return shim.Error("Failed to delete state")
+	}
+
+	fmt.Println("- end delete_config")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// init_company() - register the company of an organisation, its MSP id is the company id. Admin only.
 //
 // Inputs - Array of strings
-//    0   ,    1
-//   key  ,  value
-//  "abc" , "test"
+//       0    ,        1
+//   company  ,       name
+//  "Org1MSP" , "United Marbles"
 // ============================================================================================================================
-func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var key, value string
+func init_company(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var company Company
 	var err error
-	fmt.Println("starting write")
+	fmt.Println("starting init_company")
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2. key of the variable and value to set")
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
 	// input sanitation
@@ -39,14 +148,34 @@ func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
-	key = args[0]                                   //rename for funsies
-	value = args[1]
-	err = stub.PutState(key, []byte(value))         //write the variable into the ledger
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can register companies")
+	}
+
+	_, err = get_company(stub, args[0])
+	if err == nil {
+		return shim.Error("This company already exists - " + args[0])
+	}
+
+	company.ObjectType = "company"
+	company.Company_Id = args[0]
+	company.Name = args[1]
+	company.CreatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(COMPANY_INDEX, []string{company.Company_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	companyAsBytes, _ := json.Marshal(company)      //convert to array of bytes
+	err = stub.PutState(key, companyAsBytes)        //store company by its MSP id
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	fmt.Println("- end write")
+	fmt.Println("- end init_company")
 	return shim.Success(nil)
 }
 
@@ -58,7 +187,7 @@ func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // Inputs - Array of strings
 //      0      ,         1
 //     id      ,  authed_by_company
-// "m999999999", "united marbles"
+// "m999999999", "Org1MSP"
 // ============================================================================================================================
 func delete_ticket(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	fmt.Println("starting delete_ticket")
@@ -74,6 +203,7 @@ func delete_ticket(stub shim.ChaincodeStubInterface, args []string) (pb.Response
 	}
 
 	id := args[0]
+	authed_by_company := args[1]
 	
 	// get the object
 	ticket, err := get_ticket(stub, id)
@@ -82,11 +212,32 @@ func delete_ticket(stub shim.ChaincodeStubInterface, args []string) (pb.Response
 		return shim.Error(err.Error())
 	}
 
+	// check authorizing company
+	if ticket.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion of '" + ticket.Company + "'s ticket.")
+	}
+	err = check_tenant(stub, authed_by_company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// remove the ticket
 	err = stub.DelState(ticket.Ticket_Id)   	 //remove the key from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state")
 	}
+	err = del_tag_index(stub, "ticket", ticket.Ticket_Id, ticket.Tags)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = index_ticket(stub, ticket, Ticket{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = del_ticket_lookup(stub, ticket)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end delete_ticket")
 	return shim.Success(nil)
@@ -100,7 +251,7 @@ func delete_ticket(stub shim.ChaincodeStubInterface, args []string) (pb.Response
 // Inputs - Array of strings
 //      0      ,         1
 //     id      ,  authed_by_company
-// "m999999999", "united marbles"
+// "m999999999", "Org1MSP"
 // ============================================================================================================================
 func delete_employee(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	fmt.Println("starting delete_employee")
@@ -116,6 +267,7 @@ func delete_employee(stub shim.ChaincodeStubInterface, args []string) (pb.Respon
 	}
 
 	id := args[0]
+	authed_by_company := args[1]
 	
 	// get the object
 	employee, err := get_employee(stub, id)
@@ -124,6 +276,15 @@ func delete_employee(stub shim.ChaincodeStubInterface, args []string) (pb.Respon
 		return shim.Error(err.Error())
 	}
 
+	// check authorizing company
+	if employee.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion of '" + employee.Company + "'s employee.")
+	}
+	err = check_tenant(stub, authed_by_company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// remove the employee
 	err = stub.DelState(employee.Employee_sn) 	//remove the key from chaincode state
 	if err != nil {
@@ -142,7 +303,7 @@ func delete_employee(stub shim.ChaincodeStubInterface, args []string) (pb.Respon
 // Inputs - Array of strings
 //      0      ,         1
 //     id      ,  authed_by_company
-// "m999999999", "united marbles"
+// "m999999999", "Org1MSP"
 // ============================================================================================================================
 func delete_ibmasset(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	fmt.Println("starting delete_ibmasset")
@@ -158,6 +319,7 @@ func delete_ibmasset(stub shim.ChaincodeStubInterface, args []string) (pb.Respon
 	}
 
 	id := args[0]
+	authed_by_company := args[1]
 
 	// get the object
 	ibmasset, err := get_ibmasset(stub, id)
@@ -166,11 +328,24 @@ func delete_ibmasset(stub shim.ChaincodeStubInterface, args []string) (pb.Respon
 		return shim.Error(err.Error())
 	}
 
+	// check authorizing company
+	if ibmasset.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion of '" + ibmasset.Company + "'s asset.")
+	}
+	err = check_tenant(stub, authed_by_company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// remove the Asset
 	err = stub.DelState(ibmasset.SerialNumber)   	 //remove the key from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state")
 	}
+	err = del_tag_index(stub, "ibm_asset", ibmasset.SerialNumber, ibmasset.Tags)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end delete_ibmasset")
 	return shim.Success(nil)
@@ -179,86 +354,319 @@ func delete_ibmasset(stub shim.ChaincodeStubInterface, args []string) (pb.Respon
 // ============================================================================================================================
 // Init Ticket - create a new ticket, store into chaincode state
 //
-// Shows off building a key's JSON value manually
+// Shows off building key's value from GoLang Structure
+//
+// Tickets opened against an asset on the ledger get an entitlement check. Hardware tickets on assets out of warranty
+// are routed to the billing queue, assets without a warranty end date leave the ticket where it is.
+//
+// The ticket belongs to the owner's company, which must be the caller's own unless the caller works across companies.
+// The asset must belong to the same company, the assignee too unless they have the support role.
+//
+// Contact details are personal data of the ticket owner. They are passed in the transient map under "pii", e.g.
+// {"address": "MOP 1", "contactphone": "0612345678", "contactemail": "bob@ibm.com", "salt": "<random>"}, stored in
+// private data and only their salted hashes are put on the ticket.
+//
+// Custom fields are optional, a JSON object checked against the custom fields of the queue.
+//
+// Open tickets on the same asset or from the same owner, opened within duplicate_window_hours and with similar text,
+// are likely duplicates. The queue's duplicate_action rejects the ticket, opens it and lists them in the response, or
+// opens it linked to the most similar one. The check is off unless duplicate_action is set, and only runs once the
+// caller is known to be allowed to open tickets for the owner's company.
 //
 // Inputs - Array of strings
-//      0      ,    1  ,  2  ,      3          ,       4
-//     ticket_id      ,  color, size,     owner id    ,  authing company
-// "m999999999", "blue", "35", "o9999999999999", "united marbles"
+//      0      ,      1      ,     2      ,   3   ,       4        ,       5        ,      6      ,     7
+//  ticket id  , description ,    date    , status,  ticket owner  ,    assignee    ,    asset    ,   queue
+// "m999999999", "no display", "2017-07-20", "open", "o9999999999999", "o8888888888888", "SN12345678", "hardware"
+//
+//        8          ,    9    ,     10     ,     11    ,  12 ,             13
+// descriptionproduct,   prod  , diagnostic , hardwarepw, ospw,        custom fields
+//     "ThinkPad"    ,  "T470" , "no power" ,   "none"  , "pw", "{\"osversion\": \"Windows 10\"}"
 // ============================================================================================================================
 func init_ticket(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
 	var err error
 	fmt.Println("starting init_ticket")
 
-	if len(args) != 16 {
-		return shim.Error("Incorrect number of arguments. Expecting 16")
+	if len(args) != 13 && len(args) != 14 {
+		return shim.Error("Incorrect number of arguments. Expecting 13 or 14")
 	}
 
 	//input sanitation
-	err = sanitize_arguments(args)
+	err = sanitize_arguments(args[:13])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	ticket_id := args[0]
-	description := args[1]
-	date := args[2]
-	status := args[3]
-	ticketowner := args[4]
-	assignee := args[5]
-	asset := args[6]
-	queue := args[7]
-	address := args[8]
-	descriptionproduct := args[9]
-	prod := args[10]
-	diagnostic := args[11]
-	hardwarepw := args[12]
-	ospw := args[13]
-	contactphone := args[14]
-	contactemail := args[15]
+	//build the ticket from the arguments, create_ticket checks and stores it
+	var ticket Ticket
+	ticket.Ticket_Id = args[0]
+	ticket.Description = args[1]
+	ticket.Date = args[2]
+	ticket.Status = args[3]
+	ticket.TicketOwner = args[4]
+	ticket.Assignee.Employee_sn = args[5]
+	ticket.Asset = args[6]
+	ticket.Queue = args[7]
+	ticket.DescriptionProduct = args[8]
+	ticket.Prod = args[9]
+	ticket.Diagnostic = args[10]
+	ticket.HardwarePw = args[11]
+	ticket.OsPw = args[12]
+	if len(args) == 14 && len(args[13]) > 0 {
+		err = json.Unmarshal([]byte(args[13]), &ticket.CustomFields)
+		if err != nil {
+			return shim.Error("Custom fields must be a JSON object - " + err.Error())
+		}
+	}
 
-	//check if owner exists
-	employee, err := get_employee(stub, ticketowner)
+	//contact details come in through the transient map
+	pii, salt, hasPii, err := get_transient_pii(stub, "ticket")
 	if err != nil {
-		fmt.Println("Failed to find employee - " + ticketowner)
 		return shim.Error(err.Error())
 	}
+	if !hasPii {
+		pii = nil
+	}
 
-	//check if ticket id already exists
-	ticket, err := get_ticket(stub, ticket_id)
-	if err == nil {
-		fmt.Println("This ticket already exists - " + ticket_id)
-		fmt.Println(ticket)
-		return shim.Error("This ticket already exists - " + ticket_id)  //all stop a ticket by this id exists
-	}
-
-	//build the ticket json string manually
-	str := `{
-		"docType":"ticket", 
-		"ticket_id": "` + ticket.Ticket_Id + `", 
-		"description": "` + description + `", 
-		"date": "` + date + `", 
-		"status": "` + status + `",
-		"ticketowner": "` + employee.Employee_sn + `",
-		"assignee": "` + assignee + `",
-		"asset": "` + asset + `",
-		"queue": "` + queue + `",
-		"address": "` + address + `",
-		"descriptionproduct": "` + descriptionproduct + `",
-		"prod": "` + prod + `",
-		"diagnostic": "` + diagnostic + `",
-		"hardwarepw": "` + hardwarepw + `",
-		"ospw": "` + ospw + `",
-		"contactphone": "` + contactphone + `",
-		"contactemail": "` + contactemail + `"
-	}`
-	err = stub.PutState(ticket.Ticket_Id, []byte(str)) 	//store ticket with id as key
+	//the owner's company must be the caller's before any of its tickets are looked at
+	owner, err := get_employee(stub, ticket.TicketOwner)
+	if err != nil {
+		fmt.Println("Failed to find employee - " + ticket.TicketOwner)
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, owner.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//look for an open ticket this one duplicates
+	check, err := find_duplicates(stub, ticket, owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(check.Duplicates) > 0 {
+		switch check.Action {
+		case DUPLICATE_REJECT:
+			return shim.Error("Ticket looks like a duplicate of " + check.Duplicates[0].Ticket_Id)
+		case DUPLICATE_LINK:
+			ticket.DuplicateOf = check.Duplicates[0].Ticket_Id
+		}
+	}
+
+	_, err = create_ticket(stub, ticket, salt, pii)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	fmt.Println("- end init_ticket")
-	return shim.Success(nil)
+	if len(check.Duplicates) == 0 {
+		return shim.Success(nil)
+	}
+	checkAsBytes, _ := json.Marshal(check)                      //convert to array of bytes
+	return shim.Success(checkAsBytes)
+}
+
+// open tickets of the owner's company on the same asset or from the same owner, recent and with similar text
+func find_duplicates(stub shim.ChaincodeStubInterface, draft Ticket, owner Employee) (DuplicateCheck, error) {
+	check := DuplicateCheck{Ticket_Id: draft.Ticket_Id}
+	check.Action = get_config_string(stub, "duplicate_action", draft.Queue, DUPLICATE_OFF)
+	if check.Action == DUPLICATE_OFF {
+		return check, nil
+	}
+
+	now, err := get_tx_datetime(stub)
+	if err != nil {
+		return check, err
+	}
+	windowHours := get_config_number(stub, "duplicate_window_hours", draft.Queue, 72)
+	threshold := get_config_number(stub, "duplicate_similarity", "", 0.5)
+
+	//candidates come from the owner and asset indexes, the same asset wins as the reason
+	reasons := map[string]string{}
+	ids, err := get_ticket_ids_by(stub, TICKET_OWNER_INDEX, owner.Employee_sn)
+	if err != nil {
+		return check, err
+	}
+	for _, id := range ids {
+		reasons[id] = "same owner"
+	}
+	if len(draft.Asset) > 0 {
+		ids, err = get_ticket_ids_by(stub, TICKET_ASSET_INDEX, draft.Asset)
+		if err != nil {
+			return check, err
+		}
+		for _, id := range ids {
+			reasons[id] = "same asset"
+		}
+	}
+	candidates := make([]string, 0, len(reasons))
+	for id := range reasons {
+		candidates = append(candidates, id)
+	}
+	sort.Strings(candidates)
+
+	words := ticket_words(draft)
+	for _, id := range candidates {
+		ticket, err := get_ticket(stub, id)
+		if err != nil {
+			continue                                            //stale entry, nothing to compare
+		}
+		if ticket.Company != owner.Company || is_resolved_status(ticket.Status) {
+			continue
+		}
+		if windowHours > 0 {
+			openedOn, err := ticket_opened_on(ticket)
+			if err != nil || now.Sub(openedOn).Hours() > windowHours {
+				continue
+			}
+		}
+		score := similarity(words, ticket_words(ticket))
+		if score >= threshold {
+			check.Duplicates = append(check.Duplicates, Duplicate{ticket.Ticket_Id, reasons[id], score})
+		}
+	}
+	sort.SliceStable(check.Duplicates, func(i, j int) bool {
+		return check.Duplicates[i].Similarity > check.Duplicates[j].Similarity
+	})
+	return check, nil
+}
+
+// check a new ticket and store it, the path every ticket is opened through. Personal data is stored when pii is not nil
+func create_ticket(stub shim.ChaincodeStubInterface, draft Ticket, salt string, pii map[string]string) (Ticket, error) {
+	var ticket Ticket
+	var err error
+
+	//check if owner exists, the ticket belongs to the owner's company
+	employee, err := get_employee(stub, draft.TicketOwner)
+	if err != nil {
+		fmt.Println("Failed to find employee - " + draft.TicketOwner)
+		return ticket, err
+	}
+	err = check_tenant(stub, employee.Company)
+	if err != nil {
+		return ticket, err
+	}
+
+	//check if assignee can take the ticket
+	assigneeEmployee, err := get_employee(stub, draft.Assignee.Employee_sn)
+	if err != nil {
+		fmt.Println("Failed to find employee - " + draft.Assignee.Employee_sn)
+		return ticket, err
+	}
+	err = can_take_assignment(assigneeEmployee)
+	if err != nil {
+		return ticket, err
+	}
+	err = can_work_for(assigneeEmployee, employee.Company)
+	if err != nil {
+		return ticket, err
+	}
+
+	//check the queue is one of the channel's queues
+	queues := get_config_list(stub, "queues", "", nil)
+	if queues != nil && !contains(queues, draft.Queue) {
+		return ticket, errors.New("Unknown queue - " + draft.Queue)
+	}
+
+	//only the owner's sign-off closes a ticket
+	if normalize_status(draft.Status) == STATUS_CLOSED {
+		return ticket, errors.New("A new ticket cannot start closed - " + draft.Ticket_Id)
+	}
+
+	//check the asset can take a new ticket
+	ibmasset, err := get_ibmasset(stub, draft.Asset)
+	assetKnown := err == nil
+	if assetKnown && asset_status(ibmasset) == ASSET_RETIRED {
+		return ticket, errors.New("Asset is retired, no new tickets allowed - " + draft.Asset)
+	}
+	if assetKnown && ibmasset.Company != employee.Company {
+		return ticket, errors.New("Asset belongs to another company - " + draft.Asset)
+	}
+
+	//check the custom fields against the queue's
+	err = validate_custom_fields(stub, draft.Queue, draft.CustomFields)
+	if err != nil {
+		return ticket, err
+	}
+
+	//check if ticket id already exists
+	existing, err := get_ticket(stub, draft.Ticket_Id)
+	if err == nil {
+		fmt.Println("This ticket already exists - " + draft.Ticket_Id)
+		fmt.Println(existing)
+		return ticket, errors.New("This ticket already exists - " + draft.Ticket_Id)  //all stop a ticket by this id exists
+	}
+
+	//build the ticket
+	ticket = draft
+	ticket.ObjectType = "ticket"
+	ticket.Company = employee.Company
+	ticket.TicketOwner = employee.Employee_sn
+	ticket.Assignee.Fullname = assigneeEmployee.Fullname
+	ticket.PersonalData = PiiReference{Subject: employee.Employee_sn}
+	ticket.OpenedOn, err = get_tx_time(stub)
+	if err != nil {
+		return ticket, err
+	}
+	if pii != nil {
+		ticket.PersonalData, err = put_personal_data(stub, employee.Employee_sn, "ticket", ticket.Ticket_Id, salt, pii)
+		if err != nil {
+			return ticket, err
+		}
+	}
+
+	//start the ticket with the diagnostic checklist of the asset type
+	if assetKnown {
+		template, found, err := get_checklist_template(stub, ibmasset.AssetType)
+		if err != nil {
+			return ticket, err
+		}
+		if found {
+			for _, item := range template.Items {
+				if !has_checklist_item(ticket, item.Name) {
+					ticket.Checklist = append(ticket.Checklist, ChecklistItem{Name: item.Name, Mandatory: item.Mandatory})
+				}
+			}
+		}
+	}
+
+	//check warranty, out of warranty hardware repairs go to billing
+	if assetKnown {
+		entitlement, routedQueue, err := check_entitlement(stub, ibmasset, draft.Queue)
+		if err != nil {
+			return ticket, err
+		}
+		ticket.Entitlement = &entitlement
+		ticket.Queue = routedQueue
+	}
+
+	ticketAsBytes, _ := json.Marshal(ticket)                    //convert to array of bytes
+	err = stub.PutState(ticket.Ticket_Id, ticketAsBytes) 	//store ticket with id as key
+	if err != nil {
+		return ticket, err
+	}
+	err = index_ticket(stub, Ticket{}, ticket)
+	if err != nil {
+		return ticket, err
+	}
+	err = put_ticket_lookup(stub, ticket)
+	if err != nil {
+		return ticket, err
+	}
+
+	//customer tickets need the customer's and the provider's endorsement from here on
+	err = set_endorsement_orgs(stub, ticket.Ticket_Id, default_endorsement_orgs(stub, ticket.Company))
+	if err != nil {
+		return ticket, err
+	}
+
+	//hardware tickets take a deployed asset into repair
+	if assetKnown && is_hardware_queue(draft.Queue) && asset_status(ibmasset) == ASSET_DEPLOYED {
+		_, err = set_asset_status(stub, ibmasset, ASSET_IN_REPAIR)
+		if err != nil {
+			return ticket, err
+		}
+	}
+	return ticket, nil
 }
 
 // ============================================================================================================================
@@ -266,17 +674,20 @@ func init_ticket(stub shim.ChaincodeStubInterface, args []string) (pb.Response)
 //
 // Shows off building key's value from GoLang Structure
 //
+// The email address is passed in the transient map under "pii", e.g. {"email": "bob@ibm.com", "salt": "<random>"},
+// and kept in private data with only its salted hash on the employee.
+//
 // Inputs - Array of Strings
-//           0     ,     1   ,   2
-//      owner id   , username, company
-// "o9999999999999",     bob", "united marbles"
+//           0     ,     1
+//      employee id,  fullname
+// "o9999999999999", "Bob Smith"
 // ============================================================================================================================
 func init_employee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	fmt.Println("starting init_employee")
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
 	//input sanitation
@@ -288,10 +699,18 @@ func init_employee(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	var employee Employee
 	employee.ObjectType = "employee"
 	employee.Employee_sn =  args[0]
-	employee.Email = args[1]
-	employee.Fullname = args[2]
+	employee.Fullname = args[1]
+	employee.PersonalData.Subject = employee.Employee_sn
+	employee.Role = ROLE_USER                       //roles are handed out by an admin with set_employee_role
 	fmt.Println(employee)
 
+	//employees belong to the company of the caller's MSP
+	company, err := get_caller_company(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	employee.Company = company.Company_Id
+
 	//check if employee already exists
 	_, err = get_employee(stub, employee.Employee_sn)
 	if err == nil {
@@ -299,6 +718,18 @@ func init_employee(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("This employee already exists - " + employee.Employee_sn)
 	}
 
+	//email goes to private data
+	pii, salt, hasPii, err := get_transient_pii(stub, "employee")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if hasPii {
+		employee.PersonalData, err = put_personal_data(stub, employee.Employee_sn, "employee", employee.Employee_sn, salt, pii)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	//store employee
 	employeeAsBytes, _ := json.Marshal(employee)	//convert to array of bytes
 	err = stub.PutState(employee.Employee_sn, employeeAsBytes)	  //store owner by its Id
@@ -312,21 +743,22 @@ func init_employee(stub shim.ChaincodeStubInterface, args []string) pb.Response
 }
 
 // ============================================================================================================================
-// Init Asset - create a new IBM_Asset and store into chaincode state
+// Update Employee - change the contact details of an employee
 //
-// Shows off building key's value from GoLang Structure
+// Only the employee themselves or an admin may change contact details. A new email address is passed in the transient
+// map under "pii" like for init_employee, without it the stored email is kept.
 //
 // Inputs - Array of Strings
-//           0     ,     1   ,   2
-//      owner id   , username, company
-// "o9999999999999",     bob", "united marbles"
+//           0     ,     1
+//      employee id,  fullname
+// "o9999999999999", "Bob Smith"
 // ============================================================================================================================
-func init_ibmasset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func update_employee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting init_ibmasset")
+	fmt.Println("starting update_employee")
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
 	//input sanitation
@@ -335,48 +767,395 @@ func init_ibmasset(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error(err.Error())
 	}
 
-	var ibmasset IBM_Asset
-	ibmasset.ObjectType = "ibm_asset"
-	ibmasset.SerialNumber =  args[0]
-	ibmasset.AssetType = args[1]
-	ibmasset.Tickets =  args[2]
-	ibmasset.Owner = args[3]
-	fmt.Println(ibmasset)
+	employee, err := get_employee(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, employee.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	//check if asset already exists
-	_, err = get_ibmasset(stub, ibmasset.SerialNumber)
-	if err == nil {
-		fmt.Println("This asset already exists - " + ibmasset.SerialNumber)
-		return shim.Error("This asset already exists - " + ibmasset.SerialNumber)
+	//check the caller may edit this employee
+	if !caller_is_admin(stub) {
+		caller, err := get_caller_employee(stub)
+		if err != nil || caller.Employee_sn != employee.Employee_sn {
+			return shim.Error("Only the employee or an admin can update employee - " + employee.Employee_sn)
+		}
 	}
 
-	//store asset
-	ibmassetAsBytes, _ := json.Marshal(ibmasset)	//convert to array of bytes
-	err = stub.PutState(ibmasset.SerialNumber, ibmassetAsBytes)	  //store asset by its serial number
+	employee.Fullname = args[1]
+
+	pii, salt, hasPii, err := get_transient_pii(stub, "employee")
 	if err != nil {
-		fmt.Println("Could not store asset")
 		return shim.Error(err.Error())
 	}
+	if hasPii {
+		employee.PersonalData, err = put_personal_data(stub, employee.Employee_sn, "employee", employee.Employee_sn, salt, pii)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 
-	fmt.Println("- end init_employee asset")
+	employeeAsBytes, _ := json.Marshal(employee)                 //convert to array of bytes
+	err = stub.PutState(employee.Employee_sn, employeeAsBytes)   //rewrite the employee with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "employee_updated", employee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end update_employee")
 	return shim.Success(nil)
 }
 
 // ============================================================================================================================
-// Set Assignee on Ticket
+// Deactivate Employee - stop an employee from taking new tickets
 //
-// Shows off GetState() and PutState()
+// The employee stays in state so tickets and history that reference them remain intact. Admin only.
 //
 // Inputs - Array of Strings
-//       0     ,        1      ,        2
-//  marble id  ,  to owner id  , company that auth the transfer
-// "m999999999", "o99999999999", united_mables" 
+//           0
+//      employee id
+// "o9999999999999"
 // ============================================================================================================================
-func set_assignee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func deactivate_employee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting set_assignee")
+	fmt.Println("starting deactivate_employee")
 
-	if len(args) != 2 {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can deactivate employees")
+	}
+
+	employee, err := get_employee(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if employee.Deactivated {
+		return shim.Error("Employee is already deactivated - " + employee.Employee_sn)
+	}
+
+	employee.Deactivated = true
+	employee.DeactivatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	employeeAsBytes, _ := json.Marshal(employee)                 //convert to array of bytes
+	err = stub.PutState(employee.Employee_sn, employeeAsBytes)   //rewrite the employee with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "employee_deactivated", employee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end deactivate_employee")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Set Employee Role - assign role, team and skills to an employee
+//
+// Role is one of user, technician, teamlead, support or admin. Support staff work tickets of every company. Skills is
+// a comma separated list and may be empty. Admin only.
+//
+// Inputs - Array of Strings
+//           0     ,      1      ,     2     ,          3
+//      employee id,     role    ,    team   ,       skills
+// "o9999999999999", "technician", "hardware", "thinkpad,windows,network"
+// ============================================================================================================================
+func set_employee_role(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_employee_role")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	//input sanitation - skills may be empty
+	err = sanitize_arguments(args[:3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	role := args[1]
+	if !is_valid_role(role) {
+		return shim.Error("Unknown role - " + role)
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can assign employee roles")
+	}
+
+	employee, err := get_employee(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	employee.Role = role
+	employee.Team = args[2]
+	employee.Skills = split_list(args[3])
+
+	employeeAsBytes, _ := json.Marshal(employee)                 //convert to array of bytes
+	err = stub.PutState(employee.Employee_sn, employeeAsBytes)   //rewrite the employee with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "employee_role_changed", employee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_employee_role")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Init Asset - create a new IBM_Asset and store into chaincode state
+//
+// Shows off building key's value from GoLang Structure
+//
+// Status is optional and may be "in stock" or "deployed", assets are deployed by default.
+//
+// Inputs - Array of Strings
+//        0     ,     1     ,   2    ,        3        ,     4
+//   serial nr  , asset type, tickets,      owner      ,   status
+// "SN12345678" , "thinkpad",  "none", "o9999999999999", "in stock"
+// ============================================================================================================================
+func init_ibmasset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting init_ibmasset")
+
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var ibmasset IBM_Asset
+	ibmasset.ObjectType = "ibm_asset"
+	ibmasset.SerialNumber =  args[0]
+	ibmasset.AssetType = args[1]
+	ibmasset.Tickets =  args[2]
+	ibmasset.Owner = args[3]
+	ibmasset.Status = ASSET_DEPLOYED
+	if len(args) == 5 {
+		ibmasset.Status = args[4]
+	}
+	if ibmasset.Status != ASSET_DEPLOYED && ibmasset.Status != ASSET_IN_STOCK {
+		return shim.Error("New assets must be '" + ASSET_IN_STOCK + "' or '" + ASSET_DEPLOYED + "'")
+	}
+	fmt.Println(ibmasset)
+
+	//assets belong to the company of the caller's MSP
+	company, err := get_caller_company(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ibmasset.Company = company.Company_Id
+
+	//check if asset already exists
+	_, err = get_ibmasset(stub, ibmasset.SerialNumber)
+	if err == nil {
+		fmt.Println("This asset already exists - " + ibmasset.SerialNumber)
+		return shim.Error("This asset already exists - " + ibmasset.SerialNumber)
+	}
+
+	//store asset
+	ibmassetAsBytes, _ := json.Marshal(ibmasset)	//convert to array of bytes
+	err = stub.PutState(ibmasset.SerialNumber, ibmassetAsBytes)	  //store asset by its serial number
+	if err != nil {
+		fmt.Println("Could not store asset")
+		return shim.Error(err.Error())
+	}
+
+	//customer assets need the customer's and the provider's endorsement from here on
+	err = set_endorsement_orgs(stub, ibmasset.SerialNumber, default_endorsement_orgs(stub, ibmasset.Company))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end init_employee asset")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Update Asset - change the optional attributes of an IBM_Asset
+//
+// Attributes is a JSON object with any of manufacturer, model, purchasedate, warrantyend, location, site and
+// costcentre. Attributes left out are unchanged, an empty string clears one. Dates are YYYY-MM-DD.
+//
+// Inputs - Array of Strings
+//        0     ,                        1
+//   serial nr  ,                    attributes
+// "SN12345678" , "{\"model\": \"T470\", \"warrantyend\": \"2020-06-30\", \"site\": \"MOP\"}"
+// ============================================================================================================================
+func update_ibmasset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting update_ibmasset")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ibmasset, err := get_ibmasset(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ibmasset.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var attributes AssetAttributes
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[1])))
+	decoder.DisallowUnknownFields()                             //catch misspelled attributes
+	err = decoder.Decode(&attributes)
+	if err != nil {
+		return shim.Error("Failed to parse asset attributes - " + err.Error())
+	}
+
+	apply_asset_attributes(&ibmasset, attributes)
+	err = validate_asset_attributes(ibmasset)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ibmassetAsBytes, _ := json.Marshal(ibmasset)                 //convert to array of bytes
+	err = stub.PutState(ibmasset.SerialNumber, ibmassetAsBytes)  //rewrite the asset with serial number as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end update_ibmasset")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Set Asset Status - move an IBM_Asset along its lifecycle
+//
+// Allowed moves are in stock -> deployed, deployed -> in stock/in repair, in repair -> deployed/in stock and anything
+// to retired. Retired assets never come back.
+//
+// Inputs - Array of Strings
+//        0     ,     1
+//   serial nr  ,   status
+// "SN12345678" , "in stock"
+// ============================================================================================================================
+func set_ibmasset_status(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_ibmasset_status")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ibmasset, err := get_ibmasset(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ibmasset.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = set_asset_status(stub, ibmasset, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_ibmasset_status")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Retire Asset - take an IBM_Asset out of service for good, no new tickets can be opened against it
+//
+// Inputs - Array of Strings
+//        0
+//   serial nr
+// "SN12345678"
+// ============================================================================================================================
+func retire_asset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting retire_asset")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	//input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ibmasset, err := get_ibmasset(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ibmasset.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = set_asset_status(stub, ibmasset, ASSET_RETIRED)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end retire_asset")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Set Assignee on Ticket
+//
+// Shows off GetState() and PutState()
+//
+// Inputs - Array of Strings
+//       0     ,        1      ,        2
+//  marble id  ,  to owner id  , company that auth the transfer
+// "m999999999", "o99999999999", united_mables" 
+// ============================================================================================================================
+func set_assignee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_assignee")
+
+	if len(args) != 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
@@ -396,16 +1175,29 @@ func set_assignee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error("This employee does not exist - " + assignee)
 	}
 
+	// check if user can take new tickets
+	err = can_take_assignment(employee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// get ticket's current state
-	ticketAsBytes, err := stub.GetState(ticket_id)
+	res, err := get_ticket(stub, ticket_id)
 	if err != nil {
 		return shim.Error("Failed to get ticket")
 	}
-	res := Ticket{}
-	json.Unmarshal(ticketAsBytes, &res)           //un stringify it aka JSON.parse()
+	err = check_tenant(stub, res.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = can_work_for(employee, res.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// set assignee
 	res.Assignee.Employee_sn = employee.Employee_sn                   //change the assignee
+	res.Assignee.Fullname = employee.Fullname
 	jsonAsBytes, _ := json.Marshal(res)           //convert to array of bytes
 	err = stub.PutState(args[0], jsonAsBytes)     //rewrite the ticket with id as key
 	if err != nil {
@@ -415,3 +1207,2443 @@ func set_assignee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	fmt.Println("- end set assignee")
 	return shim.Success(nil)
 }
+
+
+// ============================================================================================================================
+// Set Ticket Status
+//
+// Status is one of the ticket statuses in the catalogue except resolved and closed. Tickets are only resolved by the
+// assignee asking the owner's sign-off with request_customer_signoff, and only closed by the owner accepting it.
+// Reopening a ticket waiting for sign-off withdraws it and takes a hardware ticket's asset back into repair. A closed
+// ticket's status is final, only an admin can reopen it.
+//
+// Inputs - Array of Strings
+//       0     ,     1
+//   ticket id ,   status
+// "m999999999", "resolved"
+// ============================================================================================================================
+func set_ticket_status(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_ticket_status")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	status := normalize_status(args[1])
+	if !is_valid_status(stub, status) {
+		return shim.Error("Unknown ticket status - " + args[1])
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if status == STATUS_CLOSED {
+		return shim.Error("Tickets are closed by their owner accepting the resolution, use request_customer_signoff - " + ticket.Ticket_Id)
+	}
+	if status == STATUS_RESOLVED {
+		return shim.Error("Tickets are resolved by asking their owner's sign-off, use request_customer_signoff - " + ticket.Ticket_Id)
+	}
+	if normalize_status(ticket.Status) == STATUS_CLOSED && !caller_is_admin(stub) {
+		return shim.Error("Only an admin can reopen a closed ticket - " + ticket.Ticket_Id)
+	}
+	signoff := pending_signoff(ticket)
+	if signoff != nil {
+		signoff.Outcome = SIGNOFF_WITHDRAWN                     //reopened before the owner answered
+		signoff.AnsweredBy = caller_identity(stub)
+		signoff.AnsweredOn, err = get_tx_time(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	_, err = change_ticket_status(stub, ticket, status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_ticket_status")
+	return shim.Success(nil)
+}
+
+// store the ticket with its new status and move a hardware ticket's asset in or out of repair with it
+func change_ticket_status(stub shim.ChaincodeStubInterface, ticket Ticket, status string) (Ticket, error) {
+	var err error
+	wasResolved := is_resolved_status(ticket.Status)
+
+	if is_resolved_status(status) && !wasResolved {
+		open := open_mandatory_items(ticket)
+		if len(open) > 0 {
+			return ticket, errors.New("Ticket " + ticket.Ticket_Id + " has unchecked mandatory checklist items - " + strings.Join(open, ", "))
+		}
+	}
+
+	ticket.Status = status
+	if is_resolved_status(status) && !wasResolved {
+		cost, err := compute_ticket_cost(stub, ticket.Ticket_Id)   //total cost on resolution
+		if err != nil {
+			return ticket, err
+		}
+		ticket.Cost = &cost
+	}
+	ticket.ClosedOn = ""
+	ticket.ChargedTo = nil
+	if status == STATUS_CLOSED {
+		ticket.ClosedOn, err = get_tx_time(stub)                //retention counts from here
+		if err != nil {
+			return ticket, err
+		}
+		chargedTo := ticket_charged_to(stub, ticket)            //billing goes to the asset's cost centre as it is now
+		ticket.ChargedTo = &chargedTo
+	}
+	ticketAsBytes, _ := json.Marshal(ticket)                    //convert to array of bytes
+	err = stub.PutState(ticket.Ticket_Id, ticketAsBytes)       //rewrite the ticket with id as key
+	if err != nil {
+		return ticket, err
+	}
+
+	// move the asset in or out of repair with the ticket
+	if is_hardware_ticket(ticket) && wasResolved != is_resolved_status(status) {
+		ibmasset, err := get_ibmasset(stub, ticket.Asset)
+		if err == nil {
+			current := asset_status(ibmasset)
+			if !wasResolved && current == ASSET_IN_REPAIR {
+				_, err = set_asset_status(stub, ibmasset, ASSET_DEPLOYED)
+			} else if wasResolved && current == ASSET_DEPLOYED {
+				_, err = set_asset_status(stub, ibmasset, ASSET_IN_REPAIR)
+			}
+			if err != nil {
+				return ticket, err
+			}
+		}
+	}
+	return ticket, nil
+}
+
+
+// ============================================================================================================================
+// Set Endorsement Policy - change the orgs that must endorse changes to a ticket or asset. Admin only.
+//
+// Orgs is a comma separated list of MSP ids, every one of them has to endorse. "default" puts back the policy the
+// object got on creation, "none" removes the key level policy so the chaincode endorsement policy applies again.
+//
+// Inputs - Array of Strings
+//       0     ,       1     ,          2
+//  object type,      id     ,         orgs
+//    "ticket" , "m999999999", "Org1MSP,ProviderMSP"
+// ============================================================================================================================
+func set_endorsement_policy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var orgs []string
+	var company string
+	var err error
+	fmt.Println("starting set_endorsement_policy")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can change endorsement policies")
+	}
+
+	objectType := args[0]
+	id := args[1]
+	switch objectType {
+	case "ticket":
+		ticket, err := get_ticket(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		company = ticket.Company
+	case "ibm_asset":
+		ibmasset, err := get_ibmasset(stub, id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		company = ibmasset.Company
+	default:
+		return shim.Error("Endorsement policies can be set on 'ticket' and 'ibm_asset' only")
+	}
+
+	switch args[2] {
+	case "default":
+		orgs = default_endorsement_orgs(stub, company)
+	case "none":
+		orgs = nil
+	default:
+		orgs = split_list(args[2])
+	}
+
+	err = set_endorsement_orgs(stub, id, orgs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "endorsement_policy_changed", map[string]interface{}{"docType": objectType, "id": id, "orgs": orgs})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_endorsement_policy")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Erase Personal Data - right to erasure, purge every private personal data record of a data subject
+//
+// Shows Off DelPrivateData() - the clear values are gone from the collection while the salted hashes stay on the public
+// documents, so the ticket history can still be checked against values someone kept. The public documents are marked
+// as erased. Only the data subject themselves or an admin may erase.
+//
+// Inputs - Array of Strings
+//         0
+//      subject
+// "o9999999999999"
+// ============================================================================================================================
+func erase_personal_data(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Erasure struct {
+		Subject  string   `json:"subject"`
+		Records  []string `json:"records"`
+		ErasedOn string   `json:"erasedon"`
+	}
+	var erasure Erasure
+	var err error
+	fmt.Println("starting erase_personal_data")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	erasure.Subject = args[0]
+	subject, err := get_employee(stub, erasure.Subject)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, subject.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller_is_admin(stub) {
+		caller, err := get_caller_employee(stub)
+		if err != nil || caller.Employee_sn != subject.Employee_sn {
+			return shim.Error("Only the data subject or an admin can erase personal data - " + subject.Employee_sn)
+		}
+	}
+
+	erasure.ErasedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// collect the subject's records first, then delete them
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(COLLECTION_PII, PII_INDEX, []string{erasure.Subject})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var keys []string
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return shim.Error(err.Error())
+		}
+		keys = append(keys, pointer.GetKey())
+	}
+	resultsIterator.Close()
+
+	for _, key := range keys {
+		_, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		recordType, recordId := attributes[1], attributes[2]
+
+		err = stub.DelPrivateData(COLLECTION_PII, key)      //purge the clear values
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = mark_personal_data_erased(stub, recordType, recordId, erasure.ErasedOn, ERASED_ON_REQUEST)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		erasure.Records = append(erasure.Records, recordType + " " + recordId)
+	}
+
+	// clear values from before schema version 3 that were never moved to private data go as well
+	legacyRecords, err := get_legacy_personal_data(stub, erasure.Subject)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, legacy := range legacyRecords {
+		key, err := legacy_pii_key(stub, legacy)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = mark_personal_data_erased(stub, legacy.RecordType, legacy.RecordId, erasure.ErasedOn, ERASED_ON_REQUEST)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		erasure.Records = append(erasure.Records, legacy.RecordType + " " + legacy.RecordId)
+	}
+
+	err = emit_event(stub, "personal_data_erased", erasure)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	erasureAsBytes, _ := json.Marshal(erasure)                //convert to array of bytes
+	fmt.Println("- end erase_personal_data")
+	return shim.Success(erasureAsBytes)
+}
+
+// flag the public document behind an erased personal data record, its hashes stay
+func mark_personal_data_erased(stub shim.ChaincodeStubInterface, recordType string, recordId string, erasedOn string, reason string) error {
+	switch recordType {
+	case "ticket":
+		ticket, err := get_ticket(stub, recordId)
+		if err != nil {
+			return nil                                          //ticket was deleted, nothing to flag
+		}
+		ticket.PersonalData.ErasedOn = erasedOn
+		ticket.PersonalData.Reason = reason
+		ticketAsBytes, _ := json.Marshal(ticket)
+		return stub.PutState(ticket.Ticket_Id, ticketAsBytes)
+	case "employee":
+		employee, err := get_employee(stub, recordId)
+		if err != nil {
+			return nil                                          //employee was deleted, nothing to flag
+		}
+		employee.PersonalData.ErasedOn = erasedOn
+		employee.PersonalData.Reason = reason
+		employeeAsBytes, _ := json.Marshal(employee)
+		return stub.PutState(employee.Employee_sn, employeeAsBytes)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Migrate Personal Data - move the clear personal fields the schema version 3 migration took off tickets and employees
+// into private data
+//
+// Shows Off PutPrivateData() outside of Init - private data cannot be written while the chaincode is upgraded, so the
+// migration parks the fields and this invoke finishes the job. A secret salt of at least 16 characters is passed in the
+// transient map under "pii", e.g. {"salt": "<random>"}. Each record is salted with hex sha256(salt + doctype + " " + id)
+// so every endorser computes the same hashes. Admin only. Max is optional and limits how many records one
+// transaction migrates.
+//
+// Inputs - Array of Strings
+//    0
+//   max
+//  "100"
+// ============================================================================================================================
+func migrate_personal_data(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var migrated []string
+	var err error
+	max := -1
+	fmt.Println("starting migrate_personal_data")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 1 {
+		max, err = strconv.Atoi(args[0])
+		if err != nil || max <= 0 {
+			return shim.Error("Max must be a positive number - " + args[0])
+		}
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can migrate personal data")
+	}
+
+	//the salt is the only entry allowed, no record type has personal fields called "legacy"
+	_, salt, found, err := get_transient_pii(stub, "legacy")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Expecting the salt in the transient map under 'pii'")
+	}
+
+	records, err := get_legacy_personal_data(stub, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, legacy := range records {
+		if max >= 0 && len(migrated) >= max {
+			break
+		}
+		recordSalt := hash_pii(salt, legacy.RecordType + " " + legacy.RecordId)
+
+		switch legacy.RecordType {
+		case "ticket":
+			ticket, err := get_ticket(stub, legacy.RecordId)
+			if err == nil {                                     //a deleted ticket keeps nothing
+				ticket.PersonalData, err = put_personal_data(stub, legacy.Subject, "ticket", ticket.Ticket_Id, recordSalt, legacy.Fields)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				ticketAsBytes, _ := json.Marshal(ticket)        //convert to array of bytes
+				err = stub.PutState(ticket.Ticket_Id, ticketAsBytes)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		case "employee":
+			employee, err := get_employee(stub, legacy.RecordId)
+			if err == nil {                                     //a deleted employee keeps nothing
+				employee.PersonalData, err = put_personal_data(stub, legacy.Subject, "employee", employee.Employee_sn, recordSalt, legacy.Fields)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				employeeAsBytes, _ := json.Marshal(employee)    //convert to array of bytes
+				err = stub.PutState(employee.Employee_sn, employeeAsBytes)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		}
+
+		key, err := legacy_pii_key(stub, legacy)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.DelState(key)                                //the clear values leave world state
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		migrated = append(migrated, legacy.RecordType + " " + legacy.RecordId)
+	}
+
+	err = emit_event(stub, "personal_data_migrated", migrated)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	migratedAsBytes, _ := json.Marshal(migrated)              //convert to array of bytes
+	fmt.Println("- end migrate_personal_data")
+	return shim.Success(migratedAsBytes)
+}
+
+// ============================================================================================================================
+// Purge Expired Tickets - purge the personal details of closed tickets whose queue's retention window has passed
+//
+// Shows Off DelPrivateData() - the queue's retention_years counts from the day the ticket was closed. The ticket itself
+// and its hashes stay, it is marked as erased by the retention policy. Admin only. Max is optional and limits how many
+// tickets one transaction purges.
+//
+// Inputs - Array of Strings
+//    0
+//   max
+//  "100"
+// ============================================================================================================================
+func purge_expired_tickets(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var purged []string
+	var err error
+	max := -1
+	fmt.Println("starting purge_expired_tickets")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 1 {
+		max, err = strconv.Atoi(args[0])
+		if err != nil || max <= 0 {
+			return shim.Error("Max must be a positive number - " + args[0])
+		}
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can purge tickets")
+	}
+
+	now, err := get_tx_datetime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	purgedOn := now.Format(time.RFC3339)
+
+	tickets, err := get_all_tickets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, ticket := range tickets {
+		if max >= 0 && len(purged) >= max {
+			break
+		}
+		if len(ticket.PersonalData.ErasedOn) > 0 {
+			continue                                            //already gone
+		}
+		due, _, ok := get_retention_due(stub, ticket)
+		if !ok || now.Before(due) {
+			continue
+		}
+
+		key, err := pii_key(stub, ticket.PersonalData.Subject, "ticket", ticket.Ticket_Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.DelPrivateData(COLLECTION_PII, key)          //purge the clear values
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = mark_personal_data_erased(stub, "ticket", ticket.Ticket_Id, purgedOn, ERASED_BY_RETENTION)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		purged = append(purged, ticket.Ticket_Id)
+	}
+
+	err = emit_event(stub, "tickets_purged", purged)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	purgedAsBytes, _ := json.Marshal(purged)                  //convert to array of bytes
+	fmt.Println("- end purge_expired_tickets")
+	return shim.Success(purgedAsBytes)
+}
+
+
+// ============================================================================================================================
+// Add Ticket Attachment - anchor a photo, log or signed work order on a ticket
+//
+// Shows Off CreateCompositeKey() - the file stays off chain, the ledger keeps its SHA-256 hash and where it is stored.
+// Attachments cannot be replaced, a changed file is attached again under a new id.
+//
+// Inputs - Array of strings
+//       0     ,       1      ,     2      ,      3     ,   4    ,      5      ,              6
+//   ticket id , attachment id,  filename  ,  mime type ,  size  ,   sha256    ,         storage uri
+// "m999999999",    "photo1"  , "board.jpg", "image/jpeg", "52311", "9f86d08...", "s3://tickets/m999999999/board.jpg"
+// ============================================================================================================================
+func add_ticket_attachment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var attachment Attachment
+	var err error
+	fmt.Println("starting add_ticket_attachment")
+
+	if len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 7")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check if the attachment id is taken
+	_, found, err := get_attachment(stub, ticket.Ticket_Id, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		return shim.Error("This attachment already exists - " + args[1])
+	}
+
+	attachment.ObjectType = "attachment"
+	attachment.Ticket_Id = ticket.Ticket_Id
+	attachment.Attachment_Id = args[1]
+	attachment.Filename = args[2]
+	attachment.MimeType = strings.ToLower(args[3])
+	if !strings.Contains(attachment.MimeType, "/") {
+		return shim.Error("Expecting a MIME type like image/jpeg - " + args[3])
+	}
+	attachment.Size, err = strconv.ParseInt(args[4], 10, 64)
+	if err != nil || attachment.Size < 0 {
+		return shim.Error("Size must be a number of bytes - " + args[4])
+	}
+	attachment.Sha256, err = normalize_sha256(args[5])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	attachment.StorageUri = args[6]
+	attachment.Uploader = caller_identity(stub)
+	attachment.UploadedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(ATTACHMENT_INDEX, []string{attachment.Ticket_Id, attachment.Attachment_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	attachmentAsBytes, _ := json.Marshal(attachment)          //convert to array of bytes
+	err = stub.PutState(key, attachmentAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "attachment_added", attachment)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end add_ticket_attachment")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Request Customer Signoff - resolve a ticket and ask its owner to accept the resolution
+//
+// Only the assignee, or an admin, can ask. The ticket is resolved and a pending sign-off is added to the ticket, the
+// owner then answers with accept_resolution or reject_resolution. Past sign-offs are never changed.
+//
+// Inputs - Array of Strings
+//       0     ,          1
+//   ticket id ,     resolution
+// "m999999999", "replaced the fan"
+// ============================================================================================================================
+func request_customer_signoff(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var signoff Signoff
+	var err error
+	fmt.Println("starting request_customer_signoff")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller_is_admin(stub) {
+		caller, err := get_caller_employee(stub)
+		if err != nil || caller.Employee_sn != ticket.Assignee.Employee_sn {
+			return shim.Error("Only the assignee or an admin can ask for sign-off - " + ticket.Ticket_Id)
+		}
+	}
+	if normalize_status(ticket.Status) == STATUS_CLOSED {
+		return shim.Error("Ticket is already closed - " + ticket.Ticket_Id)
+	}
+	if pending_signoff(ticket) != nil {
+		return shim.Error("Ticket is already waiting for its owner's sign-off - " + ticket.Ticket_Id)
+	}
+
+	signoff.Resolution = args[1]
+	signoff.Outcome = SIGNOFF_PENDING
+	signoff.RequestedBy = caller_identity(stub)
+	signoff.RequestedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ticket.Signoffs = append(ticket.Signoffs, signoff)
+
+	ticket, err = change_ticket_status(stub, ticket, STATUS_RESOLVED)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "signoff_requested", ticket)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end request_customer_signoff")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Accept Resolution - the ticket's owner accepts the resolution, which closes the ticket
+//
+// Inputs - Array of Strings
+//       0     ,       1
+//   ticket id ,    comment
+// "m999999999", "works again"
+// ============================================================================================================================
+func accept_resolution(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting accept_resolution")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting ticket id and optional comment")
+	}
+
+	comment := ""
+	if len(args) == 2 {
+		comment = args[1]
+	}
+	return answer_signoff(stub, args[0], SIGNOFF_ACCEPTED, comment)
+}
+
+// ============================================================================================================================
+// Reject Resolution - the ticket's owner rejects the resolution, which reopens the ticket
+//
+// Inputs - Array of Strings
+//       0     ,          1
+//   ticket id ,        reason
+// "m999999999", "still overheating"
+// ============================================================================================================================
+func reject_resolution(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting reject_resolution")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting ticket id and reason")
+	}
+	return answer_signoff(stub, args[0], SIGNOFF_REJECTED, args[1])
+}
+
+// record the owner's answer on the pending sign-off and close or reopen the ticket
+func answer_signoff(stub shim.ChaincodeStubInterface, ticketId string, outcome string, comment string) pb.Response {
+	var err error
+
+	// input sanitation
+	err = sanitize_arguments([]string{ticketId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if outcome == SIGNOFF_REJECTED && len(strings.TrimSpace(comment)) == 0 {
+		return shim.Error("A reason is required to reject a resolution")
+	}
+
+	ticket, err := get_ticket(stub, ticketId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// only the owner's own identity can answer, admins included
+	caller, err := get_caller_employee(stub)
+	if err != nil || caller.Employee_sn != ticket.TicketOwner {
+		return shim.Error("Only the ticket's owner can answer its sign-off - " + ticket.Ticket_Id)
+	}
+
+	signoff := pending_signoff(ticket)
+	if signoff == nil {
+		return shim.Error("Ticket is not waiting for sign-off - " + ticket.Ticket_Id)
+	}
+	signoff.Outcome = outcome
+	signoff.Comment = comment
+	signoff.AnsweredBy = caller.Employee_sn
+	signoff.AnsweredOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	status := STATUS_CLOSED
+	if outcome == SIGNOFF_REJECTED {
+		status = STATUS_IN_PROGRESS                             //back to the assignee
+	}
+	ticket, err = change_ticket_status(stub, ticket, status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "signoff_" + outcome, ticket)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end " + outcome + " sign-off")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Submit Csat - the ticket's owner rates a closed ticket from 1 to 5
+//
+// One rating per ticket, within csat_window_days of the ticket's queue after it was closed.
+//
+// Inputs - Array of Strings
+//       0     ,  1   ,        2
+//   ticket id , score,     comment
+// "m999999999",  "4" , "quick and friendly"
+// ============================================================================================================================
+func submit_csat(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var csat Csat
+	var err error
+	fmt.Println("starting submit_csat")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting ticket id, score and optional comment")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args[:2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := get_caller_employee(stub)
+	if err != nil || caller.Employee_sn != ticket.TicketOwner {
+		return shim.Error("Only the ticket's owner can rate it - " + ticket.Ticket_Id)
+	}
+	if normalize_status(ticket.Status) != STATUS_CLOSED {
+		return shim.Error("Only closed tickets can be rated - " + ticket.Ticket_Id)
+	}
+
+	csat.Score, err = strconv.Atoi(args[1])
+	if err != nil || csat.Score < 1 || csat.Score > 5 {
+		return shim.Error("Score must be a whole number from 1 to 5 - " + args[1])
+	}
+	if len(args) == 3 {
+		csat.Comment = args[2]
+	}
+
+	// one rating per ticket
+	_, found, err := get_csat(stub, ticket.Ticket_Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		return shim.Error("This ticket was already rated - " + ticket.Ticket_Id)
+	}
+
+	// within the queue's window
+	now, err := get_tx_datetime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	windowDays := get_config_number(stub, "csat_window_days", ticket.Queue, 30)
+	if windowDays > 0 {
+		closedOn, err := time.Parse(time.RFC3339, ticket.ClosedOn)
+		if err == nil && now.After(closedOn.Add(time.Duration(windowDays * 24) * time.Hour)) {
+			return shim.Error("The rating window of this ticket has passed - " + ticket.Ticket_Id)
+		}
+	}
+
+	csat.ObjectType = "csat"
+	csat.Ticket_Id = ticket.Ticket_Id
+	csat.Company = ticket.Company
+	csat.SubmittedBy = caller.Employee_sn
+	csat.SubmittedOn = now.Format(time.RFC3339)
+	csat.Assignee = ticket.Assignee.Employee_sn
+	csat.Queue = ticket.Queue
+	ibmasset, err := get_ibmasset(stub, ticket.Asset)
+	if err == nil {
+		csat.AssetType = ibmasset.AssetType
+	}
+
+	key, err := stub.CreateCompositeKey(CSAT_INDEX, []string{csat.Ticket_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	csatAsBytes, _ := json.Marshal(csat)                      //convert to array of bytes
+	err = stub.PutState(key, csatAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "csat_submitted", csat)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end submit_csat")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Restock Part - add stock of a part at a site, creating the part on first restock
+//
+// Description, reorder level and unit cost are optional and update the part when given. Admins and anyone who can
+// work tickets can restock, stock belongs to the caller's company.
+//
+// Inputs - Array of Strings
+//      0    ,      1     ,   2     ,       3      ,      4       ,     5
+//     site  , part number, quantity,  description , reorder level, unit cost
+//  "Dublin" ,  "FAN-120" ,  "10"   , "120mm fan"  ,     "2"      ,  "14.50"
+// ============================================================================================================================
+func restock_part(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting restock_part")
+
+	if len(args) < 3 || len(args) > 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 to 6")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args[:3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	quantity, err := strconv.Atoi(args[2])
+	if err != nil || quantity <= 0 {
+		return shim.Error("Quantity must be a positive whole number - " + args[2])
+	}
+
+	if !caller_works_tickets(stub) {
+		return shim.Error("Only an admin or an employee who works tickets can restock parts")
+	}
+	company, err := get_caller_company(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	part, found, err := get_part(stub, company.Company_Id, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		part.ObjectType = "part"
+		part.Site = args[0]
+		part.Part_Number = args[1]
+		part.Company = company.Company_Id
+	}
+
+	part.Quantity += quantity
+	if len(args) > 3 && len(args[3]) > 0 {
+		part.Description = args[3]
+	}
+	if len(args) > 4 && len(args[4]) > 0 {
+		part.ReorderLevel, err = strconv.Atoi(args[4])
+		if err != nil || part.ReorderLevel < 0 {
+			return shim.Error("Reorder level must be a whole number - " + args[4])
+		}
+	}
+	if len(args) > 5 && len(args[5]) > 0 {
+		part.UnitCost, err = strconv.ParseFloat(args[5], 64)
+		if err != nil || part.UnitCost < 0 {
+			return shim.Error("Unit cost must be a number - " + args[5])
+		}
+	}
+	part.UpdatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = put_part(stub, part)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end restock_part")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Consume Part - take parts from a site's stock for a ticket
+//
+// Stock of the ticket's company and the ticket's parts list change in the same transaction, it fails when the site has
+// too few. The use that takes a part down to its reorder level sends "part_low_stock" instead of "part_consumed", a
+// transaction carries one event. Resolved tickets take no parts, their cost is fixed when they are resolved.
+//
+// Inputs - Array of Strings
+//       0     ,    1    ,      2     ,    3
+//   ticket id ,   site  , part number, quantity
+// "m999999999", "Dublin",  "FAN-120" ,   "1"
+// ============================================================================================================================
+func consume_part(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var usage PartUsage
+	var err error
+	fmt.Println("starting consume_part")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if is_resolved_status(ticket.Status) {
+		return shim.Error("Parts cannot be consumed by a resolved ticket, its cost is final until it is reopened - " + ticket.Ticket_Id)
+	}
+	if !caller_works_tickets(stub) {
+		return shim.Error("Only an admin or an employee who works tickets can consume parts")
+	}
+
+	usage.Quantity, err = strconv.Atoi(args[3])
+	if err != nil || usage.Quantity <= 0 {
+		return shim.Error("Quantity must be a positive whole number - " + args[3])
+	}
+
+	part, found, err := get_part(stub, ticket.Company, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("This part is not stocked for the ticket's company at this site - " + args[2])
+	}
+	if part.Quantity < usage.Quantity {
+		return shim.Error("Insufficient stock of " + part.Part_Number + " at " + part.Site + ", " + strconv.Itoa(part.Quantity) + " left")
+	}
+
+	usage.ObjectType = "part_usage"
+	usage.Usage_Id = stub.GetTxID()
+	usage.Ticket_Id = ticket.Ticket_Id
+	usage.Part_Number = part.Part_Number
+	usage.Site = part.Site
+	usage.UnitCost = part.UnitCost
+	usage.Cost = part.UnitCost * float64(usage.Quantity)
+	usage.ConsumedBy = caller_identity(stub)
+	usage.ConsumedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	before := part.Quantity
+	part.Quantity -= usage.Quantity
+	part.UpdatedOn = usage.ConsumedOn
+	err = put_part(stub, part)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(PART_USAGE_INDEX, []string{usage.Ticket_Id, usage.Usage_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	usageAsBytes, _ := json.Marshal(usage)                    //convert to array of bytes
+	err = stub.PutState(key, usageAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if before > part.ReorderLevel && part.Quantity <= part.ReorderLevel {
+		err = emit_event(stub, "part_low_stock", part)       //only when it crosses the level, not on every use below it
+	} else {
+		err = emit_event(stub, "part_consumed", usage)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end consume_part")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Log Time - record labour on a ticket
+//
+// The cost is worked out from the labour_rate of the rate category when the time is logged. Technicians log their own
+// time, admins can log it for anyone. Resolved tickets take no time, their cost is fixed when they are resolved.
+//
+// Inputs - Array of Strings
+//       0     ,      1      ,    2   ,      3
+//   ticket id ,  technician , minutes, rate category
+// "m999999999", "o999999999",  "45"  ,  "standard"
+// ============================================================================================================================
+func log_time(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var entry TimeEntry
+	var err error
+	fmt.Println("starting log_time")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if is_resolved_status(ticket.Status) {
+		return shim.Error("Time cannot be logged on a resolved ticket, its cost is final until it is reopened - " + ticket.Ticket_Id)
+	}
+
+	technician, err := get_employee(stub, args[1])
+	if err != nil {
+		return shim.Error("This employee does not exist - " + args[1])
+	}
+	err = can_work_for(technician, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller_is_admin(stub) {
+		caller, err := get_caller_employee(stub)
+		if err != nil || caller.Employee_sn != technician.Employee_sn {
+			return shim.Error("Technicians can only log their own time - " + technician.Employee_sn)
+		}
+	}
+
+	entry.Minutes, err = strconv.Atoi(args[2])
+	if err != nil || entry.Minutes <= 0 {
+		return shim.Error("Minutes must be a positive whole number - " + args[2])
+	}
+
+	rate, found, err := get_config(stub, "labour_rate", args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("Unknown rate category - " + args[3])
+	}
+	json.Unmarshal(rate.Value, &entry.Rate)                   //un stringify it aka JSON.parse()
+
+	entry.ObjectType = "time_entry"
+	entry.Entry_Id = stub.GetTxID()
+	entry.Ticket_Id = ticket.Ticket_Id
+	entry.Technician = technician.Employee_sn
+	entry.RateCategory = args[3]
+	entry.Cost = entry.Rate * float64(entry.Minutes) / 60
+	entry.LoggedBy = caller_identity(stub)
+	entry.LoggedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(TIME_ENTRY_INDEX, []string{entry.Ticket_Id, entry.Entry_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entryAsBytes, _ := json.Marshal(entry)                    //convert to array of bytes
+	err = stub.PutState(key, entryAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end log_time")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Generate Invoice - bill a cost centre for its billable tickets closed in a period, the end day included
+//
+// Billable tickets are out of warranty hardware repairs of the caller's company whose asset belonged to the cost centre
+// when they were closed.
+// Each ticket's cost is frozen into a line of the invoice and the ticket is marked as invoiced, so it is never billed
+// twice. Admin only.
+//
+// Inputs - Array of Strings
+//       0     ,      1     ,      2      ,      3
+//  invoice id , cost centre,    start    ,     end
+// "inv-2024-q1",  "CC-1001" , "2024-01-01", "2024-03-31"
+// ============================================================================================================================
+func generate_invoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var invoice Invoice
+	var err error
+	fmt.Println("starting generate_invoice")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can generate invoices")
+	}
+	company, err := get_caller_company(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, found, err := get_invoice(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		return shim.Error("This invoice already exists - " + args[0])
+	}
+
+	start, err := parse_date(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	end, err := parse_date(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	endExclusive, err := parse_period_end(args[3])            //the whole end day counts
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	invoice.ObjectType = "invoice"
+	invoice.Invoice_Id = args[0]
+	invoice.Company = company.Company_Id
+	invoice.CostCentre = args[1]
+	invoice.PeriodStart = start.Format(time.RFC3339)
+	invoice.PeriodEnd = end.Format(time.RFC3339)
+	invoice.GeneratedBy = caller_identity(stub)
+	invoice.GeneratedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tickets, err := get_all_tickets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, ticket := range tickets {
+		if ticket.Company != invoice.Company || len(ticket.Invoice) > 0 {
+			continue                                            //other company or billed already
+		}
+		if normalize_status(ticket.Status) != STATUS_CLOSED || ticket.Entitlement == nil || !ticket.Entitlement.Billable {
+			continue
+		}
+		closedOn, err := time.Parse(time.RFC3339, ticket.ClosedOn)
+		if err != nil || closedOn.Before(start) || !closedOn.Before(endExclusive) {
+			continue
+		}
+		if ticket_charged_to(stub, ticket).CostCentre != invoice.CostCentre {
+			continue
+		}
+
+		cost := ticket.Cost
+		if cost == nil {
+			computed, err := compute_ticket_cost(stub, ticket.Ticket_Id)   //closed before costs were worked out
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			cost = &computed
+		}
+		invoice.Lines = append(invoice.Lines, InvoiceLine{ticket.Ticket_Id, ticket.Asset, ticket.Queue, ticket.ClosedOn, cost.Minutes, cost.Labour, cost.Parts, cost.Total})
+		invoice.Total += cost.Total
+
+		// mark the ticket as billed
+		ticket.Invoice = invoice.Invoice_Id
+		ticketAsBytes, _ := json.Marshal(ticket)                //convert to array of bytes
+		err = stub.PutState(ticket.Ticket_Id, ticketAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if len(invoice.Lines) == 0 {
+		return shim.Error("No billable tickets to invoice for " + invoice.CostCentre + " in this period")
+	}
+
+	key, err := stub.CreateCompositeKey(INVOICE_INDEX, []string{invoice.Invoice_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	invoiceAsBytes, _ := json.Marshal(invoice)                //convert to array of bytes
+	err = stub.PutState(key, invoiceAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "invoice_generated", invoice)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end generate_invoice")
+	return shim.Success(invoiceAsBytes)
+}
+
+
+// ============================================================================================================================
+// Open Rma - record that a ticket's asset, or a part of it, goes back to its vendor
+//
+// Inputs - Array of Strings
+//       0     ,    1   ,    2    ,      3
+//   ticket id , rma id ,  vendor , rma number
+// "m999999999", "rma1" , "Lenovo", "RMA-778812"
+// ============================================================================================================================
+func open_rma(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var rma Rma
+	var err error
+	fmt.Println("starting open_rma")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if normalize_status(ticket.Status) == STATUS_CLOSED {
+		return shim.Error("Ticket is closed - " + ticket.Ticket_Id)
+	}
+	ibmasset, err := get_ibmasset(stub, ticket.Asset)
+	if err != nil {
+		return shim.Error("Ticket has no asset on the ledger to return - " + ticket.Ticket_Id)
+	}
+
+	_, found, err := get_rma(stub, ticket.Ticket_Id, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		return shim.Error("This RMA already exists - " + args[1])
+	}
+
+	rma.ObjectType = "rma"
+	rma.Ticket_Id = ticket.Ticket_Id
+	rma.Rma_Id = args[1]
+	rma.Company = ticket.Company
+	rma.Asset = ibmasset.SerialNumber
+	rma.Vendor = args[2]
+	rma.RmaNumber = args[3]
+	rma.Status = RMA_OPEN
+	rma.OpenedBy = caller_identity(stub)
+	rma.OpenedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = put_rma(stub, rma)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end open_rma")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Ship Rma - the returned device or part left for the vendor
+//
+// Inputs - Array of Strings
+//       0     ,    1   ,      2
+//   ticket id , rma id , shipped on
+// "m999999999", "rma1" , "2024-02-01"
+// ============================================================================================================================
+func ship_rma(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting ship_rma")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	rma, found, err := get_rma(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("This RMA does not exist - " + args[1])
+	}
+	err = check_tenant(stub, rma.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rma.Status != RMA_OPEN {
+		return shim.Error("RMA is already " + rma.Status + " - " + rma.Rma_Id)
+	}
+
+	shippedOn, err := parse_date(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rma.ShippedOn = shippedOn.Format("2006-01-02")
+	rma.Status = RMA_SHIPPED
+
+	err = put_rma(stub, rma)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end ship_rma")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Receive Rma - the vendor sent the device back, or a replacement for it
+//
+// When the replacement has a new serial a new asset is created for it with the original's attributes, the original is
+// retired and both point at each other through replacedby and replaces, so the original's history stays reachable.
+// The ticket moves to the replacement.
+//
+// Inputs - Array of Strings
+//       0     ,    1   ,      2      ,         3
+//   ticket id , rma id , received on , replacement serial
+// "m999999999", "rma1" , "2024-02-09",   "PF1XYZ99"
+// ============================================================================================================================
+func receive_rma(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting receive_rma")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args[:3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	rma, found, err := get_rma(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("This RMA does not exist - " + args[1])
+	}
+	err = check_tenant(stub, rma.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rma.Status != RMA_SHIPPED {
+		return shim.Error("Only shipped RMAs can be received - " + rma.Rma_Id)
+	}
+
+	receivedOn, err := parse_date(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rma.ReceivedOn = receivedOn.Format("2006-01-02")
+	rma.Status = RMA_RECEIVED
+	if len(args) == 4 && args[3] != rma.Asset {
+		rma.ReplacementSerial = args[3]
+	}
+
+	if len(rma.ReplacementSerial) > 0 {
+		err = swap_asset(stub, rma)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = put_rma(stub, rma)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "rma_received", rma)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end receive_rma")
+	return shim.Success(nil)
+}
+
+// replace the RMA's asset with the replacement serial, linking the two and moving the ticket over
+func swap_asset(stub shim.ChaincodeStubInterface, rma Rma) error {
+	original, err := get_ibmasset(stub, rma.Asset)
+	if err != nil {
+		return err
+	}
+	_, err = get_ibmasset(stub, rma.ReplacementSerial)
+	if err == nil {
+		return errors.New("The replacement serial is already an asset - " + rma.ReplacementSerial)
+	}
+
+	// the replacement takes over the original's place, including its repair status
+	replacement := original
+	replacement.SerialNumber = rma.ReplacementSerial
+	replacement.Status = asset_status(original)
+	replacement.Replaces = original.SerialNumber
+	replacement.ReplacedBy = ""
+	err = validate_asset_attributes(replacement)
+	if err != nil {
+		return err
+	}
+	replacementAsBytes, _ := json.Marshal(replacement)        //convert to array of bytes
+	err = stub.PutState(replacement.SerialNumber, replacementAsBytes)
+	if err != nil {
+		return err
+	}
+	err = set_endorsement_orgs(stub, replacement.SerialNumber, default_endorsement_orgs(stub, replacement.Company))
+	if err != nil {
+		return err
+	}
+	err = put_tag_index(stub, "ibm_asset", replacement.SerialNumber, replacement.Tags)   //the replacement keeps the tags
+	if err != nil {
+		return err
+	}
+
+	original.ReplacedBy = replacement.SerialNumber
+	_, err = set_asset_status(stub, original, ASSET_RETIRED)
+	if err != nil {
+		return err
+	}
+
+	ticket, err := get_ticket(stub, rma.Ticket_Id)
+	if err != nil {
+		return nil                                              //ticket was deleted, nothing to move
+	}
+	err = del_ticket_lookup(stub, ticket)
+	if err != nil {
+		return err
+	}
+	ticket.Asset = replacement.SerialNumber
+	ticketAsBytes, _ := json.Marshal(ticket)                    //convert to array of bytes
+	err = stub.PutState(ticket.Ticket_Id, ticketAsBytes)
+	if err != nil {
+		return err
+	}
+	return put_ticket_lookup(stub, ticket)                      //puts the owner entry back too
+}
+
+
+// ============================================================================================================================
+// Schedule Visit - book a technician on site for a ticket
+//
+// The window may not overlap another visit of the technician. Site is optional and defaults to the site of the ticket's
+// asset.
+//
+// Inputs - Array of Strings
+//       0     ,    1    ,      2      ,          3          ,          4          ,    5
+//   ticket id , visit id,  technician ,    window start     ,     window end      ,   site
+// "m999999999", "visit1", "o999999999", "2024-02-01T09:00:00Z", "2024-02-01T11:00:00Z", "Dublin"
+// ============================================================================================================================
+func schedule_visit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var visit Visit
+	var err error
+	fmt.Println("starting schedule_visit")
+
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 or 6")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args[:5])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if is_resolved_status(ticket.Status) {
+		return shim.Error("Visits cannot be scheduled for a resolved ticket - " + ticket.Ticket_Id)
+	}
+	if !caller_works_tickets(stub) {
+		return shim.Error("Only an admin or an employee who works tickets can schedule visits")
+	}
+
+	technician, err := get_employee(stub, args[2])
+	if err != nil {
+		return shim.Error("This employee does not exist - " + args[2])
+	}
+	err = can_take_assignment(technician)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = can_work_for(technician, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	start, err := time.Parse(time.RFC3339, args[3])
+	if err != nil {
+		return shim.Error("Window start must be RFC3339 - " + args[3])
+	}
+	end, err := time.Parse(time.RFC3339, args[4])
+	if err != nil {
+		return shim.Error("Window end must be RFC3339 - " + args[4])
+	}
+	if !start.Before(end) {
+		return shim.Error("Window end must be after window start")
+	}
+
+	// conflict detection against the technician's other visits
+	visits, err := get_technician_visits(stub, technician.Employee_sn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, other := range visits {
+		if other.Visit_Id == args[1] {
+			return shim.Error("This visit already exists - " + args[1])
+		}
+		if other.Status == VISIT_COMPLETED {
+			continue
+		}
+		otherStart, _ := time.Parse(time.RFC3339, other.WindowStart)
+		otherEnd, _ := time.Parse(time.RFC3339, other.WindowEnd)
+		if windows_overlap(start, end, otherStart, otherEnd) {
+			return shim.Error("Technician " + technician.Employee_sn + " already has visit " + other.Visit_Id + " from " + other.WindowStart + " to " + other.WindowEnd)
+		}
+	}
+
+	visit.ObjectType = "visit"
+	visit.Visit_Id = args[1]
+	visit.Ticket_Id = ticket.Ticket_Id
+	visit.Company = ticket.Company
+	visit.Technician = technician.Employee_sn
+	visit.WindowStart = start.UTC().Format(time.RFC3339)           //UTC so windows sort as text
+	visit.WindowEnd = end.UTC().Format(time.RFC3339)
+	visit.Status = VISIT_SCHEDULED
+	if len(args) == 6 && len(args[5]) > 0 {
+		visit.Site = args[5]
+	} else {
+		ibmasset, err := get_ibmasset(stub, ticket.Asset)
+		if err == nil {
+			visit.Site = ibmasset.Site
+		}
+	}
+	if len(visit.Site) == 0 {
+		return shim.Error("Expecting a site, the ticket's asset has none")
+	}
+	visit.ScheduledBy = caller_identity(stub)
+	visit.ScheduledOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = put_visit(stub, visit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "visit_scheduled", visit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end schedule_visit")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Check In - the technician arrived on site, records the actual time
+//
+// Inputs - Array of Strings
+//      0
+//   visit id
+//   "visit1"
+// ============================================================================================================================
+func check_in(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting check_in")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting visit id")
+	}
+	return record_visit_time(stub, args[0], VISIT_SCHEDULED, VISIT_CHECKED_IN)
+}
+
+// ============================================================================================================================
+// Check Out - the technician left the site, records the actual time and completes the visit
+//
+// Inputs - Array of Strings
+//      0
+//   visit id
+//   "visit1"
+// ============================================================================================================================
+func check_out(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting check_out")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting visit id")
+	}
+	return record_visit_time(stub, args[0], VISIT_CHECKED_IN, VISIT_COMPLETED)
+}
+
+// move one of the caller's own visits on, stamping the transaction time
+func record_visit_time(stub shim.ChaincodeStubInterface, visitId string, from string, to string) pb.Response {
+	// input sanitation
+	err := sanitize_arguments([]string{visitId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := get_caller_employee(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visit, found, err := get_visit(stub, caller.Employee_sn, visitId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return shim.Error("The caller has no visit " + visitId)
+	}
+	if visit.Status != from {
+		return shim.Error("Visit " + visit.Visit_Id + " is " + visit.Status + ", expecting " + from)
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visit.Status = to
+	if to == VISIT_CHECKED_IN {
+		visit.CheckedIn = now
+	} else {
+		visit.CheckedOut = now
+	}
+
+	err = put_visit(stub, visit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emit_event(stub, "visit_" + strings.Replace(to, " ", "_", -1), visit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end visit " + to)
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Set Maintenance Plan - create or replace a periodic servicing plan. Admin only.
+//
+// Target is "assettype:<type>" for every asset of a type or "asset:<serial>" for one asset. Every interval days from the
+// start date is a period, the scheduler opens one ticket per covered asset and period. Checklist is comma separated.
+//
+// Inputs - Array of Strings
+//      0    ,        1        ,    2    ,     3      ,    4    ,     5       ,      6      ,          7          ,       8
+//   plan id ,      target     , interval, start date ,  queue  ,    owner    ,   assignee  ,      checklist      ,  description
+// "pm-ups"  , "assettype:ups" ,  "90"   , "2024-01-01", "hardware", "o999999999", "o888888888", "battery,fans,firmware", "UPS service"
+// ============================================================================================================================
+func set_maintenance_plan(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var plan MaintenancePlan
+	var err error
+	fmt.Println("starting set_maintenance_plan")
+
+	if len(args) != 9 {
+		return shim.Error("Incorrect number of arguments. Expecting 9")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can set maintenance plans")
+	}
+	company, err := get_caller_company(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	existing, found, err := get_maintenance_plan(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found && existing.Company != company.Company_Id {
+		return shim.Error("Maintenance plan belongs to another company - " + args[0])
+	}
+
+	plan.ObjectType = "maintenance_plan"
+	plan.Plan_Id = args[0]
+	plan.Company = company.Company_Id
+	target := strings.SplitN(args[1], ":", 2)
+	if len(target) != 2 || len(target[1]) == 0 {
+		return shim.Error("Target must be assettype:<type> or asset:<serial> - " + args[1])
+	}
+	switch target[0] {
+	case "assettype":
+		plan.AssetType = target[1]
+	case "asset":
+		ibmasset, err := get_ibmasset(stub, target[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if ibmasset.Company != plan.Company {
+			return shim.Error("Asset belongs to another company - " + target[1])
+		}
+		plan.Asset = ibmasset.SerialNumber
+	default:
+		return shim.Error("Target must be assettype:<type> or asset:<serial> - " + args[1])
+	}
+
+	plan.IntervalDays, err = strconv.Atoi(args[2])
+	if err != nil || plan.IntervalDays <= 0 {
+		return shim.Error("Interval must be a positive number of days - " + args[2])
+	}
+	startDate, err := time.Parse("2006-01-02", args[3])
+	if err != nil {
+		return shim.Error("Start date must be YYYY-MM-DD - " + args[3])
+	}
+	plan.StartDate = startDate.Format("2006-01-02")
+	plan.Queue = args[4]
+	queues := get_config_list(stub, "queues", "", nil)
+	if queues != nil && !contains(queues, plan.Queue) {
+		return shim.Error("Unknown queue - " + plan.Queue)
+	}
+
+	// owner and assignee are checked again whenever a ticket is opened
+	owner, err := get_employee(stub, args[5])
+	if err != nil || owner.Company != plan.Company {
+		return shim.Error("Owner must be an employee of the company - " + args[5])
+	}
+	plan.Owner = owner.Employee_sn
+	assignee, err := get_employee(stub, args[6])
+	if err != nil {
+		return shim.Error("This employee does not exist - " + args[6])
+	}
+	err = can_work_for(assignee, plan.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	plan.Assignee = assignee.Employee_sn
+
+	plan.Checklist = split_list(args[7])
+	plan.Description = args[8]
+	plan.UpdatedBy = caller_identity(stub)
+	plan.UpdatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(MAINTENANCE_PLAN_INDEX, []string{plan.Plan_Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	planAsBytes, _ := json.Marshal(plan)                      //convert to array of bytes
+	err = stub.PutState(key, planAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_maintenance_plan")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Run Maintenance Scheduler - open the maintenance tickets that are due. Admin only.
+//
+// Every covered asset gets one ticket per plan and period, opened through create_ticket like init_ticket's, with the
+// plan's checklist as mandatory items ahead of the asset type's checklist. Plans,
+// assets and ticket ids only depend on the ledger and the transaction date, so every endorser opens the same tickets and
+// running the scheduler again in the same period opens none. Max is optional and limits how many tickets one run opens.
+//
+// An asset a plan cannot open a ticket for, e.g. because the plan's assignee left or the ticket id is taken, is skipped
+// and reported with the error under "skipped", the plan's other assets and the other plans still run. Ticket ids join
+// "pm", the plan id, the serial number and the period with '-', with '%' and '-' escaped in the plan id and serial
+// number so no two plans and assets give the same id.
+//
+// Inputs - Array of Strings
+//    0
+//   max
+//  "50"
+//
+// Returns - {"opened": ["pm-pm%2Dups-SN1-3"], "skipped": [{"plan_id": "pm-ups", "asset": "SN2", "error": "..."}]}
+// ============================================================================================================================
+func run_maintenance_scheduler(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type SkippedAsset struct {
+		Plan_Id string `json:"plan_id"`
+		Asset   string `json:"asset"`
+		Error   string `json:"error"`
+	}
+	type SchedulerRun struct {
+		Opened  []string      `json:"opened"`
+		Skipped []SkippedAsset `json:"skipped"`
+	}
+	run := SchedulerRun{Opened: []string{}, Skipped: []SkippedAsset{}}
+	var err error
+	max := -1
+	fmt.Println("starting run_maintenance_scheduler")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	if len(args) == 1 {
+		max, err = strconv.Atoi(args[0])
+		if err != nil || max <= 0 {
+			return shim.Error("Max must be a positive number - " + args[0])
+		}
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can run the maintenance scheduler")
+	}
+	scope, err := get_tenant_scope(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := get_tx_datetime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	today := now.UTC().Format("2006-01-02")
+
+	// plans come back in key order
+	var plans []MaintenancePlan
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(MAINTENANCE_PLAN_INDEX, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for resultsIterator.HasNext() {
+		pointer, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return shim.Error(err.Error())
+		}
+		var plan MaintenancePlan
+		json.Unmarshal(pointer.GetValue(), &plan)            //un stringify it aka JSON.parse()
+		if can_see(scope, plan.Company) {
+			plans = append(plans, plan)
+		}
+	}
+	resultsIterator.Close()
+
+	assets, err := get_all_assets(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, plan := range plans {
+		period, ok := maintenance_period(plan, now)
+		if !ok {
+			continue
+		}
+		for _, ibmasset := range assets {
+			if max >= 0 && len(run.Opened) >= max {
+				break
+			}
+			if !plan_covers(plan, ibmasset) {
+				continue
+			}
+
+			// one ticket per plan, asset and period
+			runKey, err := stub.CreateCompositeKey(MAINTENANCE_RUN_INDEX, []string{plan.Plan_Id, ibmasset.SerialNumber, strconv.Itoa(period)})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			done, err := stub.GetState(runKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if done != nil {
+				continue
+			}
+
+			var draft Ticket
+			draft.Ticket_Id = "pm-" + id_part(plan.Plan_Id) + "-" + id_part(ibmasset.SerialNumber) + "-" + strconv.Itoa(period)
+			draft.Description = plan.Description
+			draft.Date = today
+			draft.Status = STATUS_OPEN
+			draft.TicketOwner = plan.Owner
+			draft.Assignee.Employee_sn = plan.Assignee
+			draft.Asset = ibmasset.SerialNumber
+			draft.Queue = plan.Queue
+			draft.DescriptionProduct = ibmasset.Manufacturer
+			draft.Prod = ibmasset.Model
+			draft.Diagnostic = plan.Description
+			for _, name := range plan.Checklist {
+				draft.Checklist = append(draft.Checklist, ChecklistItem{Name: name, Mandatory: true})
+			}
+			draft.MaintenancePlan = plan.Plan_Id
+			ticket, err := create_ticket(stub, draft, "", nil)
+			if err != nil {
+				fmt.Println("Maintenance plan " + plan.Plan_Id + " could not open a ticket for " + ibmasset.SerialNumber + " - " + err.Error())
+				run.Skipped = append(run.Skipped, SkippedAsset{plan.Plan_Id, ibmasset.SerialNumber, err.Error()})
+				continue                                        //on to the plan's next asset
+			}
+
+			err = stub.PutState(runKey, []byte(ticket.Ticket_Id))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			run.Opened = append(run.Opened, ticket.Ticket_Id)
+		}
+	}
+
+	err = emit_event(stub, "maintenance_tickets_opened", run)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	runAsBytes, _ := json.Marshal(run)                        //convert to array of bytes
+	fmt.Println("- end run_maintenance_scheduler")
+	return shim.Success(runAsBytes)
+}
+
+
+// ============================================================================================================================
+// Set Checklist Template - the diagnostic checklist new tickets on an asset type start with. Admin only.
+//
+// Items is a JSON array, tickets already open keep the checklist they started with.
+//
+// Inputs - Array of Strings
+//       0    ,                              1
+//  asset type,                            items
+//   "laptop" , "[{\"name\": \"power on self test\", \"mandatory\": true}, {\"name\": \"battery health\"}]"
+// ============================================================================================================================
+func set_checklist_template(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var template ChecklistTemplate
+	var err error
+	fmt.Println("starting set_checklist_template")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can set checklists")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(args[1]))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&template.Items)
+	if err != nil {
+		return shim.Error("Items must be a JSON array of {name, mandatory} - " + err.Error())
+	}
+	if len(template.Items) == 0 {
+		return shim.Error("A checklist needs at least one item")
+	}
+	var names []string
+	for _, item := range template.Items {
+		if len(strings.TrimSpace(item.Name)) == 0 {
+			return shim.Error("Checklist items need a name")
+		}
+		if contains(names, item.Name) {
+			return shim.Error("Checklist item is listed twice - " + item.Name)
+		}
+		names = append(names, item.Name)
+	}
+
+	template.ObjectType = "checklist_template"
+	template.AssetType = args[0]
+	template.UpdatedBy = caller_identity(stub)
+	template.UpdatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(CHECKLIST_INDEX, []string{strings.ToLower(template.AssetType)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	templateAsBytes, _ := json.Marshal(template)              //convert to array of bytes
+	err = stub.PutState(key, templateAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_checklist_template")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Update Checklist Item - record the result of a checklist item on a ticket
+//
+// Result is pass or fail, notes are optional.
+//
+// Inputs - Array of Strings
+//       0     ,         1          ,   2   ,        3
+//   ticket id ,       item         , result,      notes
+// "m999999999", "power on self test", "fail", "beeps 3 times"
+// ============================================================================================================================
+func update_checklist_item(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting update_checklist_item")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args[:3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := strings.ToLower(args[2])
+	if result != CHECK_PASS && result != CHECK_FAIL {
+		return shim.Error("Result must be pass or fail - " + args[2])
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if is_resolved_status(ticket.Status) {
+		return shim.Error("Checklist of a resolved ticket cannot change - " + ticket.Ticket_Id)
+	}
+	if !caller_works_tickets(stub) {
+		return shim.Error("Only an admin or an employee who works tickets can update checklists")
+	}
+
+	var item *ChecklistItem
+	for i := range ticket.Checklist {
+		if ticket.Checklist[i].Name == args[1] {
+			item = &ticket.Checklist[i]
+		}
+	}
+	if item == nil {
+		return shim.Error("Ticket has no checklist item - " + args[1])
+	}
+	item.Result = result
+	item.Notes = ""
+	if len(args) == 4 {
+		item.Notes = args[3]
+	}
+	item.UpdatedBy = caller_identity(stub)
+	item.UpdatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticketAsBytes, _ := json.Marshal(ticket)                  //convert to array of bytes
+	err = stub.PutState(ticket.Ticket_Id, ticketAsBytes)     //rewrite the ticket with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end update_checklist_item")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Set Custom Fields - define the extra fields tickets in a queue carry. Admin only.
+//
+// Fields is a JSON array. Type is string, number, bool or date, enum limits the values of a string field. New rules
+// apply to tickets opened or updated from here on.
+//
+// Inputs - Array of Strings
+//       0    ,                                          1
+//     queue  ,                                        fields
+// "hardware" , "[{\"name\": \"osversion\", \"type\": \"string\", \"required\": true, \"enum\": [\"Windows 10\", \"Windows 11\"]}]"
+// ============================================================================================================================
+func set_custom_fields(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var schema CustomFieldSchema
+	var err error
+	fmt.Println("starting set_custom_fields")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !caller_is_admin(stub) {
+		return shim.Error("Only an admin can define custom fields")
+	}
+
+	queues := get_config_list(stub, "queues", "", nil)
+	if queues != nil && !contains(queues, args[0]) {
+		return shim.Error("Unknown queue - " + args[0])
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(args[1]))
+	decoder.DisallowUnknownFields()                             //catch misspelled attributes
+	err = decoder.Decode(&schema.Fields)
+	if err != nil {
+		return shim.Error("Fields must be a JSON array of {name, type, required, enum} - " + err.Error())
+	}
+	var names []string
+	for _, field := range schema.Fields {
+		if len(strings.TrimSpace(field.Name)) == 0 {
+			return shim.Error("Custom fields need a name")
+		}
+		if contains(names, field.Name) {
+			return shim.Error("Custom field is listed twice - " + field.Name)
+		}
+		names = append(names, field.Name)
+		if field.Type != FIELD_STRING && field.Type != FIELD_NUMBER && field.Type != FIELD_BOOL && field.Type != FIELD_DATE {
+			return shim.Error("Custom field " + field.Name + " must be of type string, number, bool or date")
+		}
+		if len(field.Enum) > 0 && field.Type != FIELD_STRING {
+			return shim.Error("Only string custom fields take enum values - " + field.Name)
+		}
+	}
+
+	schema.ObjectType = "custom_fields"
+	schema.Queue = args[0]
+	schema.UpdatedBy = caller_identity(stub)
+	schema.UpdatedOn, err = get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(CUSTOM_FIELDS_INDEX, []string{schema.Queue})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	schemaAsBytes, _ := json.Marshal(schema)                  //convert to array of bytes
+	err = stub.PutState(key, schemaAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_custom_fields")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Update Ticket - change the descriptive attributes and custom fields of a ticket
+//
+// Attributes is a JSON object with any of description, descriptionproduct, prod, diagnostic and customFields. Attributes
+// left out are unchanged. Custom fields are merged into the ticket's, a null value removes one, and the result is
+// checked against the custom fields of the queue the ticket was opened in.
+//
+// Inputs - Array of Strings
+//       0     ,                             1
+//   ticket id ,                        attributes
+// "m999999999", "{\"diagnostic\": \"fan\", \"customFields\": {\"osversion\": \"Windows 11\"}}"
+// ============================================================================================================================
+func update_ticket(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting update_ticket")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticket, err := get_ticket(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, ticket.Company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if normalize_status(ticket.Status) == STATUS_CLOSED {
+		return shim.Error("Closed tickets cannot change - " + ticket.Ticket_Id)
+	}
+
+	var attributes TicketAttributes
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[1])))
+	decoder.DisallowUnknownFields()                             //catch misspelled attributes
+	err = decoder.Decode(&attributes)
+	if err != nil {
+		return shim.Error("Failed to parse ticket attributes - " + err.Error())
+	}
+
+	old := ticket
+	if attributes.Description != nil {
+		ticket.Description = *attributes.Description
+	}
+	if attributes.DescriptionProduct != nil {
+		ticket.DescriptionProduct = *attributes.DescriptionProduct
+	}
+	if attributes.Prod != nil {
+		ticket.Prod = *attributes.Prod
+	}
+	if attributes.Diagnostic != nil {
+		ticket.Diagnostic = *attributes.Diagnostic
+	}
+	if len(attributes.CustomFields) > 0 && ticket.CustomFields == nil {
+		ticket.CustomFields = map[string]interface{}{}
+	}
+	for name, value := range attributes.CustomFields {
+		if value == nil {
+			delete(ticket.CustomFields, name)
+		} else {
+			ticket.CustomFields[name] = value
+		}
+	}
+	err = validate_custom_fields(stub, ticket_origin_queue(ticket), ticket.CustomFields)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ticketAsBytes, _ := json.Marshal(ticket)                  //convert to array of bytes
+	err = stub.PutState(ticket.Ticket_Id, ticketAsBytes)     //rewrite the ticket with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = index_ticket(stub, old, ticket)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end update_ticket")
+	return shim.Success(nil)
+}
+
+
+// ============================================================================================================================
+// Add Tag - tag a ticket or an asset
+//
+// Object type is the docType, ticket or ibm_asset. Tags are normalised to lower case with words joined by '-', adding a
+// tag the object has is a no-op.
+//
+// Inputs - Array of Strings
+//       0     ,      1     ,     2
+//  object type,     id     ,    tag
+//    "ticket" , "m999999999", "Blue Screen"
+// ============================================================================================================================
+func add_tag(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting add_tag")
+	return change_tag(stub, args, true)
+}
+
+// ============================================================================================================================
+// Remove Tag - untag a ticket or an asset
+//
+// Inputs - Array of Strings
+//       0     ,      1     ,     2
+//  object type,     id     ,    tag
+//    "ticket" , "m999999999", "blue-screen"
+// ============================================================================================================================
+func remove_tag(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting remove_tag")
+	return change_tag(stub, args, false)
+}
+
+// add or remove a tag on the object and in the tag index
+func change_tag(stub shim.ChaincodeStubInterface, args []string, add bool) pb.Response {
+	var tags []string
+	var company string
+	var err error
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	objectType, id := args[0], args[1]
+	tag, err := normalize_tag(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var ticket Ticket
+	var ibmasset IBM_Asset
+	switch objectType {
+	case "ticket":
+		ticket, err = get_ticket(stub, id)
+		tags, company = ticket.Tags, ticket.Company
+	case "ibm_asset":
+		ibmasset, err = get_ibmasset(stub, id)
+		tags, company = ibmasset.Tags, ibmasset.Company
+	default:
+		return shim.Error("Tags go on 'ticket' and 'ibm_asset' only")
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = check_tenant(stub, company)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if add == contains(tags, tag) {
+		fmt.Println("- end tag unchanged")
+		return shim.Success(nil)                                //already in the wanted state
+	}
+	if add {
+		tags = append(tags, tag)
+		sort.Strings(tags)
+		err = put_tag_index(stub, objectType, id, []string{tag})
+	} else {
+		var kept []string
+		for _, t := range tags {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		tags = kept
+		err = del_tag_index(stub, objectType, id, []string{tag})
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// rewrite the object with its new tags
+	var objectAsBytes []byte
+	if objectType == "ticket" {
+		ticket.Tags = tags
+		objectAsBytes, _ = json.Marshal(ticket)                  //convert to array of bytes
+	} else {
+		ibmasset.Tags = tags
+		objectAsBytes, _ = json.Marshal(ibmasset)                //convert to array of bytes
+	}
+	err = stub.PutState(id, objectAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end tag changed")
+	return shim.Success(nil)
+}
@@ -0,0 +1,1058 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- employees ----- //
+
+func TestUpdateEmployee(t *testing.T) {
+	l := newTestLedger(t).customer()
+
+	l.as(customerMsp, "owner1").ok(l.invoke("update_employee", "owner1", "Bob Smith"))
+	if l.getEmployee("owner1").Fullname != "Bob Smith" {
+		t.Fatal("fullname not updated")
+	}
+	if l.event() != "employee_updated" {
+		t.Fatalf("expected employee_updated event, got %q", l.event())
+	}
+
+	l.as(customerMsp, "tech2").fails(l.invoke("update_employee", "owner1", "Mallory"), "Only the employee or an admin")
+	l.as(otherMsp, "").fails(l.invoke("update_employee", "owner1", "Mallory"), "another company")
+	l.asAdmin().ok(l.invoke("update_employee", "owner1", "Robert Smith"))
+}
+
+func TestDeactivateEmployee(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+
+	l.as(customerMsp, "owner1").fails(l.invoke("deactivate_employee", "tech2"), "Only an admin")
+	l.asAdmin().ok(l.invoke("deactivate_employee", "tech2"))
+	if l.event() != "employee_deactivated" {
+		t.Fatalf("expected employee_deactivated event, got %q", l.event())
+	}
+	employee := l.getEmployee("tech2")
+	if !employee.Deactivated || len(employee.DeactivatedOn) == 0 {
+		t.Fatal("employee not deactivated")
+	}
+	l.fails(l.invoke("deactivate_employee", "tech2"), "already deactivated")
+
+	// existing tickets keep the employee, new ones cannot be given to them
+	if l.getTicket("t1").Assignee.Employee_sn != "tech2" {
+		t.Fatal("existing assignment changed")
+	}
+	l.fails(l.ticket(customerMsp, "t2", "no keyboard", "owner1", "tech2", "SN1", "software"), "deactivated")
+	l.asAdmin().fails(l.invoke("set_assignee", "t1", "tech2"), "deactivated")
+}
+
+func TestSetEmployeeRole(t *testing.T) {
+	l := newTestLedger(t).customer()
+
+	l.asAdmin().fails(l.invoke("set_employee_role", "owner1", "wizard", "team", ""), "Unknown role")
+	l.as(customerMsp, "owner1").fails(l.invoke("set_employee_role", "owner1", ROLE_ADMIN, "team", ""), "Only an admin")
+
+	l.asAdmin().ok(l.invoke("set_employee_role", "owner1", ROLE_TEAMLEAD, "hardware", "thinkpad, windows"))
+	employee := l.getEmployee("owner1")
+	if employee.Role != ROLE_TEAMLEAD || employee.Team != "hardware" || len(employee.Skills) != 2 {
+		t.Fatalf("role not assigned - %+v", employee)
+	}
+	if l.event() != "employee_role_changed" {
+		t.Fatalf("expected employee_role_changed event, got %q", l.event())
+	}
+
+	// plain users cannot be assigned tickets
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "owner1", "SN1", "hardware"))
+	l.asAdmin().ok(l.invoke("set_employee_role", "owner1", ROLE_USER, "hardware", ""))
+	l.fails(l.ticket(customerMsp, "t2", "no screen", "owner1", "owner1", "SN1", "software"), "cannot be assigned tickets")
+}
+
+// ----- asset lifecycle ----- //
+
+func TestAssetLifecycle(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.as(customerMsp, "owner1").ok(l.invoke("init_ibmasset", "SN2", "thinkpad", "none", "owner1", ASSET_IN_STOCK))
+	l.fails(l.invoke("init_ibmasset", "SN3", "thinkpad", "none", "owner1", ASSET_IN_REPAIR), "New assets must be")
+
+	l.fails(l.invoke("set_ibmasset_status", "SN2", ASSET_IN_REPAIR), "cannot move from 'in stock' to 'in repair'")
+	l.fails(l.invoke("set_ibmasset_status", "SN2", "lost"), "Unknown asset status")
+	l.ok(l.invoke("set_ibmasset_status", "SN2", ASSET_DEPLOYED))
+	l.as(otherMsp, "").fails(l.invoke("set_ibmasset_status", "SN2", ASSET_IN_STOCK), "another company")
+	if status := l.getAsset("SN2").Status; status != ASSET_DEPLOYED {
+		t.Fatalf("expected deployed, got %q", status)
+	}
+}
+
+func TestHardwareTicketTakesAssetIntoRepair(t *testing.T) {
+	l := newTestLedger(t).customer()
+
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+	if status := l.getAsset("SN1").Status; status != ASSET_IN_REPAIR {
+		t.Fatalf("expected in repair after a hardware ticket, got %q", status)
+	}
+	l.as(customerMsp, "tech2").ok(l.invoke("request_customer_signoff", "t1", "fixed"))
+	if status := l.getAsset("SN1").Status; status != ASSET_DEPLOYED {
+		t.Fatalf("expected deployed after resolution, got %q", status)
+	}
+	l.ok(l.invoke("set_ticket_status", "t1", STATUS_OPEN))
+	if status := l.getAsset("SN1").Status; status != ASSET_IN_REPAIR {
+		t.Fatalf("expected in repair after reopening, got %q", status)
+	}
+
+	// software tickets leave the asset alone
+	l.asset(customerMsp, "SN2", "thinkpad", "owner1")
+	l.ok(l.ticket(customerMsp, "t2", "outlook crashes", "owner1", "tech2", "SN2", "software"))
+	if status := l.getAsset("SN2").Status; status != ASSET_DEPLOYED {
+		t.Fatalf("expected a software ticket to leave the asset deployed, got %q", status)
+	}
+}
+
+func TestRetireAsset(t *testing.T) {
+	l := newTestLedger(t).customer()
+
+	l.as(customerMsp, "owner1").ok(l.invoke("retire_asset", "SN1"))
+	l.fails(l.invoke("retire_asset", "SN1"), "cannot move from 'retired'")
+	l.fails(l.invoke("set_ibmasset_status", "SN1", ASSET_DEPLOYED), "cannot move from 'retired'")
+	l.fails(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"), "Asset is retired")
+}
+
+// ----- asset attributes ----- //
+
+func TestUpdateAsset(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.as(customerMsp, "owner1")
+
+	l.ok(l.invoke("update_ibmasset", "SN1", `{"model": "T470", "purchasedate": "2016-06-30", "warrantyend": "2019-06-30", "site": "MOP"}`))
+	ibmasset := l.getAsset("SN1")
+	if ibmasset.Model != "T470" || ibmasset.WarrantyEnd != "2019-06-30" || ibmasset.Site != "MOP" {
+		t.Fatalf("attributes not applied - %+v", ibmasset)
+	}
+
+	// attributes left out stay, an empty string clears one
+	l.ok(l.invoke("update_ibmasset", "SN1", `{"site": ""}`))
+	ibmasset = l.getAsset("SN1")
+	if ibmasset.Model != "T470" || len(ibmasset.Site) != 0 {
+		t.Fatalf("expected only site cleared - %+v", ibmasset)
+	}
+
+	l.fails(l.invoke("update_ibmasset", "SN1", `{"colour": "black"}`), "Failed to parse asset attributes")
+	l.fails(l.invoke("update_ibmasset", "SN1", `{"warrantyend": "30-06-2019"}`), "must be YYYY-MM-DD")
+	l.fails(l.invoke("update_ibmasset", "SN1", `{"warrantyend": "2015-01-01"}`), "before purchasedate")
+	l.fails(l.invoke("update_ibmasset", "SN1", `{"costcentre": "CC 42"}`), "costcentre may only contain")
+	l.as(otherMsp, "").fails(l.invoke("update_ibmasset", "SN1", `{"model": "X1"}`), "another company")
+}
+
+// ----- entitlement ----- //
+
+func TestTicketEntitlement(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.asset(customerMsp, "SN2", "thinkpad", "owner1")
+	l.as(customerMsp, "owner1")
+	l.ok(l.invoke("update_ibmasset", "SN1", `{"warrantyend": "2017-07-20"}`))
+	l.ok(l.invoke("update_ibmasset", "SN2", `{"warrantyend": "2017-07-19"}`))
+
+	// covered up to and including the warranty end day
+	l.ok(l.invokeAt(day("2017-07-20"), init_ticket, "t1", "no display", "2017-07-20", STATUS_OPEN, "owner1", "tech2", "SN1", "hardware",
+		"ThinkPad", "T470", "diagnostic", "none", "pw"))
+	ticket := l.getTicket("t1")
+	if ticket.Entitlement == nil || !ticket.Entitlement.Covered || ticket.Entitlement.Billable || ticket.Queue != "hardware" {
+		t.Fatalf("expected a covered hardware ticket - %+v %+v", ticket.Queue, ticket.Entitlement)
+	}
+
+	// out of warranty hardware repairs are billed
+	l.ok(l.invokeAt(day("2017-07-20"), init_ticket, "t2", "keyboard broken", "2017-07-20", STATUS_OPEN, "owner1", "tech2", "SN2", "hardware",
+		"ThinkPad", "T470", "diagnostic", "none", "pw"))
+	ticket = l.getTicket("t2")
+	if ticket.Entitlement == nil || ticket.Entitlement.Covered || !ticket.Entitlement.Billable {
+		t.Fatalf("expected a billable ticket - %+v", ticket.Entitlement)
+	}
+	if ticket.Queue != QUEUE_BILLING || ticket.Entitlement.RoutedFrom != "hardware" {
+		t.Fatalf("expected the ticket routed from hardware to billing, got %q from %q", ticket.Queue, ticket.Entitlement.RoutedFrom)
+	}
+
+	// only hardware gets routed
+	l.ok(l.invokeAt(day("2017-07-20"), init_ticket, "t3", "outlook crashes", "2017-07-20", STATUS_OPEN, "owner1", "tech2", "SN2", "software",
+		"ThinkPad", "T470", "diagnostic", "none", "pw"))
+	ticket = l.getTicket("t3")
+	if ticket.Queue != "software" || ticket.Entitlement.Billable {
+		t.Fatalf("expected a software ticket to stay put - %q %+v", ticket.Queue, ticket.Entitlement)
+	}
+
+	// assets without a warranty end are neither covered nor billed and stay in their queue
+	l.asset(customerMsp, "SN3", "thinkpad", "owner1")
+	l.ok(l.invokeAt(day("2017-07-20"), init_ticket, "t5", "fan noise", "2017-07-20", STATUS_OPEN, "owner1", "tech2", "SN3", "hardware",
+		"ThinkPad", "T470", "diagnostic", "none", "pw"))
+	ticket = l.getTicket("t5")
+	if ticket.Entitlement == nil || !ticket.Entitlement.Unknown || ticket.Entitlement.Covered || ticket.Entitlement.Billable || ticket.Queue != "hardware" {
+		t.Fatalf("expected an unknown entitlement in the hardware queue - %q %+v", ticket.Queue, ticket.Entitlement)
+	}
+
+	// tickets on assets that are not on the ledger get no entitlement
+	l.ok(l.ticket(customerMsp, "t4", "printer jam", "owner1", "tech2", "PRINTER1", "hardware"))
+	if l.getTicket("t4").Entitlement != nil {
+		t.Fatal("expected no entitlement for an unknown asset")
+	}
+
+	// the read shows the entitlement
+	var details TicketDetails
+	json.Unmarshal(l.ok(l.invoke("read_ticket", "t2")), &details)
+	if details.Entitlement == nil || !details.Entitlement.Billable {
+		t.Fatalf("expected the entitlement on the read - %+v", details.Entitlement)
+	}
+}
+
+// ----- config store ----- //
+
+func TestSetConfig(t *testing.T) {
+	l := newTestLedger(t).customer()
+
+	l.as(customerMsp, "owner1").fails(l.invoke("set_config", "billing_queue", `"software"`), "Only an admin")
+	l.asAdmin()
+	l.fails(l.invoke("set_config", "no_such_entry", `"x"`), "Unknown config entry")
+	l.fails(l.invoke("set_config", "billing_queue", `42`), "must be a JSON string")
+	l.fails(l.invoke("set_config", "billing_queue", "hardware", `"software"`), "channel wide and takes no scope")
+	l.fails(l.invoke("set_config", "sla_hours", `12`), "expecting a scope")
+	l.fails(l.invoke("set_config", "sla_hours", "hardware", `-1`), "out of range")
+	l.fails(l.invoke("set_config", "statuses", `["open", "closed"]`), "must contain 'in progress'")
+
+	l.ok(l.invoke("set_config", "billing_queue", `"software"`))
+	if l.event() != "config_changed" {
+		t.Fatalf("expected config_changed event, got %q", l.event())
+	}
+	var entry ConfigEntry
+	json.Unmarshal(l.ok(l.invoke("read_config", "billing_queue")), &entry)
+	if string(entry.Value) != `"software"` || len(entry.UpdatedBy) == 0 {
+		t.Fatalf("entry not stored - %+v", entry)
+	}
+
+	// the configured billing queue is used for routing
+	l.as(customerMsp, "owner1").ok(l.invoke("update_ibmasset", "SN1", `{"warrantyend": "2016-01-01"}`))
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+	if queue := l.getTicket("t1").Queue; queue != "software" {
+		t.Fatalf("expected the ticket routed to the configured billing queue, got %q", queue)
+	}
+
+	l.as(customerMsp, "owner1").fails(l.invoke("delete_config", "billing_queue"), "Only an admin")
+	l.asAdmin().ok(l.invoke("delete_config", "billing_queue"))
+	l.fails(l.invoke("delete_config", "billing_queue"), "not set")
+	json.Unmarshal(l.ok(l.invoke("read_config", "billing_queue")), &entry)
+	if string(entry.Value) != "null" {
+		t.Fatalf("expected a deleted entry to read as null, got %s", entry.Value)
+	}
+}
+
+// ----- tenants ----- //
+
+func TestTenantIsolationOnWrites(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	l.asset(otherMsp, "SN3", "thinkpad", "owner3")
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+
+	// another company's identities cannot touch the ticket
+	l.as(otherMsp, "owner3")
+	l.fails(l.invoke("set_ticket_status", "t1", STATUS_CLOSED), "another company")
+	l.fails(l.invoke("set_assignee", "t1", "tech3"), "another company")
+	l.fails(l.invoke("delete_ticket", "t1", otherMsp), "cannot authorize deletion")
+	l.fails(l.invoke("delete_ticket", "t1", customerMsp), "another company")
+	l.fails(l.invoke("set_ibmasset_status", "SN1", ASSET_RETIRED), "another company")
+	l.fails(l.ticket(otherMsp, "t2", "no display", "owner1", "tech3", "SN3", "software"), "another company")
+
+	// tickets stay inside the company of their owner
+	l.fails(l.ticket(customerMsp, "t3", "no display", "owner1", "tech2", "SN3", "software"), "Asset belongs to another company")
+	l.fails(l.ticket(customerMsp, "t4", "no display", "owner1", "tech3", "SN1", "software"), "works for another company")
+	l.asAdmin().fails(l.invoke("set_assignee", "t1", "tech3"), "works for another company")
+
+	// support staff work for every company
+	l.ok(l.invoke("set_assignee", "t1", "tech1"))
+	l.as(providerMsp, "tech1").ok(l.invoke("set_ticket_status", "t1", STATUS_IN_PROGRESS))
+	if ticket := l.getTicket("t1"); ticket.Status != STATUS_IN_PROGRESS || ticket.Company != customerMsp {
+		t.Fatalf("expected support to work the customer's ticket - %+v", ticket)
+	}
+
+	// identities of MSPs without a company cannot create anything
+	l.as("StrangerMSP", "").fails(l.invoke("init_employee", "x1", "Stranger"), "Company does not exist")
+}
+
+// ----- endorsement policies ----- //
+
+func endorsingOrgs(l *testLedger, objectType string, id string) []string {
+	var policy struct {
+		Orgs []string `json:"orgs"`
+	}
+	json.Unmarshal(l.asAdmin().ok(l.invoke("get_endorsement_policy", objectType, id)), &policy)
+	sort.Strings(policy.Orgs)
+	return policy.Orgs
+}
+
+func TestEndorsementPolicies(t *testing.T) {
+	l := newTestLedger(t).customer()
+
+	// without a provider the chaincode policy applies
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+	if orgs := endorsingOrgs(l, "ticket", "t1"); len(orgs) != 0 {
+		t.Fatalf("expected no key level policy, got %v", orgs)
+	}
+
+	// customer documents need the customer and the provider, the provider's own just the provider
+	l.config("provider_msp", "", `"`+providerMsp+`"`)
+	l.ok(l.ticket(customerMsp, "t2", "keyboard broken", "owner1", "tech2", "SN1", "hardware"))
+	if orgs := endorsingOrgs(l, "ticket", "t2"); strings.Join(orgs, ",") != customerMsp+","+providerMsp {
+		t.Fatalf("expected customer and provider, got %v", orgs)
+	}
+	l.asset(customerMsp, "SN2", "thinkpad", "owner1")
+	if orgs := endorsingOrgs(l, "ibm_asset", "SN2"); strings.Join(orgs, ",") != customerMsp+","+providerMsp {
+		t.Fatalf("expected customer and provider, got %v", orgs)
+	}
+	l.asset(providerMsp, "SN3", "thinkpad", "tech1")
+	if orgs := endorsingOrgs(l, "ibm_asset", "SN3"); strings.Join(orgs, ",") != providerMsp {
+		t.Fatalf("expected the provider only, got %v", orgs)
+	}
+
+	// admins change them
+	l.as(customerMsp, "owner1").fails(l.invoke("set_endorsement_policy", "ticket", "t2", "none"), "Only an admin")
+	l.fails(l.invoke("get_endorsement_policy", "ticket", "t2"), "Only an admin")
+	l.asAdmin().fails(l.invoke("set_endorsement_policy", "employee", "owner1", "none"), "'ticket' and 'ibm_asset' only")
+	l.ok(l.invoke("set_endorsement_policy", "ticket", "t2", "none"))
+	if orgs := endorsingOrgs(l, "ticket", "t2"); len(orgs) != 0 {
+		t.Fatalf("expected the key level policy removed, got %v", orgs)
+	}
+	l.ok(l.invoke("set_endorsement_policy", "ticket", "t2", otherMsp+", "+providerMsp))
+	if orgs := endorsingOrgs(l, "ticket", "t2"); strings.Join(orgs, ",") != otherMsp+","+providerMsp {
+		t.Fatalf("expected the given orgs, got %v", orgs)
+	}
+	l.ok(l.invoke("set_endorsement_policy", "ticket", "t2", "default"))
+	if orgs := endorsingOrgs(l, "ticket", "t2"); strings.Join(orgs, ",") != customerMsp+","+providerMsp {
+		t.Fatalf("expected the default policy back, got %v", orgs)
+	}
+}
+
+// ----- personal data ----- //
+
+const testSalt = "0123456789abcdef"
+
+func TestPersonalDataStaysPrivate(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.pii(`{"email": "bob@example.com", "salt": "`+testSalt+`"}`).as(customerMsp, "").ok(l.invoke("init_employee", "owner2", "Bob"))
+	l.pii(`{"address": "MOP 1", "contactphone": "0612345678", "salt": "` + testSalt + `"}`)
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+
+	for _, key := range []string{"t1", "owner2"} {
+		public := string(l.stub.State[key])
+		if strings.Contains(public, "0612345678") || strings.Contains(public, "MOP 1") || strings.Contains(public, "bob@example.com") {
+			t.Fatalf("clear personal data on the public document - %s", public)
+		}
+	}
+	ticket := l.getTicket("t1")
+	if ticket.PersonalData.Subject != "owner1" || ticket.PersonalData.Hashes["contactphone"] != hash_pii(testSalt, "0612345678") {
+		t.Fatalf("expected the salted hashes on the ticket - %+v", ticket.PersonalData)
+	}
+
+	var personalData PersonalData
+	json.Unmarshal(l.as(customerMsp, "tech2").ok(l.invoke("read_personal_data", "ticket", "t1")), &personalData)
+	if personalData.Fields["address"] != "MOP 1" || len(personalData.Salt) != 0 {
+		t.Fatalf("expected the clear fields without the salt - %+v", personalData)
+	}
+	l.as(otherMsp, "").fails(l.invoke("read_personal_data", "ticket", "t1"), "another company")
+
+	var matches map[string]bool
+	l.pii(`{"address": "MOP 1", "contactphone": "0687654321", "salt": "` + testSalt + `"}`)
+	json.Unmarshal(l.as(customerMsp, "owner1").ok(l.invoke("verify_personal_data", "ticket", "t1")), &matches)
+	if !matches["address"] || matches["contactphone"] {
+		t.Fatalf("expected only the address to match - %v", matches)
+	}
+
+	l.pii(`{"address": "MOP 1", "salt": "short"}`).fails(l.ticket(customerMsp, "t2", "no keyboard", "owner1", "tech2", "SN1", "software"), "salt of at least 16")
+	l.pii(`{"shoesize": "44", "salt": "`+testSalt+`"}`).fails(l.ticket(customerMsp, "t2", "no keyboard", "owner1", "tech2", "SN1", "software"), "Unknown personal field")
+}
+
+func TestErasePersonalData(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.pii(`{"address": "MOP 1", "salt": "` + testSalt + `"}`)
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+	l.pii(`{"email": "bob@example.com", "salt": "`+testSalt+`"}`).as(customerMsp, "owner1").ok(l.invoke("update_employee", "owner1", "Bob"))
+
+	l.as(customerMsp, "tech2").fails(l.invokeAt(day("2017-07-20"), erase_personal_data, "owner1"), "Only the data subject or an admin")
+	l.as(customerMsp, "owner1").ok(l.invokeAt(day("2017-07-20"), erase_personal_data, "owner1"))
+	if l.event() != "personal_data_erased" {
+		t.Fatalf("expected personal_data_erased event, got %q", l.event())
+	}
+	if len(l.stub.PvtState[COLLECTION_PII]) != 0 {
+		t.Fatalf("expected the private data purged - %v", l.stub.PvtState[COLLECTION_PII])
+	}
+	ticket := l.getTicket("t1")
+	if len(ticket.PersonalData.ErasedOn) == 0 || ticket.PersonalData.Reason != ERASED_ON_REQUEST || len(ticket.PersonalData.Hashes) == 0 {
+		t.Fatalf("expected the ticket marked erased with its hashes kept - %+v", ticket.PersonalData)
+	}
+	l.fails(l.invoke("read_personal_data", "employee", "owner1"), "erased")
+
+	// the history can still be checked
+	var matches map[string]bool
+	l.pii(`{"address": "MOP 1", "salt": "` + testSalt + `"}`)
+	json.Unmarshal(l.ok(l.invoke("verify_personal_data", "ticket", "t1")), &matches)
+	if !matches["address"] {
+		t.Fatal("expected the kept value to verify after erasure")
+	}
+}
+
+// ----- retention ----- //
+
+func TestPurgeExpiredTickets(t *testing.T) {
+	l := newLegacyTestLedger(t, map[string]string{
+		"m1": `{"docType": "ticket", "ticket_id": "m1", "status": "closed", "queue": "hardware"}`,
+	}).customer()
+	if len(l.getTicket("m1").ClosedOn) == 0 {
+		t.Fatal("expected the upgrade to record when legacy closed tickets were closed")
+	}
+	if _, _, ok := get_retention_due(l.stub, Ticket{Ticket_Id: "m1", Status: STATUS_CLOSED, Queue: "hardware"}); ok {
+		t.Fatal("expected a ticket without closedon never due")
+	}
+
+	l.config("retention_years", "hardware", "1")
+	for _, id := range []string{"t1", "t2", "t3"} {
+		l.pii(`{"address": "MOP 1", "salt": "` + testSalt + `"}`)
+		l.ok(l.ticketAt(day("2017-01-02"), customerMsp, id, "no display", "owner1", "tech2", "X1", "hardware"))
+	}
+	l.closeAt(day("2017-01-10"), customerMsp, "t1", "tech2", "owner1")
+	l.closeAt(day("2017-06-10"), customerMsp, "t2", "tech2", "owner1")
+
+	var report []struct {
+		Ticket_Id string `json:"ticket_id"`
+	}
+	json.Unmarshal(l.asAdmin().ok(l.invoke("retention_report", "2018-01-10")), &report)
+	if len(report) != 1 || report[0].Ticket_Id != "t1" {
+		t.Fatalf("expected only t1 due on 2018-01-10 - %+v", report)
+	}
+
+	l.as(customerMsp, "owner1").fails(l.invokeAt(day("2018-01-11"), purge_expired_tickets), "Only an admin")
+	var purged []string
+	json.Unmarshal(l.asAdmin().ok(l.invokeAt(day("2018-01-11"), purge_expired_tickets)), &purged)
+	if len(purged) != 1 || purged[0] != "t1" || l.event() != "tickets_purged" {
+		t.Fatalf("expected only t1 purged - %v", purged)
+	}
+	if ticket := l.getTicket("t1"); ticket.PersonalData.Reason != ERASED_BY_RETENTION {
+		t.Fatalf("expected t1 marked erased by retention - %+v", ticket.PersonalData)
+	}
+	if len(l.getTicket("t2").PersonalData.ErasedOn) != 0 || len(l.getTicket("t3").PersonalData.ErasedOn) != 0 {
+		t.Fatal("expected the tickets not yet due kept")
+	}
+}
+
+// ----- attachments ----- //
+
+func TestTicketAttachments(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+	hash := strings.Repeat("9F", 32)
+
+	l.as(customerMsp, "tech2").ok(l.invoke("add_ticket_attachment", "t1", "photo1", "board.jpg", "image/jpeg", "52311", hash, "s3://tickets/t1/board.jpg"))
+	if l.event() != "attachment_added" {
+		t.Fatalf("expected attachment_added event, got %q", l.event())
+	}
+	l.fails(l.invoke("add_ticket_attachment", "t1", "photo1", "board2.jpg", "image/jpeg", "100", hash, "s3://tickets/t1/board2.jpg"), "already exists")
+	l.fails(l.invoke("add_ticket_attachment", "t1", "photo2", "board.jpg", "jpeg", "100", hash, "s3://x"), "MIME type")
+	l.fails(l.invoke("add_ticket_attachment", "t1", "photo2", "board.jpg", "image/jpeg", "-1", hash, "s3://x"), "Size must be")
+	l.fails(l.invoke("add_ticket_attachment", "t1", "photo2", "board.jpg", "image/jpeg", "100", "9f86d0", "s3://x"), "SHA-256")
+	l.as(otherMsp, "").fails(l.invoke("add_ticket_attachment", "t1", "photo2", "board.jpg", "image/jpeg", "100", hash, "s3://x"), "another company")
+
+	var verification struct {
+		Attachment Attachment `json:"attachment"`
+		Match      bool       `json:"match"`
+	}
+	json.Unmarshal(l.as(customerMsp, "owner1").ok(l.invoke("verify_attachment", "t1", "photo1", strings.ToLower(hash))), &verification)
+	if !verification.Match || verification.Attachment.Uploader != "tech2" {
+		t.Fatalf("expected the anchored hash to match - %+v", verification)
+	}
+	json.Unmarshal(l.ok(l.invoke("verify_attachment", "t1", "photo1", strings.Repeat("00", 32))), &verification)
+	if verification.Match {
+		t.Fatal("expected a changed file not to match")
+	}
+	l.fails(l.invoke("verify_attachment", "t1", "photo9", hash), "does not exist")
+	l.as(otherMsp, "").fails(l.invoke("verify_attachment", "t1", "photo1", hash), "another company")
+
+	var details TicketDetails
+	json.Unmarshal(l.as(customerMsp, "owner1").ok(l.invoke("read_ticket", "t1")), &details)
+	if len(details.Attachments) != 1 || details.Attachments[0].Sha256 != strings.ToLower(hash) || details.Attachments[0].StorageUri != "s3://tickets/t1/board.jpg" {
+		t.Fatalf("expected the attachment listed on the ticket - %+v", details.Attachments)
+	}
+}
+
+// ----- sign-off ----- //
+
+func TestCustomerSignoff(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "software"))
+
+	// nobody closes a ticket without the owner's sign-off
+	l.as(customerMsp, "tech2").fails(l.invoke("set_ticket_status", "t1", STATUS_CLOSED), "closed by their owner")
+	l.fails(l.invoke("set_ticket_status", "t1", STATUS_RESOLVED), "use request_customer_signoff")
+	l.asAdmin().fails(l.invoke("set_ticket_status", "t1", STATUS_RESOLVED), "use request_customer_signoff")
+	l.asAdmin().fails(l.invoke("set_ticket_status", "t1", STATUS_CLOSED), "closed by their owner")
+	l.as(customerMsp, "tech2").ok(l.invoke("set_ticket_status", "t1", STATUS_IN_PROGRESS))
+	l.as(customerMsp, "owner1")
+	l.fails(l.invoke("init_ticket", "t2", "no keyboard", "2017-07-20", STATUS_CLOSED, "owner1", "tech2", "SN1", "software",
+		"ThinkPad", "T470", "diagnostic", "none", "pw"), "cannot start closed")
+
+	// only the assignee asks
+	l.as(customerMsp, "owner1").fails(l.invoke("request_customer_signoff", "t1", "fixed"), "Only the assignee")
+	l.as(otherMsp, "").fails(l.invoke("request_customer_signoff", "t1", "fixed"), "another company")
+	l.as(customerMsp, "tech2").ok(l.invoke("request_customer_signoff", "t1", "replaced the cable"))
+	if l.event() != "signoff_requested" || l.getTicket("t1").Status != STATUS_RESOLVED {
+		t.Fatalf("expected t1 resolved and waiting for sign-off, got %q %+v", l.event(), l.getTicket("t1"))
+	}
+	l.fails(l.invoke("request_customer_signoff", "t1", "fixed"), "already waiting")
+
+	// only the owner answers, a rejection needs a reason and reopens the ticket
+	l.as(customerMsp, "tech2").fails(l.invoke("accept_resolution", "t1"), "Only the ticket's owner")
+	l.asAdmin().fails(l.invoke("accept_resolution", "t1"), "Only the ticket's owner")
+	l.as(customerMsp, "owner1").fails(l.invoke("reject_resolution", "t1", " "), "reason is required")
+	l.ok(l.invoke("reject_resolution", "t1", "still flickers"))
+	ticket := l.getTicket("t1")
+	if l.event() != "signoff_rejected" || ticket.Status != STATUS_IN_PROGRESS || ticket.Signoffs[0].Outcome != SIGNOFF_REJECTED {
+		t.Fatalf("expected t1 reopened with the rejection - %q %+v", l.event(), ticket)
+	}
+
+	// reopening withdraws a pending sign-off
+	l.as(customerMsp, "tech2").ok(l.invoke("request_customer_signoff", "t1", "replaced the screen"))
+	l.ok(l.invoke("set_ticket_status", "t1", STATUS_IN_PROGRESS))
+	if ticket = l.getTicket("t1"); ticket.Signoffs[1].Outcome != SIGNOFF_WITHDRAWN {
+		t.Fatalf("expected the sign-off withdrawn - %+v", ticket.Signoffs)
+	}
+	l.as(customerMsp, "owner1").fails(l.invoke("accept_resolution", "t1"), "not waiting")
+
+	// accepting closes the ticket
+	l.as(customerMsp, "tech2").ok(l.invoke("request_customer_signoff", "t1", "replaced the board"))
+	l.as(customerMsp, "owner1").ok(l.invoke("accept_resolution", "t1", "works again"))
+	ticket = l.getTicket("t1")
+	if l.event() != "signoff_accepted" || ticket.Status != STATUS_CLOSED || len(ticket.ClosedOn) == 0 {
+		t.Fatalf("expected t1 closed by the sign-off - %q %+v", l.event(), ticket)
+	}
+	if len(ticket.Signoffs) != 3 || ticket.Signoffs[2].AnsweredBy != "owner1" || ticket.Signoffs[2].Comment != "works again" {
+		t.Fatalf("expected every sign-off kept - %+v", ticket.Signoffs)
+	}
+	l.as(customerMsp, "tech2").fails(l.invoke("request_customer_signoff", "t1", "fixed"), "already closed")
+
+	// a closed ticket stays closed unless an admin reopens it
+	l.fails(l.invoke("set_ticket_status", "t1", STATUS_OPEN), "Only an admin can reopen")
+	l.as(customerMsp, "owner1").fails(l.invoke("set_ticket_status", "t1", STATUS_IN_PROGRESS), "Only an admin can reopen")
+	if ticket = l.getTicket("t1"); ticket.Status != STATUS_CLOSED || len(ticket.ClosedOn) == 0 {
+		t.Fatalf("expected t1 still closed - %+v", ticket)
+	}
+	l.asAdmin().ok(l.invoke("set_ticket_status", "t1", STATUS_IN_PROGRESS))
+	if ticket = l.getTicket("t1"); ticket.Status != STATUS_IN_PROGRESS || len(ticket.ClosedOn) != 0 {
+		t.Fatalf("expected t1 reopened by the admin - %+v", ticket)
+	}
+}
+
+// ----- spare parts ----- //
+
+func TestSpareParts(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "owner3", ROLE_USER)
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	l.ok(l.ticket(customerMsp, "t1", "fan noise", "owner1", "tech2", "X1", "software"))
+	l.ok(l.ticket(otherMsp, "t3", "fan noise", "owner3", "tech3", "X3", "software"))
+
+	// companies sharing a site keep their own stock
+	l.as(customerMsp, "owner1").fails(l.invoke("restock_part", "Dublin", "FAN-120", "3"), "Only an admin or an employee who works tickets")
+	l.as(customerMsp, "tech2").ok(l.invoke("restock_part", "Dublin", "FAN-120", "3", "120mm fan", "1", "14.50"))
+	l.as(otherMsp, "tech3").ok(l.invoke("restock_part", "Dublin", "FAN-120", "5"))
+	readPart := func(args ...string) Part {
+		var part Part
+		json.Unmarshal(l.ok(l.invoke("read_part", args...)), &part)
+		return part
+	}
+	if l.as(customerMsp, "tech2"); readPart("Dublin", "FAN-120").Quantity != 3 {
+		t.Fatal("expected 3 in the customer's stock")
+	}
+	if l.as(otherMsp, "tech3"); readPart("Dublin", "FAN-120").Quantity != 5 {
+		t.Fatal("expected 5 in the other company's stock")
+	}
+	l.fails(l.invoke("read_part", "Dublin", "FAN-120", customerMsp), "another company")
+	if l.as(providerMsp, "tech1"); readPart("Dublin", "FAN-120", customerMsp).Quantity != 3 {
+		t.Fatal("expected support staff to read the customer's stock")
+	}
+
+	// stock is decremented, never below zero, and low stock is reported once
+	l.as(customerMsp, "tech2").fails(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "4"), "Insufficient stock of FAN-120 at Dublin, 3 left")
+	l.fails(l.invoke("consume_part", "t1", "Dublin", "FAN-999", "1"), "not stocked")
+	l.fails(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "0"), "positive whole number")
+	l.ok(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "1"))
+	if l.event() != "part_consumed" {
+		t.Fatalf("expected part_consumed above the reorder level, got %q", l.event())
+	}
+	l.ok(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "1"))
+	if l.event() != "part_low_stock" {
+		t.Fatalf("expected part_low_stock when reaching the reorder level, got %q", l.event())
+	}
+	l.ok(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "1"))
+	if l.event() != "part_consumed" {
+		t.Fatalf("expected part_low_stock only once, got %q", l.event())
+	}
+	l.fails(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "1"), "0 left")
+	if readPart("Dublin", "FAN-120").Quantity != 0 {
+		t.Fatal("expected the customer's stock used up")
+	}
+	l.fails(l.invoke("consume_part", "t3", "Dublin", "FAN-120", "1"), "another company")
+
+	// the other company's tickets use their own stock
+	l.as(otherMsp, "tech3").ok(l.invoke("consume_part", "t3", "Dublin", "FAN-120", "2"))
+	if readPart("Dublin", "FAN-120").Quantity != 3 {
+		t.Fatal("expected the other company's stock decremented")
+	}
+
+	var details TicketDetails
+	json.Unmarshal(l.as(customerMsp, "owner1").ok(l.invoke("read_ticket", "t1")), &details)
+	if len(details.Parts) != 3 || details.Parts[0].Cost != 14.5 {
+		t.Fatalf("expected the parts used on the ticket - %+v", details.Parts)
+	}
+}
+
+// ----- ticket cost ----- //
+
+func TestTicketCost(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.config("labour_rate", "standard", "60")
+	l.ok(l.ticket(customerMsp, "t1", "fan noise", "owner1", "tech2", "X1", "software"))
+	l.as(customerMsp, "tech2").ok(l.invoke("restock_part", "Dublin", "FAN-120", "5", "120mm fan", "0", "14.50"))
+
+	l.fails(l.invoke("log_time", "t1", "tech1", "30", "standard"), "only log their own time")
+	l.fails(l.invoke("log_time", "t1", "tech2", "30", "overtime"), "Unknown rate category")
+	l.ok(l.invoke("log_time", "t1", "tech2", "30", "standard"))
+	l.ok(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "1"))
+	l.ok(l.invoke("request_customer_signoff", "t1", "replaced the fan"))
+	if cost := l.getTicket("t1").Cost; cost == nil || cost.Minutes != 30 || cost.Labour != 30 || cost.Parts != 14.5 || cost.Total != 44.5 {
+		t.Fatalf("expected the cost worked out on resolution - %+v", cost)
+	}
+
+	// the cost of a resolved ticket is final
+	l.fails(l.invoke("log_time", "t1", "tech2", "30", "standard"), "resolved ticket")
+	l.fails(l.invoke("consume_part", "t1", "Dublin", "FAN-120", "1"), "resolved ticket")
+
+	// reopening lets work go on and resolving again works the cost out again
+	l.as(customerMsp, "owner1").ok(l.invoke("reject_resolution", "t1", "still noisy"))
+	l.as(customerMsp, "tech2").ok(l.invoke("log_time", "t1", "tech2", "30", "standard"))
+	l.ok(l.invoke("request_customer_signoff", "t1", "replaced the fan again"))
+	l.as(customerMsp, "owner1").ok(l.invoke("accept_resolution", "t1"))
+	if cost := l.getTicket("t1").Cost; cost == nil || cost.Minutes != 60 || cost.Total != 74.5 {
+		t.Fatalf("expected the cost worked out again - %+v", cost)
+	}
+	l.as(customerMsp, "tech2").fails(l.invoke("log_time", "t1", "tech2", "30", "standard"), "resolved ticket")
+}
+
+// ----- invoices ----- //
+
+func TestGenerateInvoice(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.config("labour_rate", "standard", "60")
+	l.employee(providerMsp, "powner", ROLE_USER)
+	l.asset(providerMsp, "SNP", "thinkpad", "powner")
+	l.ok(l.invoke("update_ibmasset", "SNP", `{"warrantyend": "2016-01-01", "costcentre": "CC-1001"}`))
+	closed := map[string]string{"p1": "2017-03-01", "p2": "2017-03-31", "p3": "2017-04-01"}
+	for _, id := range []string{"p1", "p2", "p3"} {
+		l.ok(l.ticketAt(day("2017-03-01"), providerMsp, id, "keyboard broken", "powner", "tech1", "SNP", "hardware"))
+		l.as(providerMsp, "tech1").ok(l.invoke("log_time", id, "tech1", "60", "standard"))
+		l.closeAt(day(closed[id]), providerMsp, id, "tech1", "powner")
+	}
+	if chargedTo := l.getTicket("p1").ChargedTo; chargedTo == nil || chargedTo.CostCentre != "CC-1001" || chargedTo.Owner != "powner" {
+		t.Fatalf("expected the asset's cost centre and owner frozen on closure - %+v", chargedTo)
+	}
+
+	// a later change of the asset's cost centre does not move closed repairs
+	l.as(providerMsp, "powner").ok(l.invoke("update_ibmasset", "SNP", `{"costcentre": "CC-2002"}`))
+	l.asAdmin().fails(l.invoke("generate_invoice", "inv0", "CC-2002", "2017-03-01", "2017-04-30"), "No billable tickets")
+
+	l.as(providerMsp, "tech1").fails(l.invoke("generate_invoice", "inv1", "CC-1001", "2017-03-01", "2017-03-31"), "Only an admin")
+	var invoice Invoice
+	l.asAdmin().ok(l.invoke("generate_invoice", "inv1", "CC-1001", "2017-03-01", "2017-03-31"))
+	if l.event() != "invoice_generated" {
+		t.Fatalf("expected invoice_generated event, got %q", l.event())
+	}
+	json.Unmarshal(l.ok(l.invoke("read_invoice", "inv1")), &invoice)
+	if len(invoice.Lines) != 2 || invoice.Total != 120 {
+		t.Fatalf("expected the tickets closed from the start day to the end day included - %+v", invoice)
+	}
+	for _, line := range invoice.Lines {
+		if line.Ticket_Id == "p3" {
+			t.Fatalf("expected the ticket closed after the end day left out - %+v", invoice.Lines)
+		}
+	}
+	if l.getTicket("p2").Invoice != "inv1" || len(l.getTicket("p3").Invoice) != 0 {
+		t.Fatal("expected only the invoiced tickets marked")
+	}
+
+	// a ticket is billed once
+	l.fails(l.invoke("generate_invoice", "inv1", "CC-1001", "2017-03-01", "2017-04-30"), "already exists")
+	l.fails(l.invoke("generate_invoice", "inv2", "CC-1001", "2017-03-01", "2017-03-31"), "No billable tickets")
+	json.Unmarshal(l.ok(l.invoke("generate_invoice", "inv2", "CC-1001", "2017-03-01", "2017-04-01")), &invoice)
+	if len(invoice.Lines) != 1 || invoice.Lines[0].Ticket_Id != "p3" {
+		t.Fatalf("expected only the ticket not billed yet - %+v", invoice.Lines)
+	}
+	l.as(customerMsp, "owner1").fails(l.invoke("read_invoice", "inv1"), "another company")
+}
+
+// ----- rma ----- //
+
+func TestRmaReplacesAsset(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.asset(customerMsp, "SN2", "thinkpad", "owner1")
+	l.ok(l.invoke("update_ibmasset", "SN1", `{"model": "T470", "costcentre": "CC-1001"}`))
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "hardware"))
+	l.ok(l.ticket(customerMsp, "t2", "printer jam", "owner1", "tech2", "X1", "hardware"))
+	status := l.getAsset("SN1").Status
+
+	l.as(customerMsp, "tech2").fails(l.invoke("open_rma", "t2", "rma1", "Lenovo", "RMA-1"), "no asset on the ledger")
+	l.ok(l.invoke("open_rma", "t1", "rma1", "Lenovo", "RMA-1"))
+	l.fails(l.invoke("open_rma", "t1", "rma1", "Lenovo", "RMA-1"), "already exists")
+	l.as(otherMsp, "").fails(l.invoke("open_rma", "t1", "rma2", "Lenovo", "RMA-2"), "another company")
+	l.fails(l.invoke("ship_rma", "t1", "rma1", "2017-02-01"), "another company")
+
+	// open, shipped, received in that order
+	l.as(customerMsp, "tech2").fails(l.invoke("receive_rma", "t1", "rma1", "2017-02-09", "SN1R"), "Only shipped RMAs")
+	l.fails(l.invoke("ship_rma", "t1", "rma1", "01-02-2017"), "YYYY-MM-DD")
+	l.ok(l.invoke("ship_rma", "t1", "rma1", "2017-02-01"))
+	l.fails(l.invoke("ship_rma", "t1", "rma1", "2017-02-02"), "already shipped")
+	l.ok(l.invoke("receive_rma", "t1", "rma1", "2017-02-09", "SN1R"))
+	if l.event() != "rma_received" {
+		t.Fatalf("expected rma_received event, got %q", l.event())
+	}
+
+	// the replacement takes the original's place and the two point at each other
+	original, replacement := l.getAsset("SN1"), l.getAsset("SN1R")
+	if original.Status != ASSET_RETIRED || original.ReplacedBy != "SN1R" {
+		t.Fatalf("expected the original retired and linked - %+v", original)
+	}
+	if replacement.Replaces != "SN1" || replacement.Status != status || replacement.CostCentre != "CC-1001" || replacement.Company != customerMsp {
+		t.Fatalf("expected the replacement with the original's attributes - %+v", replacement)
+	}
+	if l.getTicket("t1").Asset != "SN1R" {
+		t.Fatal("expected the ticket moved to the replacement")
+	}
+	if ids, _ := get_ticket_ids_by(l.stub, TICKET_ASSET_INDEX, "SN1R"); len(ids) != 1 || ids[0] != "t1" {
+		t.Fatalf("expected the ticket found by the replacement - %v", ids)
+	}
+	if ids, _ := get_ticket_ids_by(l.stub, TICKET_ASSET_INDEX, "SN1"); len(ids) != 0 {
+		t.Fatalf("expected the ticket no longer found by the original - %v", ids)
+	}
+	var details TicketDetails
+	json.Unmarshal(l.ok(l.invoke("read_ticket", "t1")), &details)
+	if len(details.Rmas) != 1 || details.Rmas[0].Status != RMA_RECEIVED || details.Rmas[0].ReplacementSerial != "SN1R" || details.Rmas[0].ShippedOn != "2017-02-01" {
+		t.Fatalf("expected the RMA on the ticket - %+v", details.Rmas)
+	}
+
+	// the same device coming back changes no asset, a serial already on the ledger is refused
+	l.ok(l.invoke("open_rma", "t1", "rma2", "Lenovo", "RMA-2"))
+	l.ok(l.invoke("ship_rma", "t1", "rma2", "2017-03-01"))
+	l.ok(l.invoke("receive_rma", "t1", "rma2", "2017-03-09", "SN1R"))
+	if asset := l.getAsset("SN1R"); asset.Status == ASSET_RETIRED || len(asset.ReplacedBy) != 0 {
+		t.Fatalf("expected the repaired device kept - %+v", asset)
+	}
+	l.ok(l.invoke("open_rma", "t1", "rma3", "Lenovo", "RMA-3"))
+	l.ok(l.invoke("ship_rma", "t1", "rma3", "2017-04-01"))
+	l.fails(l.invoke("receive_rma", "t1", "rma3", "2017-04-09", "SN2"), "already an asset")
+}
+
+// ----- visits ----- //
+
+func TestSiteVisits(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(otherMsp, "tech3", ROLE_TECHNICIAN)
+	l.ok(l.invoke("update_ibmasset", "SN1", `{"site": "Dublin"}`))
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "software"))
+	l.ok(l.ticket(customerMsp, "t2", "printer jam", "owner1", "tech2", "X1", "software"))
+
+	l.as(customerMsp, "owner1").fails(l.invoke("schedule_visit", "t1", "v1", "tech2", "2017-02-01T09:00:00Z", "2017-02-01T11:00:00Z"), "Only an admin or an employee who works tickets")
+	l.as(customerMsp, "tech2")
+	l.fails(l.invoke("schedule_visit", "t1", "v1", "tech3", "2017-02-01T09:00:00Z", "2017-02-01T11:00:00Z"), "works for another company")
+	l.fails(l.invoke("schedule_visit", "t1", "v1", "tech2", "2017-02-01T11:00:00Z", "2017-02-01T09:00:00Z"), "must be after window start")
+	l.fails(l.invoke("schedule_visit", "t2", "v1", "tech2", "2017-02-01T09:00:00Z", "2017-02-01T11:00:00Z"), "Expecting a site")
+	l.ok(l.invoke("schedule_visit", "t1", "v1", "tech2", "2017-02-01T10:00:00+01:00", "2017-02-01T11:00:00Z"))
+	if l.event() != "visit_scheduled" {
+		t.Fatalf("expected visit_scheduled event, got %q", l.event())
+	}
+	visit, found, _ := get_visit(l.stub, "tech2", "v1")
+	if !found || visit.Site != "Dublin" || visit.WindowStart != "2017-02-01T09:00:00Z" || visit.Status != VISIT_SCHEDULED {
+		t.Fatalf("expected the visit at the asset's site in UTC - %+v", visit)
+	}
+
+	// a technician is booked once at a time, back to back is fine
+	l.fails(l.invoke("schedule_visit", "t2", "v1", "tech2", "2017-02-02T09:00:00Z", "2017-02-02T11:00:00Z", "Cork"), "already exists")
+	l.fails(l.invoke("schedule_visit", "t2", "v2", "tech2", "2017-02-01T10:30:00Z", "2017-02-01T12:00:00Z", "Cork"), "already has visit v1")
+	l.ok(l.invoke("schedule_visit", "t2", "v2", "tech2", "2017-02-01T11:00:00Z", "2017-02-01T12:00:00Z", "Cork"))
+
+	// only the technician checks in and out, in that order
+	l.as(customerMsp, "owner1").fails(l.invoke("check_in", "v1"), "has no visit v1")
+	l.as(customerMsp, "tech2").fails(l.invoke("check_out", "v1"), "expecting checked in")
+	l.ok(l.invokeAt(day("2017-02-01"), check_in, "v1"))
+	if l.event() != "visit_checked_in" {
+		t.Fatalf("expected visit_checked_in event, got %q", l.event())
+	}
+	l.fails(l.invoke("check_in", "v1"), "expecting scheduled")
+	l.ok(l.invokeAt(day("2017-02-01").Add(time.Hour), check_out, "v1"))
+	visit, _, _ = get_visit(l.stub, "tech2", "v1")
+	if visit.Status != VISIT_COMPLETED || visit.CheckedIn != "2017-02-01T12:00:00Z" || visit.CheckedOut != "2017-02-01T13:00:00Z" {
+		t.Fatalf("expected the actual times on the completed visit - %+v", visit)
+	}
+
+	// completed visits free the window, resolved tickets take no visits
+	l.ok(l.invoke("schedule_visit", "t2", "v3", "tech2", "2017-02-01T09:00:00Z", "2017-02-01T10:00:00Z", "Cork"))
+	l.ok(l.invoke("request_customer_signoff", "t1", "fixed on site"))
+	l.fails(l.invoke("schedule_visit", "t1", "v4", "tech2", "2017-02-03T09:00:00Z", "2017-02-03T10:00:00Z"), "resolved ticket")
+	l.as(otherMsp, "tech3").fails(l.invoke("schedule_visit", "t2", "v4", "tech3", "2017-02-03T09:00:00Z", "2017-02-03T10:00:00Z", "Cork"), "another company")
+}
+
+// ----- maintenance ----- //
+
+func TestMaintenanceScheduler(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.employee(providerMsp, "powner", ROLE_USER)
+	l.employee(providerMsp, "tech9", ROLE_TECHNICIAN)
+	l.asset(providerMsp, "P1", "ups", "powner")
+	l.asset(providerMsp, "P2", "ups", "powner")
+	l.asset(providerMsp, "P3", "thinkpad", "powner")
+	l.asset(customerMsp, "U1", "ups", "owner1")
+	l.asAdmin().ok(l.invoke("set_maintenance_plan", "a", "assettype:ups", "90", "2017-01-01", "hardware", "powner", "tech1", "battery,fans", "UPS service"))
+	l.ok(l.invoke("set_maintenance_plan", "b", "asset:P3", "90", "2017-01-01", "hardware", "powner", "tech9", "hinges", "Laptop service"))
+	l.ok(l.invoke("set_maintenance_plan", "c", "asset:P3", "90", "2017-01-01", "software", "powner", "tech1", "updates", "Patching"))
+	l.ok(l.invoke("deactivate_employee", "tech9"))
+	l.ok(l.ticket(providerMsp, "pm-a-P1-1", "taken", "powner", "tech1", "X1", "software"))
+
+	type schedulerRun struct {
+		Opened  []string `json:"opened"`
+		Skipped []struct {
+			Plan_Id string `json:"plan_id"`
+			Asset   string `json:"asset"`
+			Error   string `json:"error"`
+		} `json:"skipped"`
+	}
+	l.as(providerMsp, "tech1").fails(l.invokeAt(day("2017-04-05"), run_maintenance_scheduler), "Only an admin")
+
+	// a failing asset is skipped and reported, the plan's other assets and the other plans still open their tickets
+	var run schedulerRun
+	json.Unmarshal(l.asAdmin().ok(l.invokeAt(day("2017-04-05"), run_maintenance_scheduler)), &run)
+	sort.Strings(run.Opened)
+	if strings.Join(run.Opened, ",") != "pm-a-P2-1,pm-c-P3-1" {
+		t.Fatalf("expected the tickets of the working plans and assets - %+v", run)
+	}
+	if len(run.Skipped) != 2 || run.Skipped[0].Plan_Id != "a" || run.Skipped[0].Asset != "P1" || !strings.Contains(run.Skipped[0].Error, "already exists") {
+		t.Fatalf("expected a's taken ticket id reported as skipped - %+v", run.Skipped)
+	}
+	if run.Skipped[1].Plan_Id != "b" || run.Skipped[1].Asset != "P3" || !strings.Contains(run.Skipped[1].Error, "deactivated") {
+		t.Fatalf("expected b reported as skipped - %+v", run.Skipped)
+	}
+	if l.event() != "maintenance_tickets_opened" || !strings.Contains(string(l.events[0].Payload), `"plan_id":"b"`) {
+		t.Fatalf("expected the skipped plan in the event - %q %s", l.event(), l.events[0].Payload)
+	}
+	ticket := l.getTicket("pm-a-P2-1")
+	if ticket.MaintenancePlan != "a" || len(ticket.Checklist) < 2 || ticket.Checklist[0].Name != "battery" || !ticket.Checklist[0].Mandatory {
+		t.Fatalf("expected the plan's checklist on the ticket - %+v", ticket)
+	}
+
+	// once per plan, asset and period
+	json.Unmarshal(l.ok(l.invokeAt(day("2017-04-06"), run_maintenance_scheduler)), &run)
+	if len(run.Opened) != 0 || len(run.Skipped) != 2 {
+		t.Fatalf("expected nothing opened twice in a period - %+v", run)
+	}
+	json.Unmarshal(l.ok(l.invokeAt(day("2017-07-05"), run_maintenance_scheduler, "1")), &run)
+	if len(run.Opened) != 1 || run.Opened[0] != "pm-a-P1-2" {
+		t.Fatalf("expected max to limit the run - %+v", run)
+	}
+
+	// plan and serial numbers with '-' never give the same ticket id
+	l.asset(providerMsp, "f", "router", "powner")
+	l.asset(providerMsp, "e-f", "router", "powner")
+	l.asAdmin().ok(l.invoke("set_maintenance_plan", "d-e", "asset:f", "90", "2017-07-01", "software", "powner", "tech1", "firmware", "Router service"))
+	l.ok(l.invoke("set_maintenance_plan", "d", "asset:e-f", "90", "2017-07-01", "software", "powner", "tech1", "firmware", "Router service"))
+	json.Unmarshal(l.ok(l.invokeAt(day("2017-07-06"), run_maintenance_scheduler)), &run)
+	if l.getTicket("pm-d%2De-f-0").Asset != "f" || l.getTicket("pm-d-e%2Df-0").Asset != "e-f" {
+		t.Fatalf("expected a ticket for each plan and asset - %+v", run)
+	}
+}
+
+// ----- checklists ----- //
+
+func TestDiagnosticChecklist(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.as(customerMsp, "tech2").fails(l.invoke("set_checklist_template", "ThinkPad", `[{"name": "post"}]`), "Only an admin")
+	l.asAdmin()
+	l.fails(l.invoke("set_checklist_template", "ThinkPad", `[]`), "at least one item")
+	l.fails(l.invoke("set_checklist_template", "ThinkPad", `[{"name": "post"}, {"name": "post"}]`), "listed twice")
+	l.fails(l.invoke("set_checklist_template", "ThinkPad", `[{"name": "post", "weight": 2}]`), "JSON array of {name, mandatory}")
+	l.ok(l.invoke("set_checklist_template", "ThinkPad", `[{"name": "power on self test", "mandatory": true}, {"name": "battery health"}]`))
+
+	// new tickets on the asset type start with the checklist, other assets with none
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "software"))
+	l.ok(l.ticket(customerMsp, "t2", "printer jam", "owner1", "tech2", "X1", "software"))
+	checklist := l.getTicket("t1").Checklist
+	if len(checklist) != 2 || checklist[0].Name != "power on self test" || !checklist[0].Mandatory || checklist[1].Mandatory {
+		t.Fatalf("expected the asset type's checklist - %+v", checklist)
+	}
+	if len(l.getTicket("t2").Checklist) != 0 {
+		t.Fatal("expected no checklist for an unknown asset")
+	}
+
+	// mandatory items block resolving until they have a result
+	l.as(customerMsp, "tech2").fails(l.invoke("request_customer_signoff", "t1", "fixed"), "unchecked mandatory checklist items - power on self test")
+	l.as(customerMsp, "owner1").fails(l.invoke("update_checklist_item", "t1", "power on self test", "pass"), "Only an admin or an employee who works tickets")
+	l.as(otherMsp, "").fails(l.invoke("update_checklist_item", "t1", "power on self test", "pass"), "another company")
+	l.as(customerMsp, "tech2")
+	l.fails(l.invoke("update_checklist_item", "t1", "power on self test", "maybe"), "pass or fail")
+	l.fails(l.invoke("update_checklist_item", "t1", "keyboard", "pass"), "no checklist item")
+	l.ok(l.invoke("update_checklist_item", "t1", "power on self test", "FAIL", "beeps 3 times"))
+	item := l.getTicket("t1").Checklist[0]
+	if item.Result != CHECK_FAIL || item.Notes != "beeps 3 times" || item.UpdatedBy != "tech2" {
+		t.Fatalf("expected the result recorded - %+v", item)
+	}
+	l.ok(l.invoke("request_customer_signoff", "t1", "replaced the board"))
+	l.fails(l.invoke("update_checklist_item", "t1", "battery health", "pass"), "resolved ticket")
+
+	// a changed template only applies to new tickets
+	l.asAdmin().ok(l.invoke("set_checklist_template", "thinkpad", `[{"name": "hinges", "mandatory": true}]`))
+	if checklist = l.getTicket("t1").Checklist; checklist[0].Name != "power on self test" {
+		t.Fatalf("expected the open ticket to keep its checklist - %+v", checklist)
+	}
+	l.ok(l.ticket(customerMsp, "t3", "loose hinge", "owner1", "tech2", "SN1", "software"))
+	if checklist = l.getTicket("t3").Checklist; len(checklist) != 1 || checklist[0].Name != "hinges" {
+		t.Fatalf("expected the new template on a new ticket - %+v", checklist)
+	}
+}
+
+// ----- custom fields ----- //
+
+func TestCustomFields(t *testing.T) {
+	l := newTestLedger(t).customer()
+	fields := `[{"name": "osversion", "type": "string", "required": true, "enum": ["Windows 10", "Windows 11"]},
+		{"name": "users", "type": "number"}, {"name": "vip", "type": "bool"}, {"name": "since", "type": "date"}]`
+	l.as(customerMsp, "tech2").fails(l.invoke("set_custom_fields", "software", fields), "Only an admin")
+	l.asAdmin()
+	l.fails(l.invoke("set_custom_fields", "printers", fields), "Unknown queue")
+	l.fails(l.invoke("set_custom_fields", "software", `[{"name": "users", "type": "integer"}]`), "must be of type")
+	l.fails(l.invoke("set_custom_fields", "software", `[{"name": "users", "type": "number", "enum": ["1"]}]`), "Only string custom fields take enum")
+	l.fails(l.invoke("set_custom_fields", "software", `[{"name": "users", "type": "number", "min": 1}]`), "JSON array of {name, type, required, enum}")
+	l.ok(l.invoke("set_custom_fields", "software", fields))
+
+	var schema CustomFieldSchema
+	json.Unmarshal(l.as(customerMsp, "owner1").ok(l.invoke("read_custom_fields", "software")), &schema)
+	if len(schema.Fields) != 4 || !schema.Fields[0].Required {
+		t.Fatalf("expected the queue's fields - %+v", schema)
+	}
+
+	// tickets are checked against their queue's fields
+	l.fails(l.ticketWithFields("t1", `{"users": 3}`), "osversion is required")
+	l.fails(l.ticketWithFields("t1", `{"osversion": "Windows 7"}`), "must be one of Windows 10, Windows 11")
+	l.fails(l.ticketWithFields("t1", `{"osversion": "Windows 10", "users": "3"}`), "users must be a number")
+	l.fails(l.ticketWithFields("t1", `{"osversion": "Windows 10", "vip": "yes"}`), "vip must be true or false")
+	l.fails(l.ticketWithFields("t1", `{"osversion": "Windows 10", "since": "20-07-2017"}`), "since must be a YYYY-MM-DD date")
+	l.fails(l.ticketWithFields("t1", `{"osversion": "Windows 10", "colour": "red"}`), "has no custom field colour")
+	l.fails(l.ticketWithFields("t1", `not json`), "must be a JSON object")
+	l.ok(l.ticketWithFields("t1", `{"osversion": "Windows 10", "users": 3, "vip": true, "since": "2017-07-01"}`))
+	l.fails(l.ticket(customerMsp, "t2", "no display", "owner1", "tech2", "X1", "software"), "osversion is required")
+
+	// updates merge into the ticket's fields and are checked again
+	l.fails(l.invoke("update_ticket", "t1", `{"customFields": {"osversion": null}}`), "osversion is required")
+	l.ok(l.invoke("update_ticket", "t1", `{"customFields": {"osversion": "Windows 11", "users": null}}`))
+	custom := l.getTicket("t1").CustomFields
+	if custom["osversion"] != "Windows 11" || custom["vip"] != true {
+		t.Fatalf("expected the fields merged - %+v", custom)
+	}
+	if _, ok := custom["users"]; ok {
+		t.Fatalf("expected null to remove a field - %+v", custom)
+	}
+}
+
+// ----- tags ----- //
+
+func TestTags(t *testing.T) {
+	l := newTestLedger(t).customer()
+	l.asset(customerMsp, "SN2", "thinkpad", "owner1")
+	l.ok(l.ticket(customerMsp, "t1", "no display", "owner1", "tech2", "SN1", "software"))
+	tagged := func(tag string, objectType string, id string) bool {
+		key, _ := tag_key(l.stub, tag, objectType, id)
+		_, found := l.stub.State[key]
+		return found
+	}
+
+	l.ok(l.invoke("add_tag", "ticket", "t1", "Blue  Screen"))
+	l.ok(l.invoke("add_tag", "ticket", "t1", "blue-screen"))
+	l.ok(l.invoke("add_tag", "ticket", "t1", "urgent"))
+	if tags := l.getTicket("t1").Tags; strings.Join(tags, ",") != "blue-screen,urgent" || !tagged("urgent", "ticket", "t1") {
+		t.Fatalf("expected the ticket tagged once per tag - %v", tags)
+	}
+	l.fails(l.invoke("add_tag", "ticket", "t1", "red/green"), "may only contain")
+	l.fails(l.invoke("add_tag", "asset", "SN1", "spare"), "'ticket' and 'ibm_asset' only")
+	l.as(otherMsp, "").fails(l.invoke("add_tag", "ticket", "t1", "mine"), "another company")
+
+	// assets are tagged under their docType
+	l.as(customerMsp, "owner1").ok(l.invoke("add_tag", "ibm_asset", "SN1", "spare"))
+	l.ok(l.invoke("add_tag", "ibm_asset", "SN2", "spare"))
+	if !tagged("spare", "ibm_asset", "SN1") || tagged("spare", "asset", "SN1") {
+		t.Fatal("expected the asset's tag indexed under ibm_asset")
+	}
+
+	l.ok(l.invoke("remove_tag", "ticket", "t1", "Urgent"))
+	if tags := l.getTicket("t1").Tags; strings.Join(tags, ",") != "blue-screen" || tagged("urgent", "ticket", "t1") {
+		t.Fatalf("expected the tag removed from the ticket and the index - %v", tags)
+	}
+	l.ok(l.invoke("delete_ibmasset", "SN2", customerMsp))
+	if tagged("spare", "ibm_asset", "SN2") {
+		t.Fatal("expected a deleted asset's tags removed from the index")
+	}
+}
+
+// ----- duplicates ----- //
+
+func TestDuplicateTickets(t *testing.T) {
+	l := newTestLedger(t).customer()
+	opened := day("2024-03-01")
+	open := func(id string, description string, asset string, when time.Time) pb.Response {
+		return l.ticketAt(when, customerMsp, id, description, "owner1", "tech2", asset, "software")
+	}
+
+	// off unless configured
+	l.ok(open("t1", "outlook crashes on start", "X1", opened))
+	if payload := l.ok(open("t2", "outlook crashes on start", "X1", opened)); len(payload) != 0 {
+		t.Fatalf("expected no duplicate check by default - %s", payload)
+	}
+
+	l.config("duplicate_action", "software", `"reject"`)
+	l.fails(open("t3", "outlook crashes on start", "X2", opened.Add(time.Hour)), "duplicate of t1")
+	l.ok(open("t3", "printer jams on the second page", "X2", opened.Add(time.Hour)))
+
+	// another company's caller learns nothing about the owner's tickets
+	l.as(otherMsp, "")
+	res := l.invokeAt(opened.Add(time.Hour), init_ticket, "t4", "outlook crashes on start", "2017-07-20", STATUS_OPEN, "owner1", "tech2", "X1", "software",
+		"ThinkPad", "T470", "diagnostic", "none", "pw")
+	l.fails(res, "another company")
+	if strings.Contains(res.Message, "t1") {
+		t.Fatalf("expected no ticket id in the error - %s", res.Message)
+	}
+
+	l.config("duplicate_action", "software", `"warn"`)
+	var check DuplicateCheck
+	json.Unmarshal(l.ok(open("t4", "outlook crashes on start", "X1", opened.Add(2*time.Hour))), &check)
+	if check.Action != DUPLICATE_WARN || len(check.Duplicates) != 2 || check.Duplicates[0].Ticket_Id != "t1" || check.Duplicates[0].Reason != "same asset" {
+		t.Fatalf("expected the open tickets on the asset listed - %+v", check)
+	}
+
+	l.config("duplicate_action", "software", `"link"`)
+	json.Unmarshal(l.ok(open("t5", "outlook crashes on start", "X5", opened.Add(3*time.Hour))), &check)
+	if l.getTicket("t5").DuplicateOf != "t1" || check.Duplicates[0].Reason != "same owner" {
+		t.Fatalf("expected the ticket linked to the most similar one - %+v", check)
+	}
+
+	// resolved tickets and tickets older than the window are not originals
+	l.config("duplicate_action", "software", `"reject"`)
+	l.ok(l.invoke("delete_ticket", "t2", customerMsp))
+	l.closeAt(opened.Add(4*time.Hour), customerMsp, "t1", "tech2", "owner1")
+	l.fails(open("t6", "outlook crashes on start", "X1", opened.Add(5*time.Hour)), "duplicate of t4")
+	l.ok(open("t6", "outlook crashes on start", "X1", opened.AddDate(0, 0, 4)))
+	if ids, _ := get_ticket_ids_by(l.stub, TICKET_OWNER_INDEX, "owner1"); strings.Join(ids, ",") != "t1,t3,t4,t5,t6" {
+		t.Fatalf("expected the owner's tickets indexed, deleted ones removed - %v", ids)
+	}
+}